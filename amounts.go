@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+// moneyColumns are the float columns that became money.Money pairs
+// (<column>_amount, <column>_currency)
+var moneyColumns = []struct{ Table, Column string }{
+	{"product", "price"},
+	{"product_variants", "price"},
+	{"orders", "total"},
+	{"order_lines", "unit_price"},
+	{"order_lines", "line_total"},
+}
+
+// scaledAmountSQL multiplies a float column into minor units. Both sides
+// must be numeric: 10 ^ n alone is float8 in Postgres, which turns 19.99
+// into 1998.9999999999998.
+func scaledAmountSQL(column string, exponent int) string {
+	return fmt.Sprintf("(%s::numeric * (10::numeric ^ %d))", column, exponent)
+}
+
+// MigrateMoney moves the old float price and total columns into minor
+// units of currency, the store currency the amounts were entered in. The
+// conversion stays in numeric, and values with fractions of a minor unit
+// stop the migration instead of being rounded.
+func MigrateMoney(db *gorm.DB, currency string) error {
+	exponent, err := money.Exponent(currency)
+	if err != nil {
+		return err
+	}
+	for _, target := range moneyColumns {
+		if !db.Dialect().HasColumn(target.Table, target.Column) {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			scaled := scaledAmountSQL(target.Column, exponent)
+			var inexact struct{ Count int }
+			err := tx.Raw(fmt.Sprintf(`SELECT count(*) AS count FROM %s WHERE %s <> trunc(%s)`,
+				target.Table, scaled, scaled)).Scan(&inexact).Error
+			if err != nil {
+				return err
+			}
+			if inexact.Count > 0 {
+				return fmt.Errorf("%d rows of %s.%s have fractions of a %s minor unit; correct them before upgrading",
+					inexact.Count, target.Table, target.Column, currency)
+			}
+			err = tx.Exec(fmt.Sprintf(`UPDATE %s SET %s_amount = %s::bigint, %s_currency = ? WHERE %s IS NOT NULL`,
+				target.Table, target.Column, scaled, target.Column, target.Column), currency).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(fmt.Sprintf(`ALTER TABLE %s DROP COLUMN %s`, target.Table, target.Column)).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestMigrateMoneyExactDecimals(t *testing.T) {
+	db := testDB(t)
+	err := db.Exec(`CREATE TABLE product (id serial PRIMARY KEY, price float8,
+		price_amount bigint NOT NULL DEFAULT 0, price_currency char(3))`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO product (price) VALUES (19.99), (0.1)`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateMoney(db, "USD"); err != nil {
+		t.Fatalf("MigrateMoney: %v", err)
+	}
+
+	var rows []struct {
+		PriceAmount   int64
+		PriceCurrency string
+	}
+	if err := db.Raw(`SELECT price_amount, price_currency FROM product ORDER BY id`).Scan(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{1999, 10}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i, row := range rows {
+		if row.PriceAmount != want[i] || row.PriceCurrency != "USD" {
+			t.Errorf("row %d = %d %s, want %d USD", i, row.PriceAmount, row.PriceCurrency, want[i])
+		}
+	}
+}
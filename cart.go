@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/models"
+	"golang_api/money"
+)
+
+var errInsufficientStock = errors.New("insufficient stock")
+
+// Struct AddToCartRequest
+// VariantID is required for products with variants and omitted otherwise.
+type AddToCartRequest struct {
+	ProductID uint `json:"product_id"`
+	VariantID uint `json:"variant_id"`
+	Quantity  int  `json:"quantity"`
+}
+
+// Struct UpdateCartItemRequest
+type UpdateCartItemRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// Struct CartLine
+type CartLine struct {
+	ProductID uint              `json:"product_id"`
+	VariantID uint              `json:"variant_id"`
+	SKU       string            `json:"sku"`
+	Options   map[string]string `json:"options,omitempty"`
+	Title     string            `json:"title"`
+	Price     money.Money       `json:"price"`
+	Quantity  int               `json:"quantity"`
+	LineTotal money.Money       `json:"line_total"`
+	// Discount is this line's share of the applied promotions
+	Discount money.Money `json:"discount"`
+	// Tax is only worked out when the request names a country
+	Tax *LineTax `json:"tax,omitempty"`
+}
+
+// Struct CartResponse
+// Total is Subtotal less DiscountTotal, plus TaxTotal unless prices
+// include tax. Shipping is not included.
+type CartResponse struct {
+	ID               uint              `json:"id"`
+	Items            []CartLine        `json:"items"`
+	Subtotal         money.Money       `json:"subtotal"`
+	Discounts        []AppliedDiscount `json:"discounts"`
+	DiscountTotal    money.Money       `json:"discount_total"`
+	FreeShipping     bool              `json:"free_shipping"`
+	Coupons          []CouponStatus    `json:"coupons"`
+	TaxAddress       *TaxAddress       `json:"tax_address,omitempty"`
+	TaxTotal         money.Money       `json:"tax_total"`
+	PricesIncludeTax bool              `json:"prices_include_tax"`
+	Total            money.Money       `json:"total"`
+}
+
+// emptyCartResponse returns a cart without lines in currency
+func emptyCartResponse(id uint, currency string) *CartResponse {
+	return &CartResponse{
+		ID:            id,
+		Items:         []CartLine{},
+		Subtotal:      money.Zero(currency),
+		Discounts:     []AppliedDiscount{},
+		DiscountTotal: money.Zero(currency),
+		Coupons:       []CouponStatus{},
+		TaxTotal:      money.Zero(currency),
+		Total:         money.Zero(currency),
+	}
+}
+
+// cartForAccount returns the account's cart, creating it on first use.
+// Concurrent first requests race on the unique user_id index, so the
+// insert is allowed to do nothing and the row is read back afterwards.
+func cartForAccount(db *gorm.DB, accountID uint) (*models.Cart, error) {
+	cart := &models.Cart{}
+	err := db.Where("user_id = ?", accountID).First(cart).Error
+	if !gorm.IsRecordNotFoundError(err) {
+		return cart, err
+	}
+	now := time.Now()
+	err = db.Exec(`INSERT INTO carts (user_id, created_at, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT DO NOTHING`, accountID, now, now).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Where("user_id = ?", accountID).First(cart).Error
+	return cart, err
+}
+
+// lockCart takes a row lock on the cart so that changes to the same cart
+// are applied one at a time
+func lockCart(tx *gorm.DB, cartID uint) error {
+	return tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("id = ?", cartID).
+		First(&models.Cart{}).Error
+}
+
+// setCartQuantity sets the quantity of a product variant in a locked cart,
+// removing the line when quantity is zero
+func setCartQuantity(tx *gorm.DB, cartID, productID, variantID uint, quantity int) error {
+	if quantity <= 0 {
+		return tx.Unscoped().
+			Where("cart_id = ? AND product_id = ? AND variant_id = ?", cartID, productID, variantID).
+			Delete(&models.CartItem{}).Error
+	}
+	item, err := findSellable(tx, productID, variantID)
+	if err != nil {
+		return err
+	}
+	if quantity > item.Available {
+		return errInsufficientStock
+	}
+	now := time.Now()
+	return tx.Exec(`INSERT INTO cart_items (cart_id, product_id, variant_id, quantity, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (cart_id, product_id, variant_id) DO UPDATE
+		SET quantity = EXCLUDED.quantity, updated_at = EXCLUDED.updated_at`,
+		cartID, productID, variantID, quantity, now, now).Error
+}
+
+// cartQuantity returns the quantity of a product variant in a cart
+func cartQuantity(tx *gorm.DB, cartID, productID, variantID uint) (int, error) {
+	item := models.CartItem{}
+	err := tx.Where("cart_id = ? AND product_id = ? AND variant_id = ?", cartID, productID, variantID).First(&item).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return 0, nil
+	}
+	return item.Quantity, err
+}
+
+// loadCart returns the cart's lines joined with their products and variants,
+// priced in currency with the promotions that apply to them. Tax is added
+// when address is given.
+func (r *Repository) loadCart(ctx context.Context, cart *models.Cart, currency string, address *TaxAddress) (*CartResponse, error) {
+	db := r.DB
+	response := emptyCartResponse(cart.ID, currency)
+	var rows []struct {
+		ProductID     uint
+		VariantID     uint
+		Quantity      int
+		Title         string
+		SKU           string
+		PriceAmount   int64
+		PriceCurrency string
+		VariantPriced bool
+		TaxClass      string
+	}
+	err := db.Table("cart_items").
+		Select(`cart_items.product_id, cart_items.variant_id, cart_items.quantity, product.title,
+			coalesce(product_variants.sku, product.sku) AS sku,
+			coalesce(product_variants.price_amount, product.price_amount) AS price_amount,
+			coalesce(product_variants.price_currency, product.price_currency) AS price_currency,
+			product_variants.price_amount IS NOT NULL AS variant_priced, product.tax_class`).
+		Joins("JOIN product ON product.id = cart_items.product_id AND product.deleted_at IS NULL").
+		Joins("LEFT JOIN product_variants ON product_variants.id = cart_items.variant_id").
+		Where("cart_items.cart_id = ? AND cart_items.deleted_at IS NULL", cart.ID).
+		// Lines of deleted variants are hidden like those of deleted products
+		Where("cart_items.variant_id = 0 OR product_variants.deleted_at IS NULL").
+		Order("cart_items.id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	var variants []ProductVariant
+	for _, row := range rows {
+		if row.VariantID != 0 {
+			variants = append(variants, ProductVariant{ID: row.VariantID})
+		}
+	}
+	if err := preloadVariants(db, variants); err != nil {
+		return nil, err
+	}
+	options := map[uint]map[string]string{}
+	for _, variant := range variants {
+		options[variant.ID] = variant.Options
+	}
+	prices := make([]*localPrice, len(rows))
+	for i, row := range rows {
+		prices[i] = &localPrice{
+			ProductID: row.ProductID,
+			VariantID: row.VariantID,
+			Base:      money.New(row.PriceAmount, row.PriceCurrency),
+			Inherit:   !row.VariantPriced,
+		}
+	}
+	rate, err := r.localizePrices(ctx, db, currency, prices)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]*discountLine, len(rows))
+	productIDs := make([]uint, len(rows))
+	for i, row := range rows {
+		lines[i] = &discountLine{
+			ProductID: row.ProductID,
+			VariantID: row.VariantID,
+			UnitPrice: prices[i].Local,
+			Quantity:  row.Quantity,
+			Discount:  money.Zero(currency),
+		}
+		productIDs[i] = row.ProductID
+	}
+	var accountID uint
+	if cart.UserID != nil {
+		accountID = *cart.UserID
+	}
+	rules, rejected, err := loadPromotionRules(db, cart.ID, accountID, productIDs, time.Now(), false)
+	if err != nil {
+		return nil, err
+	}
+	result, err := applyPromotions(rules, lines, currency, converter(rate))
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		price := prices[i].Local
+		line := CartLine{
+			ProductID: row.ProductID,
+			VariantID: row.VariantID,
+			SKU:       row.SKU,
+			Options:   options[row.VariantID],
+			Title:     row.Title,
+			Price:     price,
+			Quantity:  row.Quantity,
+			LineTotal: price.Times(row.Quantity),
+			Discount:  lines[i].Discount,
+		}
+		response.Items = append(response.Items, line)
+		response.Subtotal = response.Subtotal.Add(line.LineTotal)
+	}
+	response.Discounts = result.Discounts
+	response.DiscountTotal = result.Total
+	response.FreeShipping = result.FreeShipping
+	response.Total = response.Subtotal.Sub(result.Total)
+	response.Coupons, err = couponStatuses(db, cart.ID, result, rejected)
+	if err != nil {
+		return nil, err
+	}
+	if address == nil {
+		return response, nil
+	}
+	classes := make([]string, len(rows))
+	for i, row := range rows {
+		classes[i] = row.TaxClass
+	}
+	taxes, err := r.Tax.Calculate(ctx, *address, currency, taxLines(lines, classes))
+	if err != nil {
+		return nil, err
+	}
+	for i := range response.Items {
+		response.Items[i].Tax = &taxes.Lines[i]
+	}
+	response.TaxAddress = address
+	response.TaxTotal = taxes.Total
+	response.PricesIncludeTax = taxes.Inclusive
+	if !taxes.Inclusive {
+		response.Total = response.Total.Add(taxes.Total)
+	}
+	return response, nil
+}
+
+// respondCartError writes the response for errors returned by cart updates
+func respondCartError(context *fiber.Ctx, err error) error {
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Product not found"})
+		return nil
+	case errors.Is(err, errVariantNotFound):
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Variant not found"})
+		return nil
+	case errors.Is(err, errVariantRequired):
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "variant_id is required for this product"})
+		return nil
+	case errors.Is(err, errInsufficientStock):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Not enough stock for the requested quantity"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to update cart"})
+	return err
+}
+
+// Get the caller's cart
+func (r *Repository) GetCart(ctx *fiber.Ctx) error {
+	cart, err := r.cartForRequest(ctx, false)
+	if err != nil {
+		ctx.Status(http.StatusInternalServerError).JSON(&fiber.Map{
+			"message": "Failed to retrieve cart",
+		})
+		return err
+	}
+	if cart == nil {
+		return r.respondEmptyCart(ctx)
+	}
+	response, err := r.loadCart(ctx.Context(), cart, r.requestCurrency(ctx), cartTaxAddress(ctx))
+	if err != nil {
+		ctx.Status(http.StatusInternalServerError).JSON(&fiber.Map{
+			"message": "Failed to retrieve cart",
+		})
+		return err
+	}
+	return ctx.JSON(response)
+}
+
+// cartTaxAddress reads the country, region and postal_code query
+// parameters used to estimate the tax of a cart
+func cartTaxAddress(ctx *fiber.Ctx) *TaxAddress {
+	if ctx.Query("country") == "" {
+		return nil
+	}
+	address := TaxAddress{
+		Country:    ctx.Query("country"),
+		Region:     ctx.Query("region"),
+		PostalCode: ctx.Query("postal_code"),
+	}.normalize()
+	return &address
+}
+
+// add product to cart
+func (r *Repository) AddToCart(ctx *fiber.Ctx) error {
+	item := AddToCartRequest{}
+	if err := ctx.BodyParser(&item); err != nil || item.ProductID == 0 || item.Quantity <= 0 {
+		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+			"message": "Request failed",
+		})
+		return nil
+	}
+	cart, err := r.cartForRequest(ctx, true)
+	if err == nil {
+		err = r.DB.Transaction(func(tx *gorm.DB) error {
+			if err := lockCart(tx, cart.ID); err != nil {
+				return err
+			}
+			quantity, err := cartQuantity(tx, cart.ID, item.ProductID, item.VariantID)
+			if err != nil {
+				return err
+			}
+			return setCartQuantity(tx, cart.ID, item.ProductID, item.VariantID, quantity+item.Quantity)
+		})
+	}
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return r.GetCart(ctx)
+}
+
+// cartLineParams reads the product_id route parameter and the variant_id
+// query parameter that identify a cart line
+func cartLineParams(ctx *fiber.Ctx) (uint, uint, error) {
+	productID, err := strconv.ParseUint(ctx.Params("product_id"), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	variantID, err := strconv.ParseUint(ctx.Query("variant_id", "0"), 10, 64)
+	return uint(productID), uint(variantID), err
+}
+
+// update the quantity of a product in the cart
+func (r *Repository) UpdateCartItem(ctx *fiber.Ctx) error {
+	productID, variantID, err := cartLineParams(ctx)
+	if err != nil {
+		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+			"message": "Invalid product ID",
+		})
+		return nil
+	}
+	request := UpdateCartItemRequest{}
+	if err := ctx.BodyParser(&request); err != nil || request.Quantity < 0 {
+		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+			"message": "Request failed",
+		})
+		return nil
+	}
+	cart, err := r.cartForRequest(ctx, true)
+	if err == nil {
+		err = r.DB.Transaction(func(tx *gorm.DB) error {
+			if err := lockCart(tx, cart.ID); err != nil {
+				return err
+			}
+			return setCartQuantity(tx, cart.ID, productID, variantID, request.Quantity)
+		})
+	}
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return r.GetCart(ctx)
+}
+
+// remove product from the cart
+func (r *Repository) RemoveFromCart(ctx *fiber.Ctx) error {
+	productID, variantID, err := cartLineParams(ctx)
+	if err != nil {
+		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+			"message": "Invalid product ID",
+		})
+		return nil
+	}
+	cart, err := r.cartForRequest(ctx, true)
+	if err == nil {
+		err = r.DB.Transaction(func(tx *gorm.DB) error {
+			if err := lockCart(tx, cart.ID); err != nil {
+				return err
+			}
+			return setCartQuantity(tx, cart.ID, productID, variantID, 0)
+		})
+	}
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return r.GetCart(ctx)
+}
+
+// remove every product from the cart
+func (r *Repository) ClearCart(ctx *fiber.Ctx) error {
+	cart, err := r.cartForRequest(ctx, true)
+	if err == nil {
+		err = r.DB.Unscoped().Where("cart_id = ?", cart.ID).Delete(&models.CartItem{}).Error
+	}
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return r.GetCart(ctx)
+}
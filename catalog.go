@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// sortableProductFields maps the sort keys clients may use to their columns
+var sortableProductFields = map[string]string{
+	"id":         "id",
+	"title":      "title",
+	"price":      "price_amount",
+	"quantity":   "quantity",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// Struct ProductPage
+type ProductPage struct {
+	Data       []Product `json:"data"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	Total      int       `json:"total"`
+}
+
+type sortField struct {
+	Column string
+	Desc   bool
+}
+
+// ProductQuery holds the listing options parsed from the query string
+type ProductQuery struct {
+	Limit    int
+	Offset   int
+	Cursor   []interface{}
+	Sort     []sortField
+	MinPrice *int64 // minor units of the store currency
+	MaxPrice *int64
+	InStock  bool
+	Category string
+	Text     string
+}
+
+var errBadQuery = errors.New("invalid query")
+
+// parseProductQuery reads limit, cursor or offset, sort, min_price,
+// max_price, in_stock, category and q
+func parseProductQuery(context *fiber.Ctx, currency string) (*ProductQuery, error) {
+	query := &ProductQuery{Limit: defaultPageSize}
+	if limit := context.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%w: limit", errBadQuery)
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		query.Limit = n
+	}
+	if offset := context.Query("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: offset", errBadQuery)
+		}
+		query.Offset = n
+	}
+
+	seen := map[string]bool{}
+	for _, key := range strings.Split(context.Query("sort", "id"), ",") {
+		key = strings.TrimSpace(key)
+		desc := strings.HasPrefix(key, "-")
+		column, ok := sortableProductFields[strings.TrimPrefix(key, "-")]
+		if !ok || seen[column] {
+			return nil, fmt.Errorf("%w: sort %q", errBadQuery, key)
+		}
+		seen[column] = true
+		query.Sort = append(query.Sort, sortField{Column: column, Desc: desc})
+	}
+	// id breaks ties so the keyset is unique
+	if !seen["id"] {
+		query.Sort = append(query.Sort, sortField{Column: "id"})
+	}
+
+	if cursor := context.Query("cursor"); cursor != "" {
+		if query.Offset > 0 {
+			return nil, fmt.Errorf("%w: cursor and offset cannot be combined", errBadQuery)
+		}
+		values, err := decodeCursor(cursor, query.Sort)
+		if err != nil {
+			return nil, err
+		}
+		query.Cursor = values
+	}
+
+	for name, target := range map[string]**int64{"min_price": &query.MinPrice, "max_price": &query.MaxPrice} {
+		if raw := context.Query(name); raw != "" {
+			value, err := money.Parse(raw, currency)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", errBadQuery, name)
+			}
+			*target = &value.Amount
+		}
+	}
+	query.InStock = context.QueryBool("in_stock")
+	query.Category = context.Query("category")
+	query.Text = strings.TrimSpace(context.Query("q"))
+	return query, nil
+}
+
+// filter applies everything except paging and sorting
+func (query *ProductQuery) filter(db *gorm.DB) *gorm.DB {
+	if query.MinPrice != nil {
+		db = db.Where("price_amount >= ?", *query.MinPrice)
+	}
+	if query.MaxPrice != nil {
+		db = db.Where("price_amount <= ?", *query.MaxPrice)
+	}
+	// In stock means available to sell, after what pending orders hold
+	if query.InStock {
+		db = db.Where("product.quantity > " + activeHoldsSQL)
+	}
+	// A category, given by id or slug, includes its subcategories
+	if query.Category != "" {
+		db = db.Where("id IN (?)", categoryIDsUnder(query.Category))
+	}
+	if query.Text != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query.Text) + "%"
+		db = db.Where("title ILIKE ? OR description ILIKE ?", pattern, pattern)
+	}
+	return db
+}
+
+// page applies the sort order and either the cursor or the offset
+func (query *ProductQuery) page(db *gorm.DB) *gorm.DB {
+	for _, field := range query.Sort {
+		if field.Desc {
+			db = db.Order(field.Column + " DESC")
+		} else {
+			db = db.Order(field.Column)
+		}
+	}
+	if query.Cursor != nil {
+		// (a > x) OR (a = x AND b > y) OR ... with each comparison
+		// flipped for descending fields
+		var clauses []string
+		var args []interface{}
+		for i, field := range query.Sort {
+			var parts []string
+			for j := 0; j < i; j++ {
+				parts = append(parts, query.Sort[j].Column+" = ?")
+				args = append(args, query.Cursor[j])
+			}
+			op := " > ?"
+			if field.Desc {
+				op = " < ?"
+			}
+			parts = append(parts, field.Column+op)
+			args = append(args, query.Cursor[i])
+			clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+		}
+		db = db.Where(strings.Join(clauses, " OR "), args...)
+	}
+	if query.Offset > 0 {
+		db = db.Offset(query.Offset)
+	}
+	// One extra row tells us whether there is a next page
+	return db.Limit(query.Limit + 1)
+}
+
+// sortValue returns the value of a sort column for a product
+func sortValue(product *Product, column string) interface{} {
+	switch column {
+	case "title":
+		return product.Title
+	case "price_amount":
+		return product.Price.Amount
+	case "quantity":
+		return product.Quantity
+	case "created_at":
+		return product.CreatedAt.Format(time.RFC3339Nano)
+	case "updated_at":
+		return product.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	return product.ID
+}
+
+func encodeCursor(product *Product, sort []sortField) string {
+	values := make([]interface{}, len(sort))
+	for i, field := range sort {
+		values[i] = sortValue(product, field.Column)
+	}
+	encoded, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor restores the typed sort values stored in a cursor
+func decodeCursor(cursor string, sort []sortField) ([]interface{}, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cursor", errBadQuery)
+	}
+	var values []interface{}
+	if err := json.Unmarshal(raw, &values); err != nil || len(values) != len(sort) {
+		return nil, fmt.Errorf("%w: cursor", errBadQuery)
+	}
+	for i, field := range sort {
+		switch field.Column {
+		case "created_at", "updated_at":
+			text, _ := values[i].(string)
+			parsed, err := time.Parse(time.RFC3339Nano, text)
+			if err != nil {
+				return nil, fmt.Errorf("%w: cursor", errBadQuery)
+			}
+			values[i] = parsed
+		case "title":
+			if _, ok := values[i].(string); !ok {
+				return nil, fmt.Errorf("%w: cursor", errBadQuery)
+			}
+		default:
+			if _, ok := values[i].(float64); !ok {
+				return nil, fmt.Errorf("%w: cursor", errBadQuery)
+			}
+		}
+	}
+	return values, nil
+}
+
+// listProducts runs a product query and builds the response envelope
+func listProducts(db *gorm.DB, query *ProductQuery) (*ProductPage, error) {
+	page := &ProductPage{Data: []Product{}}
+	base := query.filter(db.Model(&Product{}))
+	if err := base.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+	if err := query.page(base).Find(&page.Data).Error; err != nil {
+		return nil, err
+	}
+	if len(page.Data) > query.Limit {
+		page.Data = page.Data[:query.Limit]
+		page.NextCursor = encodeCursor(&page.Data[query.Limit-1], query.Sort)
+	}
+	return page, nil
+}
+
+// createProductListIndexes adds the indexes used by filters and sorts
+func createProductListIndexes(db *gorm.DB) error {
+	indexes := map[string][]string{
+		"idx_product_price_amount_id": {"price_amount", "id"},
+		"idx_product_created_at_id":   {"created_at", "id"},
+		"idx_product_updated_at_id":   {"updated_at", "id"},
+		"idx_product_title_id":        {"title", "id"},
+		"idx_product_quantity":        {"quantity"},
+	}
+	for name, columns := range indexes {
+		if err := db.Model(&Product{}).AddIndex(name, columns...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
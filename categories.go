@@ -0,0 +1,520 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+// categoryTreeLock serialises changes to the shape of the tree so two
+// concurrent moves cannot build a cycle
+const categoryTreeLock = 7041
+
+// Struct Category
+// Path is the materialised path of ids from the root down to and including
+// the category itself, e.g. "/1/4/9/". A subtree is every row whose path
+// starts with the path of its root.
+type Category struct {
+	ID        uint        `json:"id" gorm:"primary_key"`
+	ParentID  *uint       `json:"parent_id" gorm:"index"`
+	Name      string      `json:"name" gorm:"not null"`
+	Slug      string      `json:"slug" gorm:"unique_index;not null"`
+	Path      string      `json:"path" gorm:"index;not null"`
+	Depth     int         `json:"depth"`
+	Children  []*Category `json:"children,omitempty" gorm:"-"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// Struct ProductCategory
+type ProductCategory struct {
+	ProductID  uint `gorm:"primary_key;auto_increment:false"`
+	CategoryID uint `gorm:"primary_key;auto_increment:false;index"`
+}
+
+// Struct CategoryRequest
+type CategoryRequest struct {
+	Name     *string `json:"name"`
+	Slug     *string `json:"slug"`
+	ParentID *uint   `json:"parent_id"`
+}
+
+// Struct MoveCategoryRequest
+// A null parent_id moves the category to the top level.
+type MoveCategoryRequest struct {
+	ParentID *uint `json:"parent_id"`
+}
+
+var (
+	errCategoryCycle       = errors.New("a category cannot be moved below itself")
+	errCategoryHasChildren = errors.New("category has subcategories")
+	errParentNotFound      = errors.New("parent category not found")
+)
+
+func categoryPath(parent *Category, id uint) string {
+	prefix := "/"
+	if parent != nil {
+		prefix = parent.Path
+	}
+	return prefix + strconv.FormatUint(uint64(id), 10) + "/"
+}
+
+// MigrateCategories creates the category tables and turns the old free-text
+// product.category column into top-level categories
+func MigrateCategories(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Category{}, &ProductCategory{}).Error; err != nil {
+		return err
+	}
+	if !db.Dialect().HasColumn("product", "category") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var rows []struct{ Name string }
+		err := tx.Raw(`SELECT DISTINCT trim(category) AS name FROM product
+			WHERE trim(coalesce(category, '')) <> '' ORDER BY 1`).Scan(&rows).Error
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			name := row.Name
+			category := Category{}
+			err := tx.Where("lower(name) = lower(?) AND parent_id IS NULL", name).First(&category).Error
+			if gorm.IsRecordNotFoundError(err) {
+				category = Category{Name: name, Slug: uniqueCategorySlug(tx, slugify(name))}
+				if err := createCategory(tx, &category, nil); err != nil {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+			err = tx.Exec(`INSERT INTO product_categories (product_id, category_id)
+				SELECT id, ? FROM product WHERE trim(category) = ?
+				ON CONFLICT DO NOTHING`, category.ID, name).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&Product{}).DropColumn("category").Error
+	})
+}
+
+// uniqueCategorySlug appends a counter to slug until no category uses it
+func uniqueCategorySlug(db *gorm.DB, slug string) string {
+	if slug == "" {
+		slug = "category"
+	}
+	candidate := slug
+	for n := 2; ; n++ {
+		var count int
+		db.Model(&Category{}).Where("slug = ?", candidate).Count(&count)
+		if count == 0 {
+			return candidate
+		}
+		candidate = slug + "-" + strconv.Itoa(n)
+	}
+}
+
+// createCategory inserts category below parent and fills in its path
+func createCategory(tx *gorm.DB, category *Category, parent *Category) error {
+	category.Path = "/"
+	if parent != nil {
+		category.ParentID = &parent.ID
+		category.Depth = parent.Depth + 1
+	}
+	if err := tx.Create(category).Error; err != nil {
+		return err
+	}
+	category.Path = categoryPath(parent, category.ID)
+	return tx.Model(category).Update("path", category.Path).Error
+}
+
+// lockCategoryTree takes the transaction-scoped lock on the tree
+func lockCategoryTree(tx *gorm.DB) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", categoryTreeLock).Error
+}
+
+// buildCategoryTree nests a flat list of categories. Categories whose parent
+// is not in the list become roots.
+func buildCategoryTree(categories []Category) []*Category {
+	nodes := make(map[uint]*Category, len(categories))
+	for i := range categories {
+		nodes[categories[i].ID] = &categories[i]
+	}
+	roots := []*Category{}
+	for i := range categories {
+		node := &categories[i]
+		if node.ParentID != nil {
+			if parent, ok := nodes[*node.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
+
+// categoryIDsUnder returns a subquery selecting the products assigned to
+// the category identified by id or slug, or to any of its descendants. As
+// in findCategory, a number is always an id.
+func categoryIDsUnder(category string) *gorm.SqlExpr {
+	const products = `SELECT product_categories.product_id FROM product_categories
+		JOIN categories ON categories.id = product_categories.category_id
+		WHERE categories.path LIKE (SELECT path FROM categories WHERE `
+	if id, err := strconv.ParseUint(category, 10, 64); err == nil {
+		return gorm.Expr(products+`id = ?) || '%'`, id)
+	}
+	return gorm.Expr(products+`slug = ?) || '%'`, category)
+}
+
+// preloadCategories loads the categories directly assigned to each product
+func preloadCategories(db *gorm.DB, products []*Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(products))
+	byID := map[uint]*Product{}
+	for i, product := range products {
+		ids[i] = product.ID
+		byID[product.ID] = product
+		product.Categories = []Category{}
+	}
+	var rows []struct {
+		ProductID uint
+		Category
+	}
+	err := db.Table("categories").
+		Select("product_categories.product_id, categories.*").
+		Joins("JOIN product_categories ON product_categories.category_id = categories.id").
+		Where("product_categories.product_id IN (?)", ids).
+		Order("categories.path").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		product := byID[row.ProductID]
+		product.Categories = append(product.Categories, row.Category)
+	}
+	return nil
+}
+
+// setProductCategories replaces the categories assigned to a product
+func setProductCategories(tx *gorm.DB, productID uint, categoryIDs []uint) error {
+	if err := tx.Where("product_id = ?", productID).Delete(&ProductCategory{}).Error; err != nil {
+		return err
+	}
+	for _, categoryID := range categoryIDs {
+		err := tx.Exec(`INSERT INTO product_categories (product_id, category_id) VALUES (?, ?)
+			ON CONFLICT DO NOTHING`, productID, categoryID).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingCategories returns the ids that do not name a category
+func missingCategories(db *gorm.DB, ids []uint) []uint {
+	if len(ids) == 0 {
+		return nil
+	}
+	var found []uint
+	db.Model(&Category{}).Where("id IN (?)", ids).Pluck("id", &found)
+	exists := map[uint]bool{}
+	for _, id := range found {
+		exists[id] = true
+	}
+	var missing []uint
+	for _, id := range ids {
+		if !exists[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// findCategory loads the category named by the :id route parameter, which
+// may be an id or a slug
+func findCategory(db *gorm.DB, context *fiber.Ctx) (*Category, error) {
+	category := &Category{}
+	key := context.Params("id")
+	if id, err := strconv.ParseUint(key, 10, 64); err == nil {
+		return category, db.Where("id = ?", id).First(category).Error
+	}
+	return category, db.Where("slug = ?", key).First(category).Error
+}
+
+func respondCategoryLookupError(context *fiber.Ctx, err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Category not found"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to retrieve category"})
+	return err
+}
+
+func respondInvalidCategory(context *fiber.Ctx, problems map[string]string) error {
+	context.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+		"message": "Invalid category",
+		"errors":  problems,
+	})
+	return nil
+}
+
+// validateCategory checks name and slug before a category is saved
+func validateCategory(db *gorm.DB, category *Category) map[string]string {
+	problems := map[string]string{}
+	if category.Name == "" {
+		problems["name"] = "must not be empty"
+	}
+	if !slugPattern.MatchString(category.Slug) {
+		problems["slug"] = "must be lowercase letters, digits and single dashes"
+	}
+	var count int
+	db.Model(&Category{}).Where("slug = ? AND id <> ?", category.Slug, category.ID).Count(&count)
+	if count > 0 {
+		problems["slug"] = "is already used by another category"
+	}
+	return problems
+}
+
+// Get the whole category tree
+func (r *Repository) GetCategoryTree(context *fiber.Ctx) error {
+	var categories []Category
+	if err := r.DB.Order("depth, name, id").Find(&categories).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve categories"})
+		return err
+	}
+	return context.JSON(buildCategoryTree(categories))
+}
+
+// Get a category with its ancestors and subtree
+func (r *Repository) GetCategory(context *fiber.Ctx) error {
+	category, err := findCategory(r.DB, context)
+	if err != nil {
+		return respondCategoryLookupError(context, err)
+	}
+	var subtree []Category
+	err = r.DB.Where("path LIKE ?", category.Path+"%").Order("depth, name, id").Find(&subtree).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve category"})
+		return err
+	}
+	// The path lists the ancestors in order
+	var ancestorIDs []string
+	for _, id := range strings.Split(strings.Trim(category.Path, "/"), "/") {
+		if id != strconv.FormatUint(uint64(category.ID), 10) {
+			ancestorIDs = append(ancestorIDs, id)
+		}
+	}
+	ancestors := []Category{}
+	if len(ancestorIDs) > 0 {
+		if err := r.DB.Where("id IN (?)", ancestorIDs).Order("depth").Find(&ancestors).Error; err != nil {
+			return err
+		}
+	}
+	return context.JSON(&fiber.Map{
+		"category":  buildCategoryTree(subtree)[0],
+		"ancestors": ancestors,
+	})
+}
+
+// Create a category
+func (r *Repository) CreateCategory(context *fiber.Ctx) error {
+	request := CategoryRequest{}
+	if err := context.BodyParser(&request); err != nil || request.Name == nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "name is required"})
+		return nil
+	}
+	category := &Category{Name: strings.TrimSpace(*request.Name)}
+	if request.Slug != nil {
+		category.Slug = *request.Slug
+	} else {
+		category.Slug = uniqueCategorySlug(r.DB, slugify(category.Name))
+	}
+	if problems := validateCategory(r.DB, category); len(problems) > 0 {
+		return respondInvalidCategory(context, problems)
+	}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockCategoryTree(tx); err != nil {
+			return err
+		}
+		var parent *Category
+		if request.ParentID != nil {
+			parent = &Category{}
+			if err := tx.Where("id = ?", *request.ParentID).First(parent).Error; err != nil {
+				return err
+			}
+		}
+		return createCategory(tx, category, parent)
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return respondInvalidCategory(context, map[string]string{"parent_id": "does not exist"})
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to create category"})
+		return err
+	}
+	return context.Status(http.StatusCreated).JSON(category)
+}
+
+// Rename a category or change its slug
+func (r *Repository) UpdateCategory(context *fiber.Ctx) error {
+	category, err := findCategory(r.DB, context)
+	if err != nil {
+		return respondCategoryLookupError(context, err)
+	}
+	request := CategoryRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	if request.ParentID != nil {
+		return respondInvalidCategory(context, map[string]string{"parent_id": "use the move endpoint to change the parent"})
+	}
+	if request.Name != nil {
+		category.Name = strings.TrimSpace(*request.Name)
+	}
+	if request.Slug != nil {
+		category.Slug = *request.Slug
+	}
+	if problems := validateCategory(r.DB, category); len(problems) > 0 {
+		return respondInvalidCategory(context, problems)
+	}
+	err = r.DB.Model(category).Updates(map[string]interface{}{"name": category.Name, "slug": category.Slug}).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to update category"})
+		return err
+	}
+	return context.JSON(category)
+}
+
+// Move a category, with its whole subtree, below another parent
+func (r *Repository) MoveCategory(context *fiber.Ctx) error {
+	request := MoveCategoryRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	var category *Category
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockCategoryTree(tx); err != nil {
+			return err
+		}
+		var err error
+		// Read again under the lock; the path may have changed
+		if category, err = findCategory(tx, context); err != nil {
+			return err
+		}
+		var parent *Category
+		if request.ParentID != nil {
+			parent = &Category{}
+			if err := tx.Where("id = ?", *request.ParentID).First(parent).Error; err != nil {
+				return errParentNotFound
+			}
+			if strings.HasPrefix(parent.Path, category.Path) {
+				return errCategoryCycle
+			}
+		}
+		oldPath := category.Path
+		newPath := categoryPath(parent, category.ID)
+		newDepth := 0
+		if parent != nil {
+			newDepth = parent.Depth + 1
+		}
+		err = tx.Exec(`UPDATE categories
+			SET path = ? || substr(path, ?), depth = depth + ?, updated_at = now()
+			WHERE path LIKE ? || '%'`,
+			newPath, len(oldPath)+1, newDepth-category.Depth, oldPath).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(category).Update("parent_id", request.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", category.ID).First(category).Error
+	})
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return respondCategoryLookupError(context, err)
+	case err == errParentNotFound:
+		return respondInvalidCategory(context, map[string]string{"parent_id": "does not exist"})
+	case err == errCategoryCycle:
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": err.Error()})
+		return nil
+	case err != nil:
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to move category"})
+		return err
+	}
+	return context.JSON(category)
+}
+
+// Delete a category. Categories with subcategories must be emptied or
+// moved first; product assignments are removed.
+func (r *Repository) DeleteCategory(context *fiber.Ctx) error {
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockCategoryTree(tx); err != nil {
+			return err
+		}
+		category, err := findCategory(tx, context)
+		if err != nil {
+			return err
+		}
+		var children int
+		tx.Model(&Category{}).Where("parent_id = ?", category.ID).Count(&children)
+		if children > 0 {
+			return errCategoryHasChildren
+		}
+		if err := tx.Where("category_id = ?", category.ID).Delete(&ProductCategory{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(category).Error
+	})
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return respondCategoryLookupError(context, err)
+	case err == errCategoryHasChildren:
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Category has subcategories; move or delete them first"})
+		return nil
+	case err != nil:
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to delete category"})
+		return err
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Category deleted successfully"})
+	return nil
+}
+
+// sortCategoryIDs removes duplicates so assignments are stable
+func sortCategoryIDs(ids []uint) []uint {
+	seen := map[uint]bool{}
+	unique := []uint{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i] < unique[j] })
+	return unique
+}
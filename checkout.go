@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/models"
+	"golang_api/money"
+)
+
+var errEmptyCart = errors.New("cart is empty")
+
+// Struct CheckoutRequest
+// Country is an ISO 3166 code; with Region and PostalCode it decides the
+// tax rates.
+type CheckoutRequest struct {
+	Fullname   string `json:"fullname"`
+	Mobile     string `json:"mobile"`
+	Address    string `json:"address"`
+	Country    string `json:"country"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	// ShippingMethodID is one of the methods quoted for the cart; it is
+	// required once shipping methods are set up
+	ShippingMethodID *uint `json:"shipping_method_id"`
+}
+
+// Struct StockShortage
+type StockShortage struct {
+	ProductID uint   `json:"product_id"`
+	VariantID uint   `json:"variant_id"`
+	SKU       string `json:"sku"`
+	Title     string `json:"title"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+// stockError is returned from the checkout transaction when one or more
+// cart lines cannot be filled
+type stockError struct {
+	Lines []StockShortage
+}
+
+func (e *stockError) Error() string { return "insufficient stock" }
+
+// lockProducts loads and row-locks the given products. Locks are always
+// taken in id order so concurrent checkouts cannot deadlock.
+func lockProducts(tx *gorm.DB, productIDs []uint) (map[uint]Product, error) {
+	var products []Product
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("id IN (?)", productIDs).
+		Order("id").
+		Find(&products).Error
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]Product, len(products))
+	for _, product := range products {
+		byID[product.ID] = product
+	}
+	return byID, nil
+}
+
+// lockVariants loads and row-locks the given variants in id order. They are
+// locked after their products, matching the order used when variants change.
+func lockVariants(tx *gorm.DB, variantIDs []uint) (map[uint]ProductVariant, error) {
+	byID := map[uint]ProductVariant{}
+	if len(variantIDs) == 0 {
+		return byID, nil
+	}
+	var variants []ProductVariant
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("id IN (?)", variantIDs).
+		Order("id").
+		Find(&variants).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, variant := range variants {
+		byID[variant.ID] = variant
+	}
+	return byID, nil
+}
+
+// placeOrder turns the cart into an order in currency and decrements stock.
+// Prices are converted from the store currency at the current rate, which
+// is recorded on the order.
+func (r *Repository) placeOrder(ctx context.Context, tx *gorm.DB, accountID uint, currency string, request CheckoutRequest) (*Order, error) {
+	cart, err := cartForAccount(tx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockCart(tx, cart.ID); err != nil {
+		return nil, err
+	}
+	var items []models.CartItem
+	if err := tx.Where("cart_id = ?", cart.ID).Order("product_id, variant_id").Find(&items).Error; err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errEmptyCart
+	}
+	productIDs := make([]uint, len(items))
+	var variantIDs []uint
+	for i, item := range items {
+		productIDs[i] = item.ProductID
+		if item.VariantID != 0 {
+			variantIDs = append(variantIDs, item.VariantID)
+		}
+	}
+	products, err := lockProducts(tx, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	variants, err := lockVariants(tx, variantIDs)
+	if err != nil {
+		return nil, err
+	}
+	// Lines added before a product got variants cannot be filled any more
+	var withVariants []uint
+	err = tx.Model(&ProductVariant{}).Where("product_id IN (?)", productIDs).Pluck("DISTINCT product_id", &withVariants).Error
+	if err != nil {
+		return nil, err
+	}
+	needsVariant := map[uint]bool{}
+	for _, id := range withVariants {
+		needsVariant[id] = true
+	}
+	// Holds are placed with the products locked, so these stay accurate
+	heldByProduct, heldByItem, err := heldStock(tx, productIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	address := TaxAddress{Country: request.Country, Region: request.Region, PostalCode: request.PostalCode}.normalize()
+	order := &Order{
+		AccountID:     accountID,
+		Fullname:      request.Fullname,
+		Mobile:        request.Mobile,
+		Address:       request.Address,
+		Country:       address.Country,
+		Region:        address.Region,
+		PostalCode:    address.PostalCode,
+		Status:        OrderPending,
+		Subtotal:      money.Zero(currency),
+		DiscountTotal: money.Zero(currency),
+		ShippingTotal: money.Zero(currency),
+		Total:         money.Zero(currency),
+		BaseTotal:     money.Zero(r.Currency),
+	}
+	shortages := []StockShortage{}
+	var prices []*localPrice
+	var classes []string
+	for _, item := range items {
+		product, ok := products[item.ProductID]
+		sku, price, inherit := product.SKU, product.Price, true
+		available := availableToSell(product.Quantity, heldByProduct[product.ID])
+		if item.VariantID == 0 && needsVariant[product.ID] {
+			ok, available = false, 0
+		} else if item.VariantID != 0 {
+			variant, found := variants[item.VariantID]
+			ok = ok && found && variant.ProductID == product.ID
+			sku = variant.SKU
+			available = availableToSell(variant.Quantity, heldByItem[stockKey{product.ID, variant.ID}])
+			if variant.Price != nil {
+				price, inherit = *variant.Price, false
+			}
+		}
+		if !ok || available < item.Quantity {
+			shortages = append(shortages, StockShortage{
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				SKU:       sku,
+				Title:     product.Title,
+				Requested: item.Quantity,
+				Available: available,
+			})
+			continue
+		}
+		order.Lines = append(order.Lines, OrderLine{
+			ProductID:     product.ID,
+			VariantID:     item.VariantID,
+			SKU:           sku,
+			Title:         product.Title,
+			BaseUnitPrice: price,
+			Quantity:      item.Quantity,
+		})
+		prices = append(prices, &localPrice{ProductID: product.ID, VariantID: item.VariantID, Base: price, Inherit: inherit})
+		classes = append(classes, product.TaxClass)
+	}
+	if len(shortages) > 0 {
+		return nil, &stockError{Lines: shortages}
+	}
+
+	localRate, err := r.localizePrices(ctx, tx, currency, prices)
+	if err != nil {
+		return nil, err
+	}
+	rate := localRate
+	if rate == nil {
+		rate = identityRate(currency)
+	}
+	order.ExchangeRate, order.RateSource = rate.Decimal(), rate.Source
+	if !rate.AsOf.IsZero() {
+		order.RateAsOf = &rate.AsOf
+	}
+	lines := make([]*discountLine, len(order.Lines))
+	for i := range order.Lines {
+		line := &order.Lines[i]
+		line.UnitPrice = prices[i].Local
+		line.LineTotal = line.UnitPrice.Times(line.Quantity)
+		order.Subtotal = order.Subtotal.Add(line.LineTotal)
+		order.BaseTotal = order.BaseTotal.Add(line.BaseUnitPrice.Times(line.Quantity))
+		lines[i] = &discountLine{
+			ProductID: line.ProductID,
+			VariantID: line.VariantID,
+			UnitPrice: line.UnitPrice,
+			Quantity:  line.Quantity,
+			Discount:  money.Zero(currency),
+		}
+	}
+
+	// Promotions are locked after the cart, products and variants
+	rules, rejected, err := loadPromotionRules(tx, cart.ID, accountID, productIDs, time.Now(), true)
+	if err != nil {
+		return nil, err
+	}
+	if len(rejected) > 0 {
+		codes := make([]string, 0, len(rejected))
+		for code := range rejected {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		return nil, &couponError{Code: codes[0], Err: rejected[codes[0]]}
+	}
+	result, err := applyPromotions(rules, lines, currency, converter(localRate))
+	if err != nil {
+		return nil, err
+	}
+	for i := range order.Lines {
+		order.Lines[i].Discount = lines[i].Discount
+	}
+	for _, discount := range result.Discounts {
+		order.Discounts = append(order.Discounts, OrderDiscount{
+			PromotionID:  discount.PromotionID,
+			Code:         discount.Code,
+			Name:         discount.Name,
+			Kind:         discount.Kind,
+			Amount:       discount.Amount,
+			FreeShipping: discount.FreeShipping,
+		})
+	}
+	order.DiscountTotal = result.Total
+	order.FreeShipping = result.FreeShipping
+	order.Total = order.Subtotal.Sub(result.Total)
+
+	taxes, err := r.Tax.Calculate(ctx, address, currency, taxLines(lines, classes))
+	if err != nil {
+		return nil, err
+	}
+	for i := range order.Lines {
+		order.Lines[i].TaxName = taxes.Lines[i].Name
+		order.Lines[i].TaxRate = taxes.Lines[i].Rate
+		order.Lines[i].Tax = taxes.Lines[i].Tax
+	}
+	order.TaxTotal = taxes.Total
+	order.PricesIncludeTax = taxes.Inclusive
+	// Amounts on top of the prices reach the store currency total at the
+	// frozen rate
+	adjustment := result.Total.Neg()
+	if !taxes.Inclusive {
+		order.Total = order.Total.Add(taxes.Total)
+		adjustment = adjustment.Add(taxes.Total)
+	}
+	if localRate != nil {
+		adjustment, err = adjustment.Convert(r.Currency, new(big.Rat).Inv(localRate.Rate))
+		if err != nil {
+			return nil, err
+		}
+	}
+	order.BaseTotal = order.BaseTotal.Add(adjustment)
+
+	quote, err := r.shippingForOrder(ctx, tx, order, products, address, localRate, request.ShippingMethodID)
+	if err != nil {
+		return nil, err
+	}
+	if quote != nil {
+		order.ShippingMethodID = &quote.MethodID
+		order.ShippingMethod = quote.Name
+		order.ShippingTotal = quote.Rate
+		order.Total = order.Total.Add(quote.Rate)
+		order.BaseTotal = order.BaseTotal.Add(quote.BaseRate)
+	}
+
+	reservedUntil := time.Now().Add(r.HoldTTL)
+	order.ReservedUntil = &reservedUntil
+	if err := tx.Create(order).Error; err != nil {
+		return nil, err
+	}
+	history := OrderHistory{OrderID: order.ID, ToStatus: OrderPending, AccountID: &accountID}
+	if err := tx.Create(&history).Error; err != nil {
+		return nil, err
+	}
+	if err := placeHolds(tx, order, reservedUntil); err != nil {
+		return nil, err
+	}
+	for _, discount := range order.Discounts {
+		redemption := PromotionRedemption{PromotionID: discount.PromotionID, OrderID: order.ID, AccountID: accountID}
+		if err := tx.Create(&redemption).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Unscoped().Where("cart_id = ?", cart.ID).Delete(&models.CartItem{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("cart_id = ?", cart.ID).Delete(&CartCoupon{}).Error; err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// shippingForOrder prices the chosen shipping method for the order's lines.
+// It returns nil when no shipping methods are set up.
+func (r *Repository) shippingForOrder(ctx context.Context, tx *gorm.DB, order *Order, products map[uint]Product,
+	address TaxAddress, rate *ExchangeRate, methodID *uint) (*ShippingQuote, error) {
+	configured, err := shippingConfigured(tx)
+	if err != nil || !configured {
+		return nil, err
+	}
+	if methodID == nil {
+		return nil, errShippingMethodRequired
+	}
+	var parcels []Parcel
+	for _, line := range order.Lines {
+		product := products[line.ProductID]
+		for n := 0; n < line.Quantity; n++ {
+			parcels = append(parcels, product.parcel())
+		}
+	}
+	quotes, err := r.quoteShipping(ctx, tx, &shipment{
+		Destination:  address,
+		Parcels:      parcels,
+		Subtotal:     order.Subtotal.Sub(order.DiscountTotal),
+		FreeShipping: order.FreeShipping,
+	}, converter(rate))
+	if err != nil {
+		return nil, err
+	}
+	for i := range quotes {
+		if quotes[i].MethodID == *methodID {
+			return &quotes[i], nil
+		}
+	}
+	return nil, errShippingUnavailable
+}
+
+// Checkout the caller's cart
+func (r *Repository) Checkout(context *fiber.Ctx) error {
+	request := CheckoutRequest{}
+	if err := context.BodyParser(&request); err != nil || request.Address == "" {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	if strings.TrimSpace(request.Country) == "" {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "country is required"})
+		return nil
+	}
+	var order *Order
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, err = r.placeOrder(context.Context(), tx, currentAccount(context).ID, r.requestCurrency(context), request)
+		return err
+	})
+	var shortage *stockError
+	var coupon *couponError
+	switch {
+	case errors.As(err, &shortage):
+		context.Status(http.StatusConflict).JSON(&fiber.Map{
+			"message": "Not enough stock for some items",
+			"lines":   shortage.Lines,
+		})
+		return nil
+	case errors.Is(err, errShippingMethodRequired), errors.Is(err, errShippingUnavailable):
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": err.Error()})
+		return nil
+	case errors.Is(err, errRateUnavailable):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Prices are no longer available in " + r.requestCurrency(context)})
+		return nil
+	case errors.As(err, &coupon):
+		return respondCouponError(context, coupon.Code, coupon.Err)
+	case errors.Is(err, errEmptyCart):
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Cart is empty"})
+		return nil
+	case err != nil:
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Could not place order"})
+		return err
+	}
+	return context.Status(http.StatusCreated).JSON(order)
+}
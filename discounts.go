@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+// discountLine is a cart or order line as seen by the promotion engine.
+// Discount accumulates what the promotions applied so far took off it.
+type discountLine struct {
+	ProductID uint
+	VariantID uint
+	UnitPrice money.Money
+	Quantity  int
+	Discount  money.Money
+}
+
+func (line *discountLine) remaining() money.Money {
+	return line.UnitPrice.Times(line.Quantity).Sub(line.Discount)
+}
+
+// AppliedDiscount is a promotion applied to a cart
+type AppliedDiscount struct {
+	PromotionID  uint        `json:"promotion_id"`
+	Code         string      `json:"code,omitempty"`
+	Name         string      `json:"name"`
+	Kind         string      `json:"kind"`
+	Amount       money.Money `json:"amount"`
+	FreeShipping bool        `json:"free_shipping,omitempty"`
+}
+
+// promotionRule is a promotion ready to evaluate. products holds the
+// products in its category, and is nil when it is not limited to one.
+type promotionRule struct {
+	Promotion
+	products map[uint]bool
+}
+
+func (rule *promotionRule) eligible(line *discountLine) bool {
+	return rule.products == nil || rule.products[line.ProductID]
+}
+
+// discountResult is the outcome of evaluating promotions on a set of lines
+type discountResult struct {
+	Discounts    []AppliedDiscount
+	Total        money.Money
+	FreeShipping bool
+}
+
+// applyPromotions evaluates rules against lines priced in currency,
+// recording each line's share in its Discount. Rules run by ascending
+// priority, then id, so the result does not depend on the order in which
+// codes were entered. Each rule works on what earlier rules left of the
+// line amounts. A rule that is not stackable only applies when no rule
+// applied before it, and then ends the evaluation. convert turns store
+// currency amounts (fixed discounts and thresholds) into currency.
+func applyPromotions(rules []promotionRule, lines []*discountLine, currency string,
+	convert func(money.Money) (money.Money, error)) (*discountResult, error) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	result := &discountResult{Discounts: []AppliedDiscount{}, Total: money.Zero(currency)}
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Stackable && len(result.Discounts) > 0 {
+			continue
+		}
+		var eligible []*discountLine
+		subtotal := money.Zero(currency)
+		for _, line := range lines {
+			if rule.eligible(line) && line.remaining().Amount > 0 {
+				eligible = append(eligible, line)
+				subtotal = subtotal.Add(line.remaining())
+			}
+		}
+		if len(eligible) == 0 {
+			continue
+		}
+		minimum, err := convert(rule.MinSubtotal)
+		if err != nil {
+			return nil, err
+		}
+		if subtotal.Cmp(minimum) < 0 {
+			continue
+		}
+		shares, err := rule.discount(eligible, subtotal, convert)
+		if err != nil {
+			return nil, err
+		}
+		applied := AppliedDiscount{
+			PromotionID:  rule.ID,
+			Name:         rule.Name,
+			Kind:         rule.Kind,
+			Amount:       money.Zero(currency),
+			FreeShipping: rule.Kind == PromotionFreeShipping,
+		}
+		if rule.Code != nil {
+			applied.Code = *rule.Code
+		}
+		for j, share := range shares {
+			applied.Amount = applied.Amount.Add(share)
+			eligible[j].Discount = eligible[j].Discount.Add(share)
+		}
+		if applied.Amount.IsZero() && !applied.FreeShipping {
+			continue
+		}
+		result.Discounts = append(result.Discounts, applied)
+		result.Total = result.Total.Add(applied.Amount)
+		result.FreeShipping = result.FreeShipping || applied.FreeShipping
+		if !rule.Stackable {
+			break
+		}
+	}
+	return result, nil
+}
+
+// discount returns the amount the rule takes off each eligible line, never
+// more than what is left of the line
+func (rule *promotionRule) discount(eligible []*discountLine, subtotal money.Money,
+	convert func(money.Money) (money.Money, error)) ([]money.Money, error) {
+	weights := make([]int64, len(eligible))
+	for i, line := range eligible {
+		weights[i] = line.remaining().Amount
+	}
+	switch rule.Kind {
+	case PromotionPercent:
+		amount, err := subtotal.Percent(rule.Percent)
+		if err != nil {
+			return nil, err
+		}
+		return amount.Allocate(weights), nil
+	case PromotionFixed:
+		amount, err := convert(rule.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if amount.Cmp(subtotal) > 0 {
+			amount = subtotal
+		}
+		return amount.Allocate(weights), nil
+	case PromotionBuyXGetY:
+		return rule.buyXGetY(eligible)
+	}
+	// Free shipping leaves the lines alone
+	return money.Zero(subtotal.Currency).Allocate(weights), nil
+}
+
+// buyXGetY discounts the cheapest units: of every BuyQuantity+GetQuantity
+// eligible units, GetQuantity are reduced by Percent. Units are ordered by
+// price, highest first, then by line so ties resolve the same way each time.
+func (rule *promotionRule) buyXGetY(eligible []*discountLine) ([]money.Money, error) {
+	type unit struct {
+		line  int
+		price money.Money
+	}
+	var units []unit
+	for i, line := range eligible {
+		for n := 0; n < line.Quantity; n++ {
+			units = append(units, unit{i, line.UnitPrice})
+		}
+	}
+	sort.SliceStable(units, func(i, j int) bool {
+		if units[i].price.Amount != units[j].price.Amount {
+			return units[i].price.Amount > units[j].price.Amount
+		}
+		return units[i].line < units[j].line
+	})
+	discounted := len(units) / (rule.BuyQuantity + rule.GetQuantity) * rule.GetQuantity
+	shares := make([]money.Money, len(eligible))
+	for i, line := range eligible {
+		shares[i] = money.Zero(line.UnitPrice.Currency)
+	}
+	for _, u := range units[len(units)-discounted:] {
+		off, err := u.price.Percent(rule.Percent)
+		if err != nil {
+			return nil, err
+		}
+		shares[u.line] = shares[u.line].Add(off)
+	}
+	for i, line := range eligible {
+		if left := line.remaining(); shares[i].Cmp(left) > 0 {
+			shares[i] = left
+		}
+	}
+	return shares, nil
+}
+
+// isCouponRejection reports whether err says a promotion cannot be used,
+// as opposed to a failure to find out
+func isCouponRejection(err error) bool {
+	return errors.Is(err, errCouponNotFound) || errors.Is(err, errCouponNotStarted) ||
+		errors.Is(err, errCouponExpired) || errors.Is(err, errCouponUsedUp) ||
+		errors.Is(err, errCouponCustomerUsed)
+}
+
+// loadPromotionRules returns the automatic promotions and the cart's
+// coupons that can be used by accountID at now, with the products each one
+// covers among productIDs. With lock set the promotion rows are locked so
+// usage limits hold while an order is placed. Coupons that cannot be used
+// are returned in rejected with the reason.
+func loadPromotionRules(db *gorm.DB, cartID, accountID uint, productIDs []uint, now time.Time, lock bool) ([]promotionRule, map[string]error, error) {
+	query := db.Where("code IS NULL OR id IN (SELECT promotion_id FROM cart_coupons WHERE cart_id = ?)", cartID).
+		Order("id")
+	if lock {
+		query = query.Set("gorm:query_option", "FOR UPDATE")
+	}
+	var promotions []Promotion
+	if err := query.Find(&promotions).Error; err != nil {
+		return nil, nil, err
+	}
+	var rules []promotionRule
+	rejected := map[string]error{}
+	for _, promotion := range promotions {
+		if err := checkPromotion(db, &promotion, accountID, now); err != nil {
+			if !isCouponRejection(err) {
+				return nil, nil, err
+			}
+			if promotion.Code != nil {
+				rejected[*promotion.Code] = err
+			}
+			continue
+		}
+		rule := promotionRule{Promotion: promotion}
+		if promotion.CategoryID != nil {
+			var ids []uint
+			err := db.Table("product_categories").
+				Where("product_id IN (?)", productIDs).
+				Where("product_id IN (?)", categoryIDsUnder(strconv.FormatUint(uint64(*promotion.CategoryID), 10))).
+				Pluck("DISTINCT product_id", &ids).Error
+			if err != nil {
+				return nil, nil, err
+			}
+			rule.products = map[uint]bool{}
+			for _, id := range ids {
+				rule.products[id] = true
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rejected, nil
+}
+
+// converter returns the function that turns store currency amounts into
+// the currency of rate; rate is nil for the store currency itself
+func converter(rate *ExchangeRate) func(money.Money) (money.Money, error) {
+	return func(amount money.Money) (money.Money, error) {
+		if rate == nil || amount.Currency == rate.Quote {
+			return amount, nil
+		}
+		return amount.Convert(rate.Quote, rate.Rate)
+	}
+}
+
+// couponError names the coupon that made checkout fail
+type couponError struct {
+	Code string
+	Err  error
+}
+
+func (e *couponError) Error() string { return fmt.Sprintf("coupon %s: %v", e.Code, e.Err) }
+func (e *couponError) Unwrap() error { return e.Err }
+
+// Enter a coupon code on the caller's cart
+func (r *Repository) ApplyCoupon(ctx *fiber.Ctx) error {
+	request := ApplyCouponRequest{}
+	if err := ctx.BodyParser(&request); err != nil || normalizeCouponCode(request.Code) == "" {
+		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+			"message": "code is required",
+		})
+		return nil
+	}
+	code := normalizeCouponCode(request.Code)
+	promotion := Promotion{}
+	if err := r.DB.Where("code = ?", code).First(&promotion).Error; err != nil {
+		return respondCouponError(ctx, code, err)
+	}
+	var accountID uint
+	if account := currentAccount(ctx); account != nil {
+		accountID = account.ID
+	}
+	if err := checkPromotion(r.DB, &promotion, accountID, time.Now()); err != nil {
+		return respondCouponError(ctx, code, err)
+	}
+	cart, err := r.cartForRequest(ctx, true)
+	if err == nil {
+		err = r.DB.Exec(`INSERT INTO cart_coupons (cart_id, promotion_id, created_at) VALUES (?, ?, ?)
+			ON CONFLICT DO NOTHING`, cart.ID, promotion.ID, time.Now()).Error
+	}
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return r.GetCart(ctx)
+}
+
+// Remove a coupon code from the caller's cart
+func (r *Repository) RemoveCoupon(ctx *fiber.Ctx) error {
+	cart, err := r.cartForRequest(ctx, false)
+	if err == nil && cart != nil {
+		err = r.DB.Where("cart_id = ? AND promotion_id IN (SELECT id FROM promotions WHERE code = ?)",
+			cart.ID, normalizeCouponCode(ctx.Params("code"))).Delete(&CartCoupon{}).Error
+	}
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return r.GetCart(ctx)
+}
+
+// CouponStatus tells whether a coupon entered on a cart gives a discount
+type CouponStatus struct {
+	Code    string `json:"code"`
+	Applied bool   `json:"applied"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// couponStatuses lists the coupons entered on a cart, in the order they
+// were entered, with the reason the ones that did not apply were left out
+func couponStatuses(db *gorm.DB, cartID uint, result *discountResult, rejected map[string]error) ([]CouponStatus, error) {
+	var codes []struct{ Code string }
+	err := db.Raw(`SELECT promotions.code FROM cart_coupons
+		JOIN promotions ON promotions.id = cart_coupons.promotion_id AND promotions.deleted_at IS NULL
+		WHERE cart_coupons.cart_id = ? ORDER BY cart_coupons.created_at, promotions.id`, cartID).Scan(&codes).Error
+	if err != nil {
+		return nil, err
+	}
+	applied := map[string]bool{}
+	for _, discount := range result.Discounts {
+		applied[discount.Code] = true
+	}
+	statuses := []CouponStatus{}
+	for _, row := range codes {
+		status := CouponStatus{Code: row.Code, Applied: applied[row.Code]}
+		switch {
+		case rejected[row.Code] != nil:
+			status.Reason = rejected[row.Code].Error()
+		case !status.Applied:
+			status.Reason = "the cart does not meet the conditions of this coupon or it cannot be combined"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"golang_api/money"
+)
+
+func testRule(id uint, priority int, stackable bool, kind string) promotionRule {
+	return promotionRule{Promotion: Promotion{
+		ID:          id,
+		Name:        kind,
+		Kind:        kind,
+		Priority:    priority,
+		Stackable:   stackable,
+		Active:      true,
+		MinSubtotal: money.Zero("USD"),
+		Amount:      money.Zero("USD"),
+	}}
+}
+
+func percentRule(id uint, priority int, stackable bool, percent string) promotionRule {
+	rule := testRule(id, priority, stackable, PromotionPercent)
+	rule.Percent = percent
+	return rule
+}
+
+func fixedRule(id uint, priority int, stackable bool, amount int64) promotionRule {
+	rule := testRule(id, priority, stackable, PromotionFixed)
+	rule.Amount = money.New(amount, "USD")
+	return rule
+}
+
+func TestApplyPromotionsOrdering(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []promotionRule
+		applied []uint
+		total   int64
+	}{
+		{
+			name:    "lower priority first",
+			rules:   []promotionRule{percentRule(2, 1, true, "10"), fixedRule(1, 0, true, 500)},
+			applied: []uint{1, 2},
+			total:   500 + 950,
+		},
+		{
+			name:    "entry order does not matter",
+			rules:   []promotionRule{fixedRule(1, 0, true, 500), percentRule(2, 1, true, "10")},
+			applied: []uint{1, 2},
+			total:   500 + 950,
+		},
+		{
+			name:    "equal priority by id",
+			rules:   []promotionRule{fixedRule(7, 0, true, 500), percentRule(3, 0, true, "10")},
+			applied: []uint{3, 7},
+			total:   1000 + 500,
+		},
+		{
+			name:    "non-stackable skipped after another applied",
+			rules:   []promotionRule{percentRule(1, 0, true, "10"), fixedRule(2, 1, false, 2000)},
+			applied: []uint{1},
+			total:   1000,
+		},
+		{
+			name:    "non-stackable ends evaluation",
+			rules:   []promotionRule{fixedRule(1, 0, false, 2000), percentRule(2, 1, true, "10")},
+			applied: []uint{1},
+			total:   2000,
+		},
+		{
+			name:    "fixed capped at what is left",
+			rules:   []promotionRule{percentRule(1, 0, true, "90"), fixedRule(2, 1, true, 5000)},
+			applied: []uint{1, 2},
+			total:   10000,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := []*discountLine{
+				{ProductID: 1, UnitPrice: money.New(2500, "USD"), Quantity: 2, Discount: money.Zero("USD")},
+				{ProductID: 2, UnitPrice: money.New(5000, "USD"), Quantity: 1, Discount: money.Zero("USD")},
+			}
+			result, err := applyPromotions(test.rules, lines, "USD", converter(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var applied []uint
+			for _, discount := range result.Discounts {
+				applied = append(applied, discount.PromotionID)
+			}
+			if len(applied) != len(test.applied) {
+				t.Fatalf("applied %v, want %v", applied, test.applied)
+			}
+			for i := range applied {
+				if applied[i] != test.applied[i] {
+					t.Fatalf("applied %v, want %v", applied, test.applied)
+				}
+			}
+			if result.Total.Amount != test.total {
+				t.Errorf("total = %d, want %d", result.Total.Amount, test.total)
+			}
+			var lineTotal int64
+			for _, line := range lines {
+				lineTotal += line.Discount.Amount
+				if line.remaining().IsNegative() {
+					t.Errorf("line %d discounted below zero: %v", line.ProductID, line.remaining())
+				}
+			}
+			if lineTotal != result.Total.Amount {
+				t.Errorf("line discounts add up to %d, total is %d", lineTotal, result.Total.Amount)
+			}
+		})
+	}
+}
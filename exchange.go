@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang_api/money"
+)
+
+var errRateUnavailable = errors.New("exchange rate unavailable")
+
+// ExchangeRate is the number of units of Quote one unit of Base buys
+type ExchangeRate struct {
+	Base   string
+	Quote  string
+	Rate   *big.Rat
+	Source string
+	AsOf   time.Time
+}
+
+// Decimal formats the rate with enough digits to store it on an order
+func (rate ExchangeRate) Decimal() string {
+	return strings.TrimRight(strings.TrimRight(rate.Rate.FloatString(12), "0"), ".")
+}
+
+// ExchangeRateProvider looks up conversion rates between currencies
+type ExchangeRateProvider interface {
+	Rate(ctx context.Context, base, quote string) (ExchangeRate, error)
+}
+
+// StaticRateProvider reads rates from a JSON file of the form
+//
+//	{"base": "USD", "as_of": "2024-01-02T00:00:00Z", "rates": {"EUR": "0.9150"}}
+//
+// Rates are decimal strings so they are read exactly. Cross rates between
+// two non-base currencies go through the base. The file is read again when
+// it changes, so rates can be updated without a restart.
+type StaticRateProvider struct {
+	Path string
+
+	mu       sync.Mutex
+	modified time.Time
+	base     string
+	asOf     time.Time
+	rates    map[string]*big.Rat
+}
+
+type rateFile struct {
+	Base  string            `json:"base"`
+	AsOf  time.Time         `json:"as_of"`
+	Rates map[string]string `json:"rates"`
+}
+
+// NewStaticRateProvider loads the rates file at path
+func NewStaticRateProvider(path string) (*StaticRateProvider, error) {
+	provider := &StaticRateProvider{Path: path}
+	if err := provider.reload(); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// reload reads the file if it changed since the last read. The caller
+// holds mu, or the provider is not shared yet.
+func (p *StaticRateProvider) reload() error {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(p.modified) && p.rates != nil {
+		return nil
+	}
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return err
+	}
+	var file rateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("exchange rates %s: %w", p.Path, err)
+	}
+	if !money.Valid(file.Base) {
+		return fmt.Errorf("exchange rates %s: unknown base currency %q", p.Path, file.Base)
+	}
+	rates := map[string]*big.Rat{strings.ToUpper(file.Base): big.NewRat(1, 1)}
+	for currency, text := range file.Rates {
+		rate, ok := new(big.Rat).SetString(text)
+		if !ok || rate.Sign() <= 0 || !money.Valid(currency) {
+			return fmt.Errorf("exchange rates %s: invalid rate %q for %s", p.Path, text, currency)
+		}
+		rates[strings.ToUpper(currency)] = rate
+	}
+	p.modified = info.ModTime()
+	p.base = strings.ToUpper(file.Base)
+	p.asOf = file.AsOf
+	p.rates = rates
+	return nil
+}
+
+func (p *StaticRateProvider) Rate(ctx context.Context, base, quote string) (ExchangeRate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Keep serving the last good rates if the file is being rewritten
+	_ = p.reload()
+	from, okFrom := p.rates[base]
+	to, okTo := p.rates[quote]
+	if !okFrom || !okTo {
+		return ExchangeRate{}, fmt.Errorf("%w: %s to %s", errRateUnavailable, base, quote)
+	}
+	return ExchangeRate{
+		Base:   base,
+		Quote:  quote,
+		Rate:   new(big.Rat).Quo(to, from),
+		Source: "static:" + p.Path,
+		AsOf:   p.asOf,
+	}, nil
+}
+
+// identityRates only knows the store currency; it is used when no rates
+// file is configured
+type identityRates struct{}
+
+func (identityRates) Rate(ctx context.Context, base, quote string) (ExchangeRate, error) {
+	if base != quote {
+		return ExchangeRate{}, fmt.Errorf("%w: %s to %s", errRateUnavailable, base, quote)
+	}
+	return ExchangeRate{Base: base, Quote: quote, Rate: big.NewRat(1, 1), Source: "identity"}, nil
+}
+
+// newExchangeRateProvider reads EXCHANGE_RATES_FILE. Without it prices can
+// only be shown in the store currency: explicit prices in other currencies
+// are kept, but a currency can only be selected when there is a rate for
+// it, since products without an explicit price are converted.
+func newExchangeRateProvider() (ExchangeRateProvider, error) {
+	path := os.Getenv("EXCHANGE_RATES_FILE")
+	if path == "" {
+		return identityRates{}, nil
+	}
+	return NewStaticRateProvider(path)
+}
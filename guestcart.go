@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/models"
+)
+
+const (
+	guestCartCookie = "guest_cart"
+	guestCartHeader = "X-Guest-Cart"
+	guestCartMaxAge = 30 * 24 * time.Hour
+	// guestTokenLocal holds a guest token issued while handling the request,
+	// which the request itself does not carry yet
+	guestTokenLocal = "guestToken"
+)
+
+// CartMergeStrategy decides the quantity of a product that is in both the
+// guest cart and the account cart when a guest logs in
+type CartMergeStrategy string
+
+const (
+	MergeSum    CartMergeStrategy = "sum"
+	MergeMax    CartMergeStrategy = "max"
+	MergeNewest CartMergeStrategy = "newest"
+)
+
+// ParseCartMergeStrategy defaults to MergeSum when name is empty
+func ParseCartMergeStrategy(name string) (CartMergeStrategy, error) {
+	switch strategy := CartMergeStrategy(strings.ToLower(name)); strategy {
+	case "":
+		return MergeSum, nil
+	case MergeSum, MergeMax, MergeNewest:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown cart merge strategy %q", name)
+}
+
+// signGuestToken appends an HMAC so clients cannot guess other guests' carts
+func (r *Repository) signGuestToken(token string) string {
+	mac := hmac.New(sha256.New, r.Tokens.Secret)
+	mac.Write([]byte("guest-cart:" + token))
+	return token + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// guestToken returns the verified guest token sent with the request, if any
+func (r *Repository) guestToken(context *fiber.Ctx) string {
+	if token, ok := context.Locals(guestTokenLocal).(string); ok {
+		return token
+	}
+	signed := context.Cookies(guestCartCookie)
+	if signed == "" {
+		signed = context.Get(guestCartHeader)
+	}
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return ""
+	}
+	token := signed[:i]
+	if !hmac.Equal([]byte(r.signGuestToken(token)), []byte(signed)) {
+		return ""
+	}
+	return token
+}
+
+func (r *Repository) setGuestCookie(context *fiber.Ctx, token string) {
+	signed := r.signGuestToken(token)
+	context.Locals(guestTokenLocal, token)
+	context.Cookie(&fiber.Cookie{
+		Name:     guestCartCookie,
+		Value:    signed,
+		Path:     "/api",
+		Expires:  time.Now().Add(guestCartMaxAge),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	// Clients that do not keep cookies can send this back in X-Guest-Cart
+	context.Set(guestCartHeader, signed)
+}
+
+func clearGuestCookie(context *fiber.Ctx) {
+	context.Locals(guestTokenLocal, "")
+	context.Cookie(&fiber.Cookie{
+		Name:    guestCartCookie,
+		Value:   "",
+		Path:    "/api",
+		Expires: time.Unix(0, 0),
+	})
+}
+
+// OptionalAuth stores the caller's Account when a bearer token is sent but
+// lets anonymous requests through
+func (r *Repository) OptionalAuth(context *fiber.Ctx) error {
+	if context.Get(fiber.HeaderAuthorization) == "" {
+		return context.Next()
+	}
+	return r.RequireAuth(context)
+}
+
+// cartForRequest returns the signed-in account's cart or the guest cart
+// named by the request cookie. A guest cart is only created when create is
+// set; otherwise nil is returned for a guest without one.
+func (r *Repository) cartForRequest(context *fiber.Ctx, create bool) (*models.Cart, error) {
+	if account := currentAccount(context); account != nil {
+		return cartForAccount(r.DB, account.ID)
+	}
+	if token := r.guestToken(context); token != "" {
+		cart := &models.Cart{}
+		err := r.DB.Where("guest_token = ?", token).First(cart).Error
+		if err == nil {
+			return cart, nil
+		}
+		if !gorm.IsRecordNotFoundError(err) {
+			return nil, err
+		}
+	}
+	if !create {
+		return nil, nil
+	}
+	token := randomToken(24)
+	cart := &models.Cart{GuestToken: &token}
+	if err := r.DB.Create(cart).Error; err != nil {
+		return nil, err
+	}
+	r.setGuestCookie(context, token)
+	return cart, nil
+}
+
+// mergeGuestCart moves the items of the request's guest cart into the
+// account's cart and deletes the guest cart
+func (r *Repository) mergeGuestCart(context *fiber.Ctx, accountID uint) error {
+	token := r.guestToken(context)
+	if token == "" {
+		return nil
+	}
+	guest := models.Cart{}
+	err := r.DB.Where("guest_token = ?", token).First(&guest).Error
+	if gorm.IsRecordNotFoundError(err) {
+		clearGuestCookie(context)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cart, err := cartForAccount(r.DB, accountID)
+	if err != nil {
+		return err
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockCart(tx, cart.ID); err != nil {
+			return err
+		}
+		if err := lockCart(tx, guest.ID); err != nil {
+			return err
+		}
+		var guestItems []models.CartItem
+		if err := tx.Where("cart_id = ?", guest.ID).Find(&guestItems).Error; err != nil {
+			return err
+		}
+		for _, guestItem := range guestItems {
+			existing := models.CartItem{}
+			err := tx.Where("cart_id = ? AND product_id = ? AND variant_id = ?",
+				cart.ID, guestItem.ProductID, guestItem.VariantID).First(&existing).Error
+			if err != nil && !gorm.IsRecordNotFoundError(err) {
+				return err
+			}
+			quantity := mergeQuantity(r.CartMerge, existing, guestItem)
+			// Lines whose product or variant is gone are dropped
+			item, err := findSellable(tx, guestItem.ProductID, guestItem.VariantID)
+			if err != nil {
+				if gorm.IsRecordNotFoundError(err) || errors.Is(err, errVariantNotFound) || errors.Is(err, errVariantRequired) {
+					continue
+				}
+				return err
+			}
+			// Stock limits what the guest cart adds, never what the
+			// account's cart already held
+			if item.Available <= 0 {
+				continue
+			}
+			if quantity > item.Available {
+				quantity = item.Available
+				if existing.ID != 0 && existing.Quantity > quantity {
+					quantity = existing.Quantity
+				}
+			}
+			if err := setCartQuantity(tx, cart.ID, guestItem.ProductID, guestItem.VariantID, quantity); err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("cart_id = ?", guest.ID).Delete(&models.CartItem{}).Error; err != nil {
+			return err
+		}
+		// Coupons entered as a guest carry over
+		err := tx.Exec(`INSERT INTO cart_coupons (cart_id, promotion_id, created_at)
+			SELECT ?, promotion_id, created_at FROM cart_coupons WHERE cart_id = ?
+			ON CONFLICT DO NOTHING`, cart.ID, guest.ID).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("cart_id = ?", guest.ID).Delete(&CartCoupon{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&guest).Error
+	})
+	if err != nil {
+		return err
+	}
+	clearGuestCookie(context)
+	return nil
+}
+
+// mergeQuantity applies the strategy to an account item (zero value when
+// absent) and a guest item for the same product
+func mergeQuantity(strategy CartMergeStrategy, existing, guest models.CartItem) int {
+	if existing.ID == 0 {
+		return guest.Quantity
+	}
+	switch strategy {
+	case MergeMax:
+		if guest.Quantity > existing.Quantity {
+			return guest.Quantity
+		}
+		return existing.Quantity
+	case MergeNewest:
+		if guest.UpdatedAt.After(existing.UpdatedAt) {
+			return guest.Quantity
+		}
+		return existing.Quantity
+	}
+	return existing.Quantity + guest.Quantity
+}
+
+// respondEmptyCart is used by GetCart for guests without a cart
+func (r *Repository) respondEmptyCart(context *fiber.Ctx) error {
+	return context.Status(http.StatusOK).JSON(emptyCartResponse(0, r.requestCurrency(context)))
+}
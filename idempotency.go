@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	idempotencyTTL    = 24 * time.Hour
+)
+
+// idempotencyExempt lists routes whose responses carry credentials. They
+// are never stored, so retries of them simply run again.
+var idempotencyExempt = map[string]bool{
+	"/api/login":         true,
+	"/api/token/refresh": true,
+}
+
+// normalizedPath matches the router, which ignores case and a trailing
+// slash
+func normalizedPath(path string) string {
+	path = strings.ToLower(path)
+	if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+		return trimmed
+	}
+	return "/"
+}
+
+// unreplayedHeaders are set afresh for every response
+var unreplayedHeaders = map[string]bool{
+	fiber.HeaderContentLength: true,
+	fiber.HeaderContentType:   true,
+	fiber.HeaderDate:          true,
+	fiber.HeaderServer:        true,
+	fiber.HeaderConnection:    true,
+}
+
+// Idempotency key states
+const (
+	idempotencyInProgress = "in_progress"
+	idempotencyCompleted  = "completed"
+)
+
+// Struct IdempotencyKey
+// The first response to a mutating request carrying an Idempotency-Key
+// header is stored here and replayed for retries with the same key.
+type IdempotencyKey struct {
+	ID             uint   `gorm:"primary_key"`
+	Scope          string `gorm:"unique_index:idx_idempotency_keys_scope_key;not null"`
+	Key            string `gorm:"unique_index:idx_idempotency_keys_scope_key;not null"`
+	Fingerprint    string `gorm:"not null"`
+	Status         string `gorm:"not null"`
+	ResponseStatus int
+	ResponseType   string
+	// ResponseHeaders holds the other response headers as a JSON list of
+	// name and value pairs
+	ResponseHeaders string
+	ResponseBody    []byte
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// anonymousScope is shared by every caller that cannot be identified
+const anonymousScope = "anonymous"
+
+// idempotencyScope keeps keys from different callers apart
+func (r *Repository) idempotencyScope(context *fiber.Ctx) string {
+	if context.Get(fiber.HeaderAuthorization) != "" {
+		if account, err := r.authenticate(context); err == nil {
+			return fmt.Sprintf("account:%d", account.ID)
+		}
+	}
+	if token := r.guestToken(context); token != "" {
+		return "guest:" + token
+	}
+	return anonymousScope
+}
+
+// requestFingerprint identifies the method, path and body of a request
+func requestFingerprint(context *fiber.Ctx) string {
+	sum := sha256.New()
+	sum.Write([]byte(context.Method()))
+	sum.Write([]byte{0})
+	sum.Write([]byte(context.OriginalURL()))
+	sum.Write([]byte{0})
+	sum.Write(context.Body())
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Idempotency makes retries of mutating requests safe. Requests from an
+// account or guest cart with an Idempotency-Key header run once; identical
+// retries get the stored response, a different request under the same key
+// gets 422, and a retry that arrives while the first is still running gets
+// 409.
+func (r *Repository) Idempotency(context *fiber.Ctx) error {
+	key := context.Get(idempotencyHeader)
+	switch context.Method() {
+	case fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete:
+	default:
+		return context.Next()
+	}
+	if key == "" || idempotencyExempt[normalizedPath(context.Path())] {
+		return context.Next()
+	}
+	scope := r.idempotencyScope(context)
+	if scope == anonymousScope {
+		// Callers without an account or guest cart share this scope, so a
+		// stored response (and the guest cookie it may set) would be
+		// replayed to strangers
+		return context.Next()
+	}
+	fingerprint := requestFingerprint(context)
+
+	// Forget keys past their lifetime, including ones left in progress by
+	// a crashed request
+	err := r.DB.Unscoped().
+		Where("scope = ? AND key = ? AND created_at < ?", scope, key, time.Now().Add(-idempotencyTTL)).
+		Delete(&IdempotencyKey{}).Error
+	if err != nil {
+		return err
+	}
+	// The unique index decides which of two concurrent requests runs
+	now := time.Now()
+	claimed := r.DB.Exec(`INSERT INTO idempotency_keys (scope, key, fingerprint, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		scope, key, fingerprint, idempotencyInProgress, now, now)
+	if claimed.Error != nil {
+		return claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		stored := IdempotencyKey{}
+		if err := r.DB.Where("scope = ? AND key = ?", scope, key).First(&stored).Error; err != nil {
+			return err
+		}
+		if stored.Fingerprint != fingerprint {
+			context.Status(http.StatusUnprocessableEntity).JSON(
+				&fiber.Map{"message": "Idempotency-Key was already used for a different request"})
+			return nil
+		}
+		if stored.Status != idempotencyCompleted {
+			context.Status(http.StatusConflict).JSON(
+				&fiber.Map{"message": "A request with this Idempotency-Key is still being processed"})
+			return nil
+		}
+		var headers [][2]string
+		if stored.ResponseHeaders != "" {
+			if err := json.Unmarshal([]byte(stored.ResponseHeaders), &headers); err != nil {
+				return err
+			}
+		}
+		for _, header := range headers {
+			context.Response().Header.Add(header[0], header[1])
+		}
+		context.Set("Idempotent-Replayed", "true")
+		context.Set(fiber.HeaderContentType, stored.ResponseType)
+		return context.Status(stored.ResponseStatus).Send(stored.ResponseBody)
+	}
+
+	release := func() {
+		r.DB.Unscoped().Where("scope = ? AND key = ?", scope, key).Delete(&IdempotencyKey{})
+	}
+	if err := context.Next(); err != nil {
+		release()
+		return err
+	}
+	status := context.Response().StatusCode()
+	if status >= http.StatusInternalServerError {
+		// Let the client retry server errors
+		release()
+		return nil
+	}
+	headers := [][2]string{}
+	context.Response().Header.VisitAll(func(name, value []byte) {
+		if !unreplayedHeaders[string(name)] {
+			headers = append(headers, [2]string{string(name), string(value)})
+		}
+	})
+	storedHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	body := append([]byte(nil), context.Response().Body()...)
+	return r.DB.Model(&IdempotencyKey{}).
+		Where("scope = ? AND key = ?", scope, key).
+		Updates(map[string]interface{}{
+			"status":           idempotencyCompleted,
+			"response_status":  status,
+			"response_type":    string(context.Response().Header.ContentType()),
+			"response_headers": string(storedHeaders),
+			"response_body":    body,
+			"updated_at":       time.Now(),
+		}).Error
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/media"
+)
+
+const signedURLTTL = time.Hour
+
+// Struct ProductImage
+// The original is stored under Key; thumbnails are stored next to it, one
+// per width in media.ThumbnailWidths.
+type ProductImage struct {
+	ID          uint              `json:"id" gorm:"primary_key"`
+	ProductID   uint              `json:"product_id" gorm:"index;not null"`
+	Position    int               `json:"position"`
+	Key         string            `json:"-" gorm:"not null"`
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	URL         string            `json:"url" gorm:"-"`
+	Thumbnails  map[string]string `json:"thumbnails" gorm:"-"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// Struct ReorderImagesRequest
+type ReorderImagesRequest struct {
+	ImageIDs []uint `json:"image_ids"`
+}
+
+func thumbnailKey(key string, width int) string {
+	return fmt.Sprintf("%s.thumb-%d.jpg", key, width)
+}
+
+// newBlobStore builds the store named by MEDIA_STORE: "local" (default)
+// writes below MEDIA_ROOT, "s3" talks to the bucket at S3_ENDPOINT, and
+// "s3standin" starts an in-memory S3 stand-in on S3_STANDIN_ADDR.
+func newBlobStore() (media.BlobStore, error) {
+	switch name := os.Getenv("MEDIA_STORE"); name {
+	case "", "local":
+		root := os.Getenv("MEDIA_ROOT")
+		if root == "" {
+			root = "uploads"
+		}
+		baseURL := os.Getenv("MEDIA_BASE_URL")
+		if baseURL == "" {
+			baseURL = "/media"
+		}
+		// Without a secret anyone could sign their own media URLs
+		secret := os.Getenv("MEDIA_SIGNING_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("MEDIA_SIGNING_SECRET is required for the local media store")
+		}
+		return &media.LocalStore{
+			Root:    root,
+			BaseURL: baseURL,
+			Secret:  []byte(secret),
+		}, nil
+	case "s3":
+		return &media.S3Store{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	case "s3standin":
+		addr := os.Getenv("S3_STANDIN_ADDR")
+		server := media.NewS3StandIn(os.Getenv("S3_REGION"), os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"))
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, server))
+		}()
+		return &media.S3Store{
+			Endpoint:  "http://" + addr,
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown media store %q", name)
+	}
+}
+
+// signImages fills in the signed URLs of product images
+func (r *Repository) signImages(images []ProductImage) {
+	for i := range images {
+		image := &images[i]
+		image.URL, _ = r.Blobs.SignedURL(image.Key, signedURLTTL)
+		image.Thumbnails = map[string]string{}
+		for _, width := range media.ThumbnailWidths {
+			image.Thumbnails[strconv.Itoa(width)], _ = r.Blobs.SignedURL(thumbnailKey(image.Key, width), signedURLTTL)
+		}
+	}
+}
+
+// preloadImages loads the ordered images of each product and signs them
+func (r *Repository) preloadImages(products []*Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(products))
+	byID := map[uint]*Product{}
+	for i, product := range products {
+		ids[i] = product.ID
+		byID[product.ID] = product
+		product.Images = []ProductImage{}
+	}
+	var images []ProductImage
+	if err := r.DB.Where("product_id IN (?)", ids).Order("position, id").Find(&images).Error; err != nil {
+		return err
+	}
+	r.signImages(images)
+	for _, image := range images {
+		product := byID[image.ProductID]
+		product.Images = append(product.Images, image)
+	}
+	return nil
+}
+
+// Upload an image for a product
+func (r *Repository) UploadProductImage(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	file, err := context.FormFile("image")
+	if err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "image file is required"})
+		return nil
+	}
+	if file.Size > r.MaxUploadSize {
+		context.Status(http.StatusRequestEntityTooLarge).JSON(
+			&fiber.Map{"message": fmt.Sprintf("image must be at most %d bytes", r.MaxUploadSize)})
+		return nil
+	}
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	data, err := io.ReadAll(io.LimitReader(src, r.MaxUploadSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > r.MaxUploadSize {
+		context.Status(http.StatusRequestEntityTooLarge).JSON(
+			&fiber.Map{"message": fmt.Sprintf("image must be at most %d bytes", r.MaxUploadSize)})
+		return nil
+	}
+	contentType, ext, err := media.Sniff(data)
+	if err != nil {
+		context.Status(http.StatusUnsupportedMediaType).JSON(
+			&fiber.Map{"message": "image must be a JPEG, PNG or GIF"})
+		return nil
+	}
+	img, err := media.Decode(data)
+	if err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "image could not be decoded"})
+		return nil
+	}
+
+	ctx := context.Context()
+	key := fmt.Sprintf("products/%d/%s%s", product.ID, randomToken(12), ext)
+	if err := r.Blobs.Put(ctx, key, contentType, bytes.NewReader(data), int64(len(data))); err != nil {
+		context.Status(http.StatusBadGateway).JSON(
+			&fiber.Map{"message": "Failed to store image"})
+		return err
+	}
+	for _, width := range media.ThumbnailWidths {
+		thumb, err := media.Thumbnail(img, width)
+		if err == nil {
+			err = r.Blobs.Put(ctx, thumbnailKey(key, width), "image/jpeg", bytes.NewReader(thumb), int64(len(thumb)))
+		}
+		if err != nil {
+			context.Status(http.StatusBadGateway).JSON(
+				&fiber.Map{"message": "Failed to store thumbnail"})
+			return err
+		}
+	}
+
+	image := ProductImage{
+		ProductID:   product.ID,
+		Key:         key,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}
+	// New images go to the end of the list
+	var last struct{ Position *int }
+	err = r.DB.Model(&ProductImage{}).Select("max(position) AS position").Where("product_id = ?", product.ID).Scan(&last).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to save image"})
+		return err
+	}
+	if last.Position != nil {
+		image.Position = *last.Position + 1
+	}
+	if err := r.DB.Create(&image).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to save image"})
+		return err
+	}
+	images := []ProductImage{image}
+	r.signImages(images)
+	return context.Status(http.StatusCreated).JSON(images[0])
+}
+
+// Delete a product image
+func (r *Repository) DeleteProductImage(context *fiber.Ctx) error {
+	image := ProductImage{}
+	err := r.DB.Where("id = ? AND product_id = ?", context.Params("image_id"), context.Params("id")).First(&image).Error
+	if err != nil {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Image not found"})
+		return nil
+	}
+	if err := r.DB.Delete(&image).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to delete image"})
+		return err
+	}
+	// The row is gone; leftover blobs are only logged
+	ctx := context.Context()
+	keys := []string{image.Key}
+	for _, width := range media.ThumbnailWidths {
+		keys = append(keys, thumbnailKey(image.Key, width))
+	}
+	for _, key := range keys {
+		if err := r.Blobs.Delete(ctx, key); err != nil {
+			log.Printf("could not delete blob %s: %v", key, err)
+		}
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Image deleted successfully"})
+	return nil
+}
+
+// Set the order of a product's images
+func (r *Repository) ReorderProductImages(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	request := ReorderImagesRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	// Listing an image twice would leave another one out
+	seen := map[uint]bool{}
+	for _, id := range request.ImageIDs {
+		if seen[id] {
+			context.Status(http.StatusUnprocessableEntity).JSON(
+				&fiber.Map{"message": "image_ids must list every image of the product once"})
+			return nil
+		}
+		seen[id] = true
+	}
+	var count int
+	if err := r.DB.Model(&ProductImage{}).Where("product_id = ?", product.ID).Count(&count).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to reorder images"})
+		return err
+	}
+	if count != len(request.ImageIDs) {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "image_ids must list every image of the product once"})
+		return nil
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		for position, id := range request.ImageIDs {
+			updated := tx.Model(&ProductImage{}).
+				Where("id = ? AND product_id = ?", id, product.ID).
+				Update("position", position)
+			if updated.Error != nil {
+				return updated.Error
+			}
+			if updated.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+		}
+		return nil
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "image_ids must list every image of the product once"})
+		return nil
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to reorder images"})
+		return err
+	}
+	if err := r.preloadImages([]*Product{product}); err != nil {
+		return err
+	}
+	return context.JSON(product.Images)
+}
+
+// Serve files from the local blob store behind signed URLs
+func (r *Repository) ServeMedia(context *fiber.Ctx) error {
+	local, ok := r.Blobs.(*media.LocalStore)
+	if !ok {
+		return context.SendStatus(http.StatusNotFound)
+	}
+	key := context.Params("*")
+	if !local.Verify(key, context.Query("expires"), context.Query("signature"), time.Now()) {
+		return context.SendStatus(http.StatusForbidden)
+	}
+	blob, err := local.Get(context.Context(), key)
+	if errors.Is(err, media.ErrNotFound) {
+		return context.SendStatus(http.StatusNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+	context.Set(fiber.HeaderContentType, http.DetectContentType(data))
+	context.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+	return context.Send(data)
+}
@@ -9,13 +9,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/joho/godotenv"
 
-	// "golang.org/x/crypto/bcrypt"
-
 	// "gorm.io/gorm"
 
 	// "gorm.io/gorm"
@@ -23,14 +23,36 @@ import (
 	// _ "github.com/jinzhu/gorm/dialects/postgres"
 	// _ "github.com/jinzhu/gorm/dialects/postgres"
 
+	"golang_api/media"
+	"golang_api/models"
+	"golang_api/money"
+	"golang_api/payment"
 	"golang_api/storage"
-	// "m/v2/models"
 )
 
 // Struct Repository
 type Repository struct {
-	DB      *gorm.DB
-	CartMap map[uint]int
+	DB        *gorm.DB
+	Hasher    PasswordHasher
+	Tokens    *TokenIssuer
+	CartMerge CartMergeStrategy
+	Payments  payment.Provider
+	Currency  string
+	Rates     ExchangeRateProvider
+	Tax       TaxCalculator
+	// Carrier quotes carrier shipping methods; nil when none is configured
+	Carrier CarrierRateProvider
+	Blobs   media.BlobStore
+	// MaxUploadSize caps image uploads in bytes
+	MaxUploadSize int64
+	// HoldTTL is how long checkout holds stock for an unpaid order
+	HoldTTL     time.Duration
+	StockAlerts StockAlertConfig
+	Notifier    StaffNotifier
+	Customers   CustomerNotifier
+	// WishlistWatch is how often wishlists are checked for price drops
+	// and restocks
+	WishlistWatch time.Duration
 }
 
 // Struct Message
@@ -41,10 +63,12 @@ type Message struct {
 // Struct Register & Log_In
 type (
 	Account struct {
+		ID       uint   `json:"id" gorm:"primary_key"`
 		Fullname string `json:"fullname"`
 		Email    string `json:"email"`
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Roles    []Role `json:"roles,omitempty" gorm:"many2many:account_roles"`
 		// Confirm_Password string `json:"confirm_password"`
 	}
 	LoginRequest struct {
@@ -52,11 +76,8 @@ type (
 		Password string `json:"password"`
 	}
 )
-type CartItem struct {
-	gorm.Model
-	ProductID uint
-	Quantity  int
-}
+
+func (Account) TableName() string { return "account" }
 
 // Struct UpdateAccountRequest
 type UpdateAccountRequest struct {
@@ -85,17 +106,33 @@ type UpdatePasswordRequest struct {
 
 // Struct Product
 type Product struct {
-	Title       string  `json:"title"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Quantity    int     `json:"quantity"`
-}
-type CartItems struct {
-	ID       uint `json:"id" gorm:"primaryKey"`
-	Product  uint `json:"product"`
-	Quantity int  `json:"quantity"`
+	ID          uint        `json:"id" gorm:"primary_key"`
+	SKU         string      `json:"sku"`
+	Slug        string      `json:"slug"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Price       money.Money `json:"price" gorm:"embedded;embedded_prefix:price_"`
+	TaxClass    string      `json:"tax_class" gorm:"not null;default:'standard'"`
+	// Weight and dimensions of one unit as shipped, in grams and millimetres
+	WeightGrams int `json:"weight_grams" gorm:"not null;default:0"`
+	LengthMM    int `json:"length_mm" gorm:"not null;default:0"`
+	WidthMM     int `json:"width_mm" gorm:"not null;default:0"`
+	HeightMM    int `json:"height_mm" gorm:"not null;default:0"`
+	Quantity    int `json:"quantity"`
+	// Available is Quantity less the units held by pending orders
+	Available  int              `json:"available" gorm:"-"`
+	CreatedAt  time.Time        `json:"created_at"`
+	UpdatedAt  time.Time        `json:"updated_at"`
+	DeletedAt  *time.Time       `json:"-" sql:"index"`
+	Categories []Category       `json:"categories" gorm:"-"`
+	Options    []ProductOption  `json:"options" gorm:"-"`
+	Variants   []ProductVariant `json:"variants" gorm:"-"`
+	Images     []ProductImage   `json:"images" gorm:"-"`
+	Rating     *ProductRating   `json:"rating,omitempty" gorm:"-"`
 }
 
+func (Product) TableName() string { return "product" }
+
 // // Struct GetUserDataResponse
 // type GetUserDataResponse struct {
 // 	Fullname string `json:"fullname"`
@@ -106,22 +143,64 @@ type CartItems struct {
 
 // Struct Order
 type Order struct {
-	Fullname   string `json:"fullname"`
-	Mobile     string `json:"mobile"`
-	Address    string `json:"address"`
-	ItemTitle  string `json:"itemTitle"`
-	Quantity   int    `json:"quantity"`
-	PurchaseID uint   `json:"-"`
+	ID        uint   `json:"id" gorm:"primary_key"`
+	AccountID uint   `json:"account_id" gorm:"index;not null"`
+	Fullname  string `json:"fullname"`
+	Mobile    string `json:"mobile"`
+	Address   string `json:"address"`
+	// Country, Region and PostalCode decide the tax rates
+	Country    string `json:"country"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	Status     string `json:"status" gorm:"index;not null"`
+	// Subtotal is the sum of the line totals before DiscountTotal is taken off
+	Subtotal      money.Money     `json:"subtotal" gorm:"embedded;embedded_prefix:subtotal_"`
+	DiscountTotal money.Money     `json:"discount_total" gorm:"embedded;embedded_prefix:discount_total_"`
+	Discounts     []OrderDiscount `json:"discounts,omitempty"`
+	FreeShipping  bool            `json:"free_shipping" gorm:"not null;default:false"`
+	// TaxTotal is already part of the line amounts when PricesIncludeTax
+	// is set and added to Total otherwise
+	TaxTotal         money.Money `json:"tax_total" gorm:"embedded;embedded_prefix:tax_total_"`
+	PricesIncludeTax bool        `json:"prices_include_tax" gorm:"not null;default:false"`
+	// ShippingMethod is the name of the method chosen at checkout
+	ShippingMethodID *uint       `json:"shipping_method_id"`
+	ShippingMethod   string      `json:"shipping_method,omitempty"`
+	ShippingTotal    money.Money `json:"shipping_total" gorm:"embedded;embedded_prefix:shipping_total_"`
+	Total            money.Money `json:"total" gorm:"embedded;embedded_prefix:total_"`
+	// BaseTotal is Total in the store currency. The rate it was converted
+	// at is frozen on the order so later rate changes do not affect it.
+	BaseTotal    money.Money `json:"base_total" gorm:"embedded;embedded_prefix:base_total_"`
+	ExchangeRate string      `json:"exchange_rate"`
+	RateSource   string      `json:"rate_source"`
+	RateAsOf     *time.Time  `json:"rate_as_of,omitempty"`
+	// ReservedUntil is when the stock held for a pending order is released
+	ReservedUntil *time.Time  `json:"reserved_until,omitempty"`
+	Lines         []OrderLine `json:"lines,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
 }
 
-// HASH
-// func hashPassword(password string) (string, error) {
-// 	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-// 	if err != nil {
-// 		return "", err
-// 	}
-// 	return string(hashedBytes), nil
-// }
+// Struct OrderLine
+// Title and UnitPrice are copied from the product at checkout so later
+// product edits do not change past orders.
+type OrderLine struct {
+	ID        uint        `json:"id" gorm:"primary_key"`
+	OrderID   uint        `json:"order_id" gorm:"index;not null"`
+	ProductID uint        `json:"product_id" gorm:"index;not null"`
+	VariantID uint        `json:"variant_id" gorm:"not null;default:0"`
+	SKU       string      `json:"sku"`
+	Title     string      `json:"title"`
+	UnitPrice money.Money `json:"unit_price" gorm:"embedded;embedded_prefix:unit_price_"`
+	// BaseUnitPrice is the store currency price UnitPrice was derived from
+	BaseUnitPrice money.Money `json:"base_unit_price" gorm:"embedded;embedded_prefix:base_unit_price_"`
+	Quantity      int         `json:"quantity"`
+	LineTotal     money.Money `json:"line_total" gorm:"embedded;embedded_prefix:line_total_"`
+	// Discount is the line's share of the order's discounts
+	Discount money.Money `json:"discount" gorm:"embedded;embedded_prefix:discount_"`
+	TaxName  string      `json:"tax_name,omitempty"`
+	TaxRate  string      `json:"tax_rate"`
+	Tax      money.Money `json:"tax" gorm:"embedded;embedded_prefix:tax_"`
+}
 
 // Create Account
 func (r *Repository) CreateAccount(context *fiber.Ctx) error {
@@ -146,25 +225,28 @@ func (r *Repository) CreateAccount(context *fiber.Ctx) error {
 		return nil
 	}
 	// Hash the password
-	// hashedPassword, err := hashPassword(account.Password)
-	// if err != nil {
-	// 	context.Status(http.StatusInternalServerError).JSON(
-	// 		&fiber.Map{"message": "error hashing password"})
-	// 	return err
-	// }
-	// // Create the new account
-	// newAccount := Account{
-	// 	Fullname: account.Fullname,
-	// 	Email:    account.Email,
-	// 	Username: account.Username,
-	// 	Password: hashedPassword,
-	// }
-	err = r.DB.Table("account").Create(&account).Error
+	hashedPassword, err := r.Hasher.Hash(account.Password)
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "error hashing password"})
+		return err
+	}
+	// Create the new account
+	newAccount := Account{
+		Fullname: account.Fullname,
+		Email:    account.Email,
+		Username: account.Username,
+		Password: hashedPassword,
+	}
+	err = r.DB.Table("account").Create(&newAccount).Error
 	if err != nil {
 		context.Status(http.StatusBadRequest).JSON(
 			&fiber.Map{"message": "could not create account"})
 		return err
 	}
+	if err := grantRole(r.DB, newAccount.ID, RoleCustomer); err != nil {
+		log.Printf("could not grant %s role to %s: %v", RoleCustomer, newAccount.Username, err)
+	}
 	context.Status(http.StatusOK).JSON(
 		&fiber.Map{"message": "Successfully Registered!!!"})
 	return nil
@@ -190,66 +272,6 @@ func (r *Repository) GetSelectedColumnsFromAccount(context *fiber.Ctx) error {
 	return context.JSON(results)
 }
 
-// Add Product with Image Upload
-// func (r *Repository) AddProduct(context *fiber.Ctx) error {
-// 	product := Product{}
-// 	err := context.BodyParser(&product)
-// 	if err != nil {
-// 		// Handle parsing error
-// 		return err
-// 	}
-// 	// Handle image upload
-// 	file, err := context.FormFile("image")
-// 	if err != nil {
-// 		// Handle image upload error
-// 		return err
-// 	}
-// 	// Open the uploaded file
-// 	src, err := file.Open()
-// 	if err != nil {
-// 		// Handle file open error
-// 		return err
-// 	}
-// 	defer src.Close()
-// 	// Read the file data into a byte slice
-// 	imageData, err := ioutil.ReadAll(src)
-// 	if err != nil {
-// 		// Handle read error
-// 		return err
-// 	}
-// 	// Store the image data in the product object
-// 	product.ImageData = imageData
-// 	// Insert the product (including image data) into the database
-// 	if err := r.DB.Table("product").Create(&product).Error; err != nil {
-// 		// Handle database insert error
-// 		return err
-// 	}
-// 	// Return a success response
-// 	return context.Status(http.StatusOK).JSON(
-// 		&fiber.Map{"message": "Product added successfully"})
-// }
-
-// Handle purchase submission
-// func (r *Repository) SubmitPurchase(context *fiber.Ctx) error {
-// 	purchase := Order{}
-// 	err := context.BodyParser(&purchase)
-// 	if err != nil {
-// 		context.Status(http.StatusUnprocessableEntity).JSON(
-// 			&fiber.Map{"message": "Invalid request"})
-// 		return err
-// 	}
-// 	// Store the purchase in the database
-// 	err = r.DB.Table("orders").Create(&purchase).Error
-// 	if err != nil {
-// 		context.Status(http.StatusBadRequest).JSON(
-// 			&fiber.Map{"message": "Could not create purchase"})
-// 		return err
-// 	}
-// 	context.Status(http.StatusOK).JSON(
-// 		&fiber.Map{"message": "Purchase saved successfully"})
-// 	return nil
-// }
-
 // log in
 func (r *Repository) Login(context *fiber.Ctx) error {
 	loginRequest := LoginRequest{}
@@ -260,22 +282,46 @@ func (r *Repository) Login(context *fiber.Ctx) error {
 			&fiber.Map{"message": "invalid request"})
 		return err
 	}
-	err = r.DB.Table("account").Where("password = ?", loginRequest.Password).First(&Clientrespones).Error
+	// The username field accepts either the username or the email
+	err = r.DB.Table("account").
+		Where("username = ? OR email = ?", loginRequest.Username, loginRequest.Username).
+		First(&Clientrespones).Error
 	if err != nil {
+		verifyPassword(string(dummyHash), loginRequest.Password)
 		context.Status(http.StatusUnauthorized).JSON(
 			&fiber.Map{"message": "Invalid Username or Password"})
 		return nil
 	}
 	// Check if the provided password matches the hashed password in the database
-	// err = bcrypt.CompareHashAndPassword([]byte(Clientrespones.Password), []byte(loginRequest.Password))
-	// if err != nil {
-	// 	context.Status(http.StatusUnauthorized).JSON(
-	// 		&fiber.Map{"message": "Invalid Username or Password"})
-	// 	return nil
-	// }
-	textMessage := Message{}
-	textMessage.Message = "Welcome! " + loginRequest.Username
-	return context.JSON(textMessage)
+	if !verifyPassword(Clientrespones.Password, loginRequest.Password) {
+		context.Status(http.StatusUnauthorized).JSON(
+			&fiber.Map{"message": "Invalid Username or Password"})
+		return nil
+	}
+	// Upgrade plaintext or outdated hashes now that we know the password
+	if r.Hasher.NeedsRehash(Clientrespones.Password) {
+		hashedPassword, err := r.Hasher.Hash(loginRequest.Password)
+		if err == nil {
+			err = r.DB.Table("account").
+				Where("id = ?", Clientrespones.ID).
+				Update("password", hashedPassword).Error
+		}
+		if err != nil {
+			log.Printf("could not upgrade password hash for %s: %v", Clientrespones.Username, err)
+		}
+	}
+	// Bring over anything added to the cart before logging in
+	if err := r.mergeGuestCart(context, Clientrespones.ID); err != nil {
+		log.Printf("could not merge guest cart for %s: %v", Clientrespones.Username, err)
+	}
+	response, err := r.issueTokens(r.DB, Clientrespones.ID, randomToken(16))
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Could not start session"})
+		return err
+	}
+	response.Message = "Welcome! " + Clientrespones.Username
+	return context.JSON(response)
 }
 
 // // Update user account
@@ -303,69 +349,50 @@ func (r *Repository) Login(context *fiber.Ctx) error {
 // }
 
 // Update user account by Admin
-// func (r *Repository) UpdateUser(context *fiber.Ctx) error {
-// 	var updateRequest UpdateUserRequest
-// 	if err := context.BodyParser(&updateRequest); err != nil {
-// 		context.Status(http.StatusUnprocessableEntity).JSON(
-// 			&fiber.Map{"message": "Invalid request"})
-// 		return err
-// 	}
-// 	// Update the user's account details in the database based on the username
-// 	err := r.DB.Table("account").
-// 		Where("username = ?", updateRequest.Username).
-// 		Updates(&Account{
-// 			Fullname: updateRequest.Fullname,
-// 			Email:    updateRequest.Email,
-// 		}).Error
-// 	if err != nil {
-// 		context.Status(http.StatusInternalServerError).JSON(
-// 			&fiber.Map{"message": "Failed to update user"})
-// 		return err
-// 	}
-// 	context.Status(http.StatusOK).JSON(
-// 		&fiber.Map{"message": "User updated successfully"})
-// 	return nil
-// }
+func (r *Repository) UpdateUser(context *fiber.Ctx) error {
+	var updateRequest UpdateUserRequest
+	if err := context.BodyParser(&updateRequest); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return err
+	}
+	// Update the user's account details in the database based on the username
+	err := r.DB.Table("account").
+		Where("username = ?", updateRequest.Username).
+		Updates(&Account{
+			Fullname: updateRequest.Fullname,
+			Email:    updateRequest.Email,
+		}).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to update user"})
+		return err
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "User updated successfully"})
+	return nil
+}
 
-// // Update Product by Admin
-// func (r *Repository) UpdateProductByTitle(context *fiber.Ctx) error {
-// 	title := context.Query("title")
-// 	// Check if the product exists
-// 	var existingProduct Product
-// 	err := r.DB.Table("product").
-// 		Where("title = ?", title).
-// 		First(&existingProduct).Error
-// 	if err != nil {
-// 		context.Status(http.StatusNotFound).JSON(
-// 			&fiber.Map{"message": "Product not found"})
-// 		return err
-// 	}
-// 	// Parse the updated product data from the request body
-// 	var updatedProduct Product
-// 	if err := context.BodyParser(&updatedProduct); err != nil {
-// 		context.Status(http.StatusUnprocessableEntity).JSON(
-// 			&fiber.Map{"message": "Invalid request"})
-// 		return err
-// 	}
-// 	// Update the product in the database
-// 	err = r.DB.Table("product").
-// 		Where("title = ?", title).
-// 		Updates(&Product{
-// 			Title:       updatedProduct.Title,
-// 			Description: updatedProduct.Description,
-// 			Price:       updatedProduct.Price,
-// 			Quantity:    updatedProduct.Quantity,
-// 			ImageData:   updatedProduct.ImageData,
-// 		}).Error
-// 	if err != nil {
-// 		context.Status(http.StatusInternalServerError).JSON(
-// 			&fiber.Map{"message": "Failed to update product"})
-// 		return err
-// 	}
-// 	context.Status(http.StatusOK).JSON(
-// 		&fiber.Map{"message": "Product updated successfully"})
-// 	return nil
-// }
+// Update Product by Admin
+func (r *Repository) UpdateProductByTitle(context *fiber.Ctx) error {
+	title := context.Query("title")
+	// Titles are not unique, so only update when exactly one matches
+	var matches []Product
+	if err := r.DB.Where("title = ?", title).Limit(2).Find(&matches).Error; err != nil {
+		return respondProductLookupError(context, err)
+	}
+	if len(matches) == 0 {
+		return respondProductLookupError(context, gorm.ErrRecordNotFound)
+	}
+	if len(matches) > 1 {
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Several products have this title; update the product by id"})
+		return nil
+	}
+	existingProduct := matches[0]
+	// The body is a partial ProductRequest, validated like PATCH /products/:id
+	return r.updateProduct(context, &existingProduct, false)
+}
 
 // // Change password
 // func (r *Repository) UpdatePassword(context *fiber.Ctx) error {
@@ -478,17 +505,29 @@ func (r *Repository) Login(context *fiber.Ctx) error {
 // 	return context.JSON(usernames)
 // }
 
-// Get all products
+// Get all products, one page at a time
 func (r *Repository) GetAllProducts(context *fiber.Ctx) error {
-	var products []Product
-	// Retrieve all products from the database
-	err := r.DB.Table("product").Find(&products).Error
+	query, err := parseProductQuery(context, r.Currency)
+	if err != nil {
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": err.Error()})
+		return nil
+	}
+	// Retrieve the products from the database
+	page, err := listProducts(r.DB, query)
 	if err != nil {
 		context.Status(http.StatusInternalServerError).JSON(
 			&fiber.Map{"message": "Failed to retrieve products"})
 		return err
 	}
-	return context.JSON(products)
+	products := make([]*Product, len(page.Data))
+	for i := range page.Data {
+		products[i] = &page.Data[i]
+	}
+	if err := r.preloadProducts(context, products); err != nil {
+		return err
+	}
+	return context.JSON(page)
 }
 
 // Get all Products Titles
@@ -516,9 +555,12 @@ func (r *Repository) DeleteAccount(context *fiber.Ctx) error {
 			&fiber.Map{"message": "User not found"})
 		return err
 	}
-	err = r.DB.Table("account").
-		Where("username = ?", username).
-		Delete(&Account{}).Error
+	err = r.DB.Model(&existingAccount).Association("Roles").Clear().Error
+	if err == nil {
+		err = r.DB.Table("account").
+			Where("username = ?", username).
+			Delete(&Account{}).Error
+	}
 	if err != nil {
 		context.Status(http.StatusInternalServerError).JSON(
 			&fiber.Map{"message": "Failed to delete user account"})
@@ -557,71 +599,149 @@ func (r *Repository) DeleteProduct(context *fiber.Ctx) error {
 	return nil
 }
 
-// add product to cart
-func (r *Repository) AddToCart(ctx *fiber.Ctx) error {
-	item := CartItem{}
-	if err := ctx.BodyParser(&item); err != nil {
-		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
-			"message": "Request failed",
-		})
-		return err
-	}
-
-	// r.CartMap[item.ProductID] += item.Quantity
-	// ctx.Status(http.StatusOK).JSON(&fiber.Map{
-	// 	"message": "Product added to cart successfully",
-	// 	"data":    r.CartMap,
-	// })
-	return nil
-}
-
-// remove product from the cart
-func (r *Repository) RemoveFromCart(ctx *fiber.Ctx) error {
-	productIDStr := ctx.Params("product_id")
-	productID, err := strconv.ParseUint(productIDStr, 10, 64)
-	if err != nil {
-		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
-			"message": "Invalid product ID",
-		})
-		return err
-	}
-	delete(r.CartMap, uint(productID))
-	ctx.Status(http.StatusOK).JSON(&fiber.Map{
-		"message": "Product removed from cart successfully",
-		"data":    r.CartMap,
-	})
-	return nil
-}
-
 // kafgjasfcb
 // Routes
 func (r *Repository) SetupRoutes(app *fiber.App) {
 	api := app.Group("/api")
+	api.Use(r.Idempotency)
+	// Prices in ?currency= or X-Currency instead of the store currency
+	api.Use(r.SelectCurrency)
 	// Log In / email/pass
 	api.Post("/login", r.Login)
+	api.Post("/token/refresh", r.RefreshSession)
+	api.Post("/logout", r.Logout)
 	// Create & Add
 	api.Post("/create/account", r.CreateAccount)
-	// api.Post("/add/product", r.AddProduct)
-	// api.Post("/submit/purchase", r.SubmitPurchase)
+	api.Post("/checkout", r.RequireAuth, r.Checkout)
+	// Orders
+	orders := api.Group("/orders", r.RequireAuth)
+	orders.Get("/", r.GetMyOrders)
+	orders.Get("/:id", r.GetOrder)
+	orders.Get("/:id/history", r.GetOrderHistory)
+	orders.Post("/:id/cancel", r.CancelOrder)
+	orders.Post("/:id/transition", r.RequirePermission("orders:manage"), r.TransitionOrder)
+	orders.Post("/:id/pay", r.PayOrder)
+	orders.Post("/:id/refund", r.RequirePermission("orders:manage"), r.RefundOrder)
+	api.Post("/payments/webhook", r.PaymentWebhook)
 	// Update
 	// api.Put("/update/account", r.UpdateAccount)
 
 	// api.Put("/update/password", r.UpdatePassword)
-	// api.Put("/update/user", r.UpdateUser)
-	// api.Put("/update/product/by/title", r.UpdateProductByTitle)
+	api.Put("/update/user", r.RequireAuth, r.RequirePermission("accounts:update"), r.UpdateUser)
+	api.Put("/update/product/by/title", r.RequireAuth, r.RequirePermission("products:write"), r.UpdateProductByTitle)
 	// Get
 	// api.Get("/get/user/data", r.GetUserData)
 	// api.Get("/get/userdata", r.GetUserData2)
 	// api.Get("/get/all/accounts", r.GetAllAccounts)
 	// api.Get("/get/all/usernames", r.GetAllUsernames)
 	api.Get("/get/all/products", r.GetAllProducts)
+	// Products
+	products := api.Group("/products")
+	products.Get("/", r.GetAllProducts)
+	products.Get("/search", r.SearchProducts)
+	products.Get("/:id", r.GetProduct)
+	products.Post("/", r.RequireAuth, r.RequirePermission("products:write"), r.CreateProduct)
+	products.Put("/:id", r.RequireAuth, r.RequirePermission("products:write"), r.ReplaceProduct)
+	products.Patch("/:id", r.RequireAuth, r.RequirePermission("products:write"), r.PatchProduct)
+	products.Delete("/:id", r.RequireAuth, r.RequirePermission("products:delete"), r.DeleteProductByID)
+	products.Get("/:id/variants", r.GetProductVariants)
+	products.Put("/:id/options", r.RequireAuth, r.RequirePermission("products:write"), r.SetProductOptions)
+	products.Post("/:id/variants", r.RequireAuth, r.RequirePermission("products:write"), r.CreateProductVariant)
+	products.Patch("/:id/variants/:variant_id", r.RequireAuth, r.RequirePermission("products:write"), r.UpdateProductVariant)
+	products.Delete("/:id/variants/:variant_id", r.RequireAuth, r.RequirePermission("products:write"), r.DeleteProductVariant)
+	products.Post("/:id/images", r.RequireAuth, r.RequirePermission("products:write"), r.UploadProductImage)
+	products.Put("/:id/images/order", r.RequireAuth, r.RequirePermission("products:write"), r.ReorderProductImages)
+	products.Delete("/:id/images/:image_id", r.RequireAuth, r.RequirePermission("products:write"), r.DeleteProductImage)
+	products.Get("/:id/prices", r.RequireAuth, r.RequirePermission("products:write"), r.GetProductPrices)
+	products.Put("/:id/prices", r.RequireAuth, r.RequirePermission("products:write"), r.SetProductPrices)
+	products.Get("/:id/reviews", r.GetProductReviews)
+	products.Post("/:id/reviews", r.RequireAuth, r.CreateReview)
+	// Reviews
+	reviews := api.Group("/reviews")
+	reviews.Get("/", r.RequireAuth, r.RequirePermission("reviews:moderate"), r.GetReviewsForModeration)
+	reviews.Patch("/:id", r.RequireAuth, r.UpdateReview)
+	reviews.Delete("/:id", r.RequireAuth, r.DeleteReview)
+	reviews.Post("/:id/helpful", r.RequireAuth, r.VoteReviewHelpful)
+	reviews.Delete("/:id/helpful", r.RequireAuth, r.UnvoteReviewHelpful)
+	reviews.Put("/:id/moderation", r.RequireAuth, r.RequirePermission("reviews:moderate"), r.ModerateReview)
+	// Categories
+	categories := api.Group("/categories")
+	categories.Get("/", r.GetCategoryTree)
+	categories.Get("/:id", r.GetCategory)
+	categories.Post("/", r.RequireAuth, r.RequirePermission("categories:manage"), r.CreateCategory)
+	categories.Patch("/:id", r.RequireAuth, r.RequirePermission("categories:manage"), r.UpdateCategory)
+	categories.Post("/:id/move", r.RequireAuth, r.RequirePermission("categories:manage"), r.MoveCategory)
+	categories.Delete("/:id", r.RequireAuth, r.RequirePermission("categories:manage"), r.DeleteCategory)
 	// api.Get("/get/all/product/titles", r.GetAllProductTitles)
 	// api.Get("/get/selected/columns/from/account", r.GetSelectedColumnsFromAccount)
 	//Delete
-	// api.Delete("/delete/account", r.DeleteAccount)
-	// api.Delete("/delete/product", r.DeleteProduct)
-	api.Post("/add/to/cart", r.AddToCart)
-	api.Post("/remove/from/cart/product/id", r.RemoveFromCart)
+	api.Delete("/delete/account", r.RequireAuth, r.RequirePermission("accounts:delete"), r.DeleteAccount)
+	api.Delete("/delete/product", r.RequireAuth, r.RequirePermission("products:delete"), r.DeleteProduct)
+	// Admin
+	admin := api.Group("/admin", r.RequireAuth, r.RequirePermission("roles:manage"))
+	admin.Get("/accounts/:id/roles", r.GetAccountRoles)
+	admin.Post("/accounts/:id/roles", r.GrantRole)
+	admin.Delete("/accounts/:id/roles/:role", r.RevokeRole)
+	// Cart
+	api.Post("/add/to/cart", r.OptionalAuth, r.AddToCart)
+	api.Post("/remove/from/cart/product/:product_id", r.OptionalAuth, r.RemoveFromCart)
+	cart := api.Group("/cart", r.OptionalAuth)
+	cart.Get("/", r.GetCart)
+	cart.Post("/items", r.AddToCart)
+	cart.Put("/items/:product_id", r.UpdateCartItem)
+	cart.Delete("/items/:product_id", r.RemoveFromCart)
+	cart.Delete("/", r.ClearCart)
+	cart.Get("/shipping-rates", r.GetShippingRates)
+	cart.Post("/coupons", r.ApplyCoupon)
+	cart.Delete("/coupons/:code", r.RemoveCoupon)
+	cart.Post("/items/:product_id/save", r.RequireAuth, r.SaveCartItemForLater)
+
+	wishlists := api.Group("/wishlists")
+	wishlists.Get("/shared/:token", r.GetSharedWishlist)
+	wishlists.Get("/", r.RequireAuth, r.GetWishlists)
+	wishlists.Post("/", r.RequireAuth, r.CreateWishlist)
+	wishlists.Get("/:id", r.RequireAuth, r.GetWishlist)
+	wishlists.Patch("/:id", r.RequireAuth, r.UpdateWishlist)
+	wishlists.Delete("/:id", r.RequireAuth, r.DeleteWishlist)
+	wishlists.Post("/:id/items", r.RequireAuth, r.AddWishlistItem)
+	wishlists.Delete("/:id/items/:item_id", r.RequireAuth, r.RemoveWishlistItem)
+	wishlists.Post("/:id/items/:item_id/move-to-cart", r.RequireAuth, r.MoveWishlistItemToCart)
+	wishlists.Post("/:id/share", r.RequireAuth, r.ShareWishlist)
+	wishlists.Delete("/:id/share", r.RequireAuth, r.UnshareWishlist)
+	// Shipping
+	shipping := api.Group("/shipping", r.RequireAuth, r.RequirePermission("shipping:manage"))
+	shipping.Get("/zones", r.GetShippingZones)
+	shipping.Post("/zones", r.CreateShippingZone)
+	shipping.Patch("/zones/:id", r.UpdateShippingZone)
+	shipping.Delete("/zones/:id", r.DeleteShippingZone)
+	shipping.Post("/zones/:id/methods", r.CreateShippingMethod)
+	shipping.Patch("/methods/:id", r.UpdateShippingMethod)
+	shipping.Delete("/methods/:id", r.DeleteShippingMethod)
+	// Inventory
+	inventory := api.Group("/inventory", r.RequireAuth, r.RequirePermission("inventory:manage"))
+	inventory.Get("/locations", r.GetStockLocations)
+	inventory.Post("/locations", r.CreateStockLocation)
+	inventory.Patch("/locations/:id", r.UpdateStockLocation)
+	inventory.Get("/locations/:id/stock", r.GetLocationStock)
+	inventory.Get("/movements", r.GetStockMovements)
+	inventory.Post("/movements", r.CreateStockMovement)
+	inventory.Post("/transfers", r.CreateStockTransfer)
+	inventory.Get("/reconciliation", r.GetStockReconciliation)
+	inventory.Get("/thresholds", r.GetReorderThresholds)
+	inventory.Put("/thresholds", r.SetReorderThreshold)
+	inventory.Delete("/thresholds/:id", r.DeleteReorderThreshold)
+	inventory.Get("/alerts", r.GetStockAlerts)
+	inventory.Post("/alerts/check", r.CheckStockAlerts)
+	inventory.Get("/reorder-suggestions", r.GetReorderSuggestions)
+	// Promotions
+	promotions := api.Group("/promotions", r.RequireAuth, r.RequirePermission("promotions:manage"))
+	promotions.Get("/", r.GetPromotions)
+	promotions.Get("/:id", r.GetPromotion)
+	promotions.Post("/", r.CreatePromotion)
+	promotions.Patch("/:id", r.UpdatePromotion)
+	promotions.Delete("/:id", r.DeletePromotion)
+	// Media served from the local blob store
+	app.Get("/media/*", r.ServeMedia)
 }
 
 // .env
@@ -642,17 +762,171 @@ func main() {
 	if err != nil {
 		log.Fatal("Could not load the database")
 	}
+	currency := os.Getenv("STORE_CURRENCY")
+	if currency == "" {
+		currency = "USD"
+	}
+	if !money.Valid(currency) {
+		log.Fatalf("STORE_CURRENCY %q is not a supported currency", currency)
+	}
 	// Auto-migrate your database tables here
 	db.AutoMigrate(
 		&Account{},
-		&Product{},
 		&Order{},
-		&CartItem{},
+		&OrderLine{},
+		&OrderHistory{},
+		&PaymentIntent{},
+		&WebhookEvent{},
+		&IdempotencyKey{},
+		&RefreshToken{},
+		&Role{},
+		&Permission{},
+		&ProductImage{},
 	)
+	if err := MigratePayments(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateProducts(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateVariants(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateMoney(db, currency); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigratePricing(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigratePromotions(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateTaxes(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateShipping(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateReservations(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateStock(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateStockAlerts(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateReviews(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateWishlists(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateCategories(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateProductSearch(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.MigratesCart(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := SeedRoles(db); err != nil {
+		log.Fatal(err)
+	}
+	// Bootstrap the first administrator
+	if username := os.Getenv("ADMIN_USERNAME"); username != "" {
+		var admin Account
+		if err := db.Where("username = ?", username).First(&admin).Error; err == nil {
+			if err := grantRole(db, admin.ID, RoleAdmin); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	hasher, err := NewPasswordHasher(os.Getenv("PASSWORD_HASHER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokens, err := newTokenIssuer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cartMerge, err := ParseCartMergeStrategy(os.Getenv("CART_MERGE_STRATEGY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	payments, err := newPaymentProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rates, err := newExchangeRateProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	taxes, err := newTaxCalculator()
+	if err != nil {
+		log.Fatal(err)
+	}
+	carrier, err := newCarrierRateProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	blobs, err := newBlobStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxUpload := int64(10 << 20)
+	if value := os.Getenv("MEDIA_MAX_UPLOAD_BYTES"); value != "" {
+		maxUpload, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxUpload <= 0 {
+			log.Fatal("MEDIA_MAX_UPLOAD_BYTES must be a positive number of bytes")
+		}
+	}
+	holdTTL, err := reservationTTL()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stockAlerts, err := stockAlertConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	notifier, err := newStaffNotifier()
+	if err != nil {
+		log.Fatal(err)
+	}
+	customers, err := newCustomerNotifier()
+	if err != nil {
+		log.Fatal(err)
+	}
+	wishlistWatch, err := wishlistWatchInterval()
+	if err != nil {
+		log.Fatal(err)
+	}
 	r := Repository{
-		DB: db,
+		DB:            db,
+		Hasher:        hasher,
+		Tokens:        tokens,
+		CartMerge:     cartMerge,
+		Payments:      payments,
+		Currency:      currency,
+		Rates:         rates,
+		Tax:           taxes,
+		Carrier:       carrier,
+		Blobs:         blobs,
+		MaxUploadSize: maxUpload,
+		HoldTTL:       holdTTL,
+		StockAlerts:   stockAlerts,
+		Notifier:      notifier,
+		Customers:     customers,
+		WishlistWatch: wishlistWatch,
 	}
-	app := fiber.New()
+	go runReservationSweeper(db, time.Minute)
+	go r.runStockAlertJob()
+	go r.runWishlistWatch()
+	// Leave room for the multipart envelope around the largest upload
+	app := fiber.New(fiber.Config{BodyLimit: int(maxUpload) + 1<<20})
+	// A panicking handler answers 500 instead of taking the server down
+	app.Use(recover.New())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
 	}))
@@ -0,0 +1,20 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist in a store
+var ErrNotFound = errors.New("media: object not found")
+
+// BlobStore stores uploaded files and the thumbnails made from them
+type BlobStore interface {
+	Put(ctx context.Context, key, contentType string, body io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL that allows reading key until ttl has passed
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
@@ -0,0 +1,120 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+
+	// Register decoders for the accepted upload types
+	_ "image/gif"
+	_ "image/png"
+)
+
+// maxPixels refuses images whose header claims more pixels than this, so a
+// small compressed file cannot expand into gigabytes when decoded
+const maxPixels = 40_000_000
+
+// ThumbnailWidths are the widths generated for every upload
+var ThumbnailWidths = []int{150, 400, 800}
+
+var (
+	ErrUnsupportedType = errors.New("media: unsupported image type")
+	ErrImageTooLarge   = errors.New("media: image dimensions too large")
+)
+
+// allowedTypes maps sniffed content types to file extensions
+var allowedTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Sniff detects the content type of data from its first bytes, ignoring
+// whatever the client claimed, and returns it with a file extension
+func Sniff(data []byte) (string, string, error) {
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedTypes[contentType]
+	if !ok {
+		return "", "", fmt.Errorf("%w: %s", ErrUnsupportedType, contentType)
+	}
+	return contentType, ext, nil
+}
+
+// Decode checks the image dimensions before decoding the whole image
+func Decode(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// Thumbnail scales img down to width, keeping the aspect ratio, and
+// encodes it as JPEG. Images narrower than width are not enlarged.
+func Thumbnail(img image.Image, width int) ([]byte, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() < width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	// Flatten transparency onto white since JPEG has no alpha channel
+	src := image.NewRGBA(bounds)
+	draw.Draw(src, bounds, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(src, bounds, img, bounds.Min, draw.Over)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	scaleBox(dst, src)
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// scaleBox downsamples by averaging the source pixels under each
+// destination pixel
+func scaleBox(dst, src *image.RGBA) {
+	sb, db := src.Bounds(), dst.Bounds()
+	for y := 0; y < db.Dy(); y++ {
+		y0 := sb.Min.Y + y*sb.Dy()/db.Dy()
+		y1 := sb.Min.Y + (y+1)*sb.Dy()/db.Dy()
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < db.Dx(); x++ {
+			x0 := sb.Min.X + x*sb.Dx()/db.Dx()
+			x1 := sb.Min.X + (x+1)*sb.Dx()/db.Dx()
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					offset := src.PixOffset(sx, sy)
+					r += uint32(src.Pix[offset])
+					g += uint32(src.Pix[offset+1])
+					b += uint32(src.Pix[offset+2])
+					a += uint32(src.Pix[offset+3])
+					n++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+}
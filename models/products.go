@@ -1,6 +1,10 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
 
 type Account struct {
 	Fullname         *string `json:"fullname"`
@@ -15,29 +19,45 @@ type LoginRequest struct {
 }
 
 func MigratesAccount(db *gorm.DB) error {
-	err := db.AutoMigrate(&Account{})
+	err := db.AutoMigrate(&Account{}).Error
 	return err
 }
 func MigratesCartItem(db *gorm.DB) error {
-	err := db.AutoMigrate(&CartItem{})
+	err := db.AutoMigrate(&CartItem{}).Error
 	return err
 }
 
-type Cart struct {
-	gorm.Model
-	UserID uint
-	Items  []CartItem
-	Total  float64 // You can add a total price for the cart if needed.
+// MigratesCart creates the cart tables. A user or guest has at most one
+// cart and a product variant appears at most once per cart.
+func MigratesCart(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Cart{}, &CartItem{}).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&Cart{}).AddUniqueIndex("idx_carts_user_id", "user_id").Error; err != nil {
+		return err
+	}
+	if err := db.Model(&Cart{}).AddUniqueIndex("idx_carts_guest_token", "guest_token").Error; err != nil {
+		return err
+	}
+	// Lines used to be unique per product; they are now unique per variant
+	if err := db.Exec("DROP INDEX IF EXISTS idx_cart_items_cart_product").Error; err != nil {
+		return err
+	}
+	return db.Model(&CartItem{}).AddUniqueIndex("idx_cart_items_cart_variant", "cart_id", "product_id", "variant_id").Error
 }
-type Products struct {
+
+type Cart struct {
 	gorm.Model
-	Name     string
-	Price    float64
-	CartItem CartItem // Add this field to establish a relationship with cart items.
+	UserID     *uint
+	GuestToken *string // set instead of UserID for carts of visitors who have not logged in
+	Items      []CartItem
+	Total      money.Money `gorm:"-"` // computed from the items when the cart is read
 }
 type CartItem struct {
 	gorm.Model
+	CartID    uint `gorm:"index"`
 	ProductID uint
+	VariantID uint `gorm:"not null;default:0"` // 0 for products without variants
 	Quantity  int
 }
 
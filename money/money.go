@@ -0,0 +1,330 @@
+// Package money represents amounts exactly, as an integer count of the
+// currency's minor unit (cents for USD, yen for JPY).
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrUnknownCurrency  = errors.New("money: unknown currency")
+	ErrInvalidAmount    = errors.New("money: invalid amount")
+	ErrTooPrecise       = errors.New("money: amount has more decimals than the currency allows")
+	ErrCurrencyMismatch = errors.New("money: currencies differ")
+)
+
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// exponents lists the number of minor-unit digits of supported ISO 4217
+// currencies. Currencies not listed are rejected.
+var exponents = map[string]int{
+	"AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CNY": 2, "CZK": 2,
+	"DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2,
+	"INR": 2, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2,
+	"NOK": 2, "NZD": 2, "OMR": 3, "PHP": 2, "PLN": 2, "SAR": 2, "SEK": 2,
+	"SGD": 2, "THB": 2, "TND": 3, "TRY": 2, "TWD": 2, "USD": 2, "VND": 0,
+	"ZAR": 2,
+}
+
+// Exponent returns the number of decimal places of currency
+func Exponent(currency string) (int, error) {
+	exponent, ok := exponents[strings.ToUpper(currency)]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	return exponent, nil
+}
+
+// Valid reports whether currency is a supported ISO 4217 code
+func Valid(currency string) bool {
+	_, err := Exponent(currency)
+	return err == nil
+}
+
+// Money is an amount in minor units of Currency. It is stored as two
+// columns, <prefix>amount (bigint) and <prefix>currency, and encoded in JSON
+// as {"amount": "12.34", "currency": "USD"} so clients never see a float.
+type Money struct {
+	Amount   int64  `gorm:"type:bigint;not null;default:0"`
+	Currency string `gorm:"type:char(3)"`
+}
+
+// New returns minor units of currency
+func New(minor int64, currency string) Money {
+	return Money{Amount: minor, Currency: strings.ToUpper(currency)}
+}
+
+// Zero returns a zero amount of currency
+func Zero(currency string) Money {
+	return New(0, currency)
+}
+
+// Parse reads a decimal such as "12.34" or "-0.5" in currency. Amounts
+// with more decimals than the currency allows are rejected rather than
+// rounded.
+func Parse(text, currency string) (Money, error) {
+	exponent, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	text = strings.TrimSpace(text)
+	if !decimalPattern.MatchString(text) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, text)
+	}
+	rat, _ := new(big.Rat).SetString(text)
+	rat.Mul(rat, new(big.Rat).SetInt(pow10(exponent)))
+	if !rat.IsInt() {
+		return Money{}, fmt.Errorf("%w: %q", ErrTooPrecise, text)
+	}
+	if !rat.Num().IsInt64() {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, text)
+	}
+	return New(rat.Num().Int64(), currency), nil
+}
+
+// Decimal formats the amount with the currency's number of decimals
+func (m Money) Decimal() string {
+	exponent, err := Exponent(m.Currency)
+	if err != nil || exponent == 0 {
+		return fmt.Sprintf("%d", m.Amount)
+	}
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	unit := pow10(exponent).Int64()
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exponent, amount%unit)
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func (m Money) IsZero() bool     { return m.Amount == 0 }
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+
+// SameCurrency reports whether m and other can be added or compared
+func (m Money) SameCurrency(other Money) bool {
+	return m.Currency == other.Currency
+}
+
+func (m Money) mustMatch(other Money) {
+	if !m.SameCurrency(other) {
+		panic(fmt.Sprintf("%v: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency))
+	}
+}
+
+// Add returns m + other. Both must be in the same currency; mixing
+// currencies is a programming error and panics.
+func (m Money) Add(other Money) Money {
+	m.mustMatch(other)
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}
+}
+
+// Sub returns m - other in the same currency
+func (m Money) Sub(other Money) Money {
+	m.mustMatch(other)
+	return Money{Amount: m.Amount - other.Amount, Currency: m.Currency}
+}
+
+// Cmp compares two amounts of the same currency
+func (m Money) Cmp(other Money) int {
+	m.mustMatch(other)
+	switch {
+	case m.Amount < other.Amount:
+		return -1
+	case m.Amount > other.Amount:
+		return 1
+	}
+	return 0
+}
+
+// Times multiplies by a whole quantity
+func (m Money) Times(quantity int) Money {
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.Currency}
+}
+
+// Neg returns -m
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Mul multiplies by an exact ratio and rounds half to even to a whole minor
+// unit. Use it for tax, discount and conversion math.
+func (m Money) Mul(ratio *big.Rat) Money {
+	product := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Amount), ratio)
+	return Money{Amount: RoundHalfEven(product), Currency: m.Currency}
+}
+
+// Percent returns rate percent of m, rounded half to even. rate is a
+// decimal string such as "20" or "7.25".
+func (m Money) Percent(rate string) (Money, error) {
+	ratio, ok := new(big.Rat).SetString(rate)
+	if !ok {
+		return Money{}, fmt.Errorf("%w: rate %q", ErrInvalidAmount, rate)
+	}
+	return m.Mul(ratio.Quo(ratio, big.NewRat(100, 1))), nil
+}
+
+// Allocate splits m in proportion to weights so the parts add up to m
+// exactly. Remainders go one minor unit at a time to the parts with the
+// largest fractional share, earliest first.
+func (m Money) Allocate(weights []int64) []Money {
+	parts := make([]Money, len(weights))
+	var total int64
+	for i, weight := range weights {
+		total += weight
+		parts[i] = Zero(m.Currency)
+	}
+	if total == 0 {
+		return parts
+	}
+	type share struct {
+		index     int
+		remainder *big.Int
+	}
+	shares := make([]share, len(weights))
+	allocated := int64(0)
+	for i, weight := range weights {
+		numerator := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(weight))
+		quotient, remainder := new(big.Int).QuoRem(numerator, big.NewInt(total), new(big.Int))
+		parts[i].Amount = quotient.Int64()
+		allocated += parts[i].Amount
+		shares[i] = share{i, remainder.Abs(remainder)}
+	}
+	left := m.Amount - allocated
+	step := int64(1)
+	if left < 0 {
+		step, left = -1, -left
+	}
+	// Stable order: biggest remainder first, then position
+	for n := int64(0); n < left; n++ {
+		best := -1
+		for i, s := range shares {
+			if s.remainder == nil {
+				continue
+			}
+			if best < 0 || s.remainder.Cmp(shares[best].remainder) > 0 {
+				best = i
+			}
+		}
+		parts[shares[best].index].Amount += step
+		shares[best].remainder = nil
+	}
+	return parts
+}
+
+// RoundHalfEven rounds an exact ratio to the nearest integer, ties to even
+func RoundHalfEven(value *big.Rat) int64 {
+	quotient, remainder := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	// Compare twice the remainder with the denominator
+	twice := new(big.Int).Abs(remainder)
+	twice.Lsh(twice, 1)
+	switch twice.Cmp(value.Denom()) {
+	case 1:
+		quotient.Add(quotient, big.NewInt(int64(value.Sign())))
+	case 0:
+		if quotient.Bit(0) == 1 {
+			quotient.Add(quotient, big.NewInt(int64(value.Sign())))
+		}
+	}
+	return quotient.Int64()
+}
+
+func pow10(exponent int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+}
+
+type jsonMoney struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMoney{Amount: m.Decimal(), Currency: m.Currency})
+}
+
+// UnmarshalJSON reads {"amount": "12.34", "currency": "USD"}
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var input Input
+	if err := json.Unmarshal(data, &input); err != nil {
+		return err
+	}
+	if input.Currency == "" {
+		return fmt.Errorf("%w: missing currency", ErrInvalidAmount)
+	}
+	parsed, err := input.In("")
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Input is an amount sent by a client: {"amount": "12.34", "currency":
+// "USD"}, or a bare "12.34" or 12.34 when the currency is implied. Numbers
+// are read from their JSON text, never through a float64.
+type Input struct {
+	Amount   string
+	Currency string
+}
+
+func (in *Input) UnmarshalJSON(data []byte) error {
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "{") {
+		var object struct {
+			Amount   json.RawMessage `json:"amount"`
+			Currency string          `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+		text = strings.TrimSpace(string(object.Amount))
+		in.Currency = strings.ToUpper(object.Currency)
+	}
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal([]byte(text), &text); err != nil {
+			return err
+		}
+	}
+	if text == "" || text == "null" {
+		return fmt.Errorf("%w: missing amount", ErrInvalidAmount)
+	}
+	in.Amount = text
+	return nil
+}
+
+// In parses the input, using currency when the client did not name one
+func (in Input) In(currency string) (Money, error) {
+	if in.Currency != "" {
+		currency = in.Currency
+	}
+	return Parse(in.Amount, currency)
+}
+
+// Convert changes m into currency using rate, the number of units of
+// currency per unit of m's currency. The result is rounded half to even to
+// a whole minor unit of currency.
+func (m Money) Convert(currency string, rate *big.Rat) (Money, error) {
+	from, err := Exponent(m.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	to, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	// minor_to = minor_from * rate * 10^(to - from)
+	scaled := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Amount), rate)
+	if to >= from {
+		scaled.Mul(scaled, new(big.Rat).SetInt(pow10(to-from)))
+	} else {
+		scaled.Quo(scaled, new(big.Rat).SetInt(pow10(from-to)))
+	}
+	return Money{Amount: RoundHalfEven(scaled), Currency: strings.ToUpper(currency)}, nil
+}
@@ -0,0 +1,153 @@
+package money
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text, currency string
+		want           int64
+		err            error
+	}{
+		{"19.99", "USD", 1999, nil},
+		{"0.1", "USD", 10, nil},
+		{"-0.5", "usd", -50, nil},
+		{"1500", "JPY", 1500, nil},
+		{"1.234", "BHD", 1234, nil},
+		{"1.005", "USD", 0, ErrTooPrecise},
+		{"1.5", "JPY", 0, ErrTooPrecise},
+		{"1e3", "USD", 0, ErrInvalidAmount},
+		{"", "USD", 0, ErrInvalidAmount},
+		{"1", "XXX", 0, ErrUnknownCurrency},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.text, test.currency)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("Parse(%q, %s) error = %v, want %v", test.text, test.currency, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got.Amount != test.want {
+			t.Errorf("Parse(%q, %s) = %d, %v, want %d", test.text, test.currency, got.Amount, err, test.want)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{New(1999, "USD"), "19.99"},
+		{New(-5, "USD"), "-0.05"},
+		{New(0, "EUR"), "0.00"},
+		{New(1500, "JPY"), "1500"},
+		{New(1234, "BHD"), "1.234"},
+	}
+	for _, test := range tests {
+		if got := test.money.Decimal(); got != test.want {
+			t.Errorf("%d %s Decimal() = %q, want %q", test.money.Amount, test.money.Currency, got, test.want)
+		}
+	}
+}
+
+func TestRoundHalfEven(t *testing.T) {
+	tests := []struct {
+		num, denom int64
+		want       int64
+	}{
+		{5, 2, 2},
+		{7, 2, 4},
+		{-5, 2, -2},
+		{-7, 2, -4},
+		{9, 4, 2},
+		{11, 4, 3},
+		{-11, 4, -3},
+		{6, 3, 2},
+	}
+	for _, test := range tests {
+		if got := RoundHalfEven(big.NewRat(test.num, test.denom)); got != test.want {
+			t.Errorf("RoundHalfEven(%d/%d) = %d, want %d", test.num, test.denom, got, test.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		amount int64
+		rate   string
+		want   int64
+	}{
+		{1999, "20", 400},
+		{1000, "7.25", 72},
+		{1000, "7.35", 74},
+		{1000, "0", 0},
+		{-1000, "12.5", -125},
+	}
+	for _, test := range tests {
+		got, err := New(test.amount, "USD").Percent(test.rate)
+		if err != nil || got.Amount != test.want {
+			t.Errorf("%d Percent(%s) = %d, %v, want %d", test.amount, test.rate, got.Amount, err, test.want)
+		}
+	}
+	if _, err := New(100, "USD").Percent("ten"); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("Percent(ten) error = %v, want %v", err, ErrInvalidAmount)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		amount  int64
+		weights []int64
+		want    []int64
+	}{
+		{100, []int64{1, 1, 1}, []int64{34, 33, 33}},
+		{-100, []int64{1, 1, 1}, []int64{-34, -33, -33}},
+		{1000, []int64{1, 3}, []int64{250, 750}},
+		{5, []int64{1, 2, 2}, []int64{1, 2, 2}},
+		{7, []int64{3, 2}, []int64{4, 3}},
+		{100, []int64{0, 0}, []int64{0, 0}},
+	}
+	for _, test := range tests {
+		parts := New(test.amount, "USD").Allocate(test.weights)
+		for i, part := range parts {
+			if part.Amount != test.want[i] || part.Currency != "USD" {
+				t.Errorf("Allocate(%d, %v)[%d] = %v, want %d", test.amount, test.weights, i, part, test.want[i])
+			}
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		from     Money
+		currency string
+		rate     *big.Rat
+		want     int64
+	}{
+		{New(1000, "USD"), "JPY", big.NewRat(150, 1), 1500},
+		{New(1500, "JPY"), "USD", big.NewRat(1, 150), 1000},
+		{New(1999, "USD"), "EUR", big.NewRat(9, 10), 1799},
+		{New(1000, "USD"), "BHD", big.NewRat(377, 1000), 3770},
+		{New(5, "USD"), "EUR", big.NewRat(1, 2), 2},
+	}
+	for _, test := range tests {
+		got, err := test.from.Convert(test.currency, test.rate)
+		if err != nil || got.Amount != test.want || got.Currency != test.currency {
+			t.Errorf("%v Convert(%s, %s) = %v, %v, want %d", test.from, test.currency, test.rate, got, err, test.want)
+		}
+	}
+}
+
+func TestArithmeticRejectsMixedCurrencies(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Add of USD and EUR did not panic")
+		}
+	}()
+	New(100, "USD").Add(New(100, "EUR"))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// StaffSignatureHeader carries the HMAC of staff webhook bodies
+const StaffSignatureHeader = "X-Staff-Signature"
+
+// Notification is a message for staff or a customer. Data is sent as-is
+// to webhooks.
+type Notification struct {
+	Kind    string      `json:"kind"`
+	Subject string      `json:"subject"`
+	Text    string      `json:"text"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// StaffNotifier delivers notifications to staff
+type StaffNotifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// CustomerNotifier delivers notifications to a customer's account
+type CustomerNotifier interface {
+	NotifyCustomer(ctx context.Context, account *Account, notification Notification) error
+}
+
+// LogNotifier writes notifications to the server log
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, notification Notification) error {
+	log.Printf("%s: %s\n%s", notification.Kind, notification.Subject, notification.Text)
+	return nil
+}
+
+func (LogNotifier) NotifyCustomer(ctx context.Context, account *Account, notification Notification) error {
+	log.Printf("%s for account %d: %s\n%s", notification.Kind, account.ID, notification.Subject, notification.Text)
+	return nil
+}
+
+// WebhookNotifier posts notifications as JSON. With a Secret the body is
+// signed with HMAC-SHA256 in StaffSignatureHeader.
+type WebhookNotifier struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.Secret) > 0 {
+		mac := hmac.New(sha256.New, n.Secret)
+		mac.Write(body)
+		req.Header.Set(StaffSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("staff webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// EmailNotifier sends notifications as plain text mail through an SMTP
+// server. Staff notifications go to To; customer ones to the account email.
+type EmailNotifier struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+	To   []string
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, notification Notification) error {
+	return n.send(n.To, notification)
+}
+
+func (n *EmailNotifier) NotifyCustomer(ctx context.Context, account *Account, notification Notification) error {
+	if account.Email == "" {
+		return nil
+	}
+	return n.send([]string{account.Email}, notification)
+}
+
+func (n *EmailNotifier) send(to []string, notification Notification) error {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", notification.Subject)
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(notification.Text, "\n", "\r\n"))
+	return smtp.SendMail(n.Addr, n.Auth, n.From, to, message.Bytes())
+}
+
+// smtpNotifier builds an EmailNotifier from SMTP_ADDR, SMTP_FROM,
+// SMTP_USERNAME and SMTP_PASSWORD
+func smtpNotifier(to []string) (*EmailNotifier, error) {
+	addr, from := os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_FROM")
+	if addr == "" || from == "" {
+		return nil, fmt.Errorf("SMTP_ADDR and SMTP_FROM are required for email notifications")
+	}
+	notifier := &EmailNotifier{Addr: addr, From: from, To: to}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		host := strings.Split(addr, ":")[0]
+		notifier.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return notifier, nil
+}
+
+// multiNotifier delivers to every notifier, returning the first error
+type multiNotifier []StaffNotifier
+
+func (m multiNotifier) Notify(ctx context.Context, notification Notification) error {
+	var first error
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, notification); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// newStaffNotifier reads STAFF_NOTIFY, a comma separated list of "log"
+// (default), "webhook" (STAFF_WEBHOOK_URL, STAFF_WEBHOOK_SECRET) and "email"
+// (SMTP_ADDR, SMTP_USERNAME, SMTP_PASSWORD, SMTP_FROM, STAFF_EMAILS)
+func newStaffNotifier() (StaffNotifier, error) {
+	names := os.Getenv("STAFF_NOTIFY")
+	if names == "" {
+		names = "log"
+	}
+	var notifiers multiNotifier
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "log":
+			notifiers = append(notifiers, LogNotifier{})
+		case "webhook":
+			url := os.Getenv("STAFF_WEBHOOK_URL")
+			if url == "" {
+				return nil, fmt.Errorf("STAFF_WEBHOOK_URL is required for webhook notifications")
+			}
+			notifiers = append(notifiers, &WebhookNotifier{
+				URL:    url,
+				Secret: []byte(os.Getenv("STAFF_WEBHOOK_SECRET")),
+				Client: &http.Client{Timeout: 10 * time.Second},
+			})
+		case "email":
+			var to []string
+			for _, address := range strings.Split(os.Getenv("STAFF_EMAILS"), ",") {
+				if address = strings.TrimSpace(address); address != "" {
+					to = append(to, address)
+				}
+			}
+			if len(to) == 0 {
+				return nil, fmt.Errorf("STAFF_EMAILS is required for email notifications")
+			}
+			notifier, err := smtpNotifier(to)
+			if err != nil {
+				return nil, err
+			}
+			notifiers = append(notifiers, notifier)
+		default:
+			return nil, fmt.Errorf("unknown staff notifier %q", name)
+		}
+	}
+	if len(notifiers) == 1 {
+		return notifiers[0], nil
+	}
+	return notifiers, nil
+}
+
+// newCustomerNotifier reads CUSTOMER_NOTIFY: "log" (default) or "email",
+// which uses the same SMTP settings as staff email
+func newCustomerNotifier() (CustomerNotifier, error) {
+	switch name := os.Getenv("CUSTOMER_NOTIFY"); name {
+	case "", "log":
+		return LogNotifier{}, nil
+	case "email":
+		return smtpNotifier(nil)
+	default:
+		return nil, fmt.Errorf("unknown customer notifier %q", name)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+// Order statuses
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderPacked    = "packed"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+// orderTransitions lists the statuses an order may move to from each status
+var orderTransitions = map[string][]string{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderPacked, OrderRefunded},
+	OrderPacked:    {OrderShipped, OrderRefunded},
+	OrderShipped:   {OrderDelivered},
+	OrderDelivered: {OrderRefunded},
+}
+
+var errIllegalTransition = errors.New("illegal order status transition")
+
+// Struct OrderHistory
+// One row per status change. FromStatus is empty for the row written when
+// the order is placed.
+type OrderHistory struct {
+	ID         uint      `json:"id" gorm:"primary_key"`
+	OrderID    uint      `json:"order_id" gorm:"index;not null"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status" gorm:"not null"`
+	AccountID  *uint     `json:"account_id"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Struct TransitionRequest
+type TransitionRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionOrder moves an order to a new status and records who did it.
+// actorID is nil for changes made by the system, such as payment webhooks.
+func transitionOrder(tx *gorm.DB, orderID uint, to string, actorID *uint, reason string) (*Order, error) {
+	order := &Order{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("id = ?", orderID).
+		First(order).Error
+	if err != nil {
+		return nil, err
+	}
+	if !canTransition(order.Status, to) {
+		return nil, errIllegalTransition
+	}
+	history := OrderHistory{
+		OrderID:    order.ID,
+		FromStatus: order.Status,
+		ToStatus:   to,
+		AccountID:  actorID,
+		Reason:     reason,
+	}
+	if err := tx.Model(order).Update("status", to).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&history).Error; err != nil {
+		return nil, err
+	}
+	switch to {
+	case OrderPaid:
+		err = commitHolds(tx, order.ID)
+	case OrderCancelled:
+		err = releaseHolds(tx, order.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// findOrderForCaller loads an order the caller may see: their own, or any
+// order for staff with the orders:manage permission
+func (r *Repository) findOrderForCaller(context *fiber.Ctx) (*Order, error) {
+	orderID, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	account := currentAccount(context)
+	order := &Order{}
+	if err := r.DB.Preload("Lines").Preload("Discounts").Where("id = ?", orderID).First(order).Error; err != nil {
+		return nil, err
+	}
+	if order.AccountID != account.ID {
+		staff, err := hasPermission(r.DB, account.ID, "orders:manage")
+		if err != nil {
+			return nil, err
+		}
+		if !staff {
+			return nil, gorm.ErrRecordNotFound
+		}
+	}
+	return order, nil
+}
+
+// respondTransitionError writes the response for errors from transitionOrder
+func respondTransitionError(context *fiber.Ctx, err error) error {
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Order not found"})
+		return nil
+	case errors.Is(err, errIllegalTransition):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Order cannot move to that status"})
+		return nil
+	case errors.Is(err, errInsufficientStock):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Not enough stock at the active locations to fulfil the order"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to update order"})
+	return err
+}
+
+// List the caller's orders
+func (r *Repository) GetMyOrders(context *fiber.Ctx) error {
+	var orders []Order
+	err := r.DB.Preload("Lines").Preload("Discounts").
+		Where("account_id = ?", currentAccount(context).ID).
+		Order("created_at DESC").
+		Find(&orders).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve orders"})
+		return err
+	}
+	return context.JSON(orders)
+}
+
+// Get one order
+func (r *Repository) GetOrder(context *fiber.Ctx) error {
+	order, err := r.findOrderForCaller(context)
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Order not found"})
+		return nil
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve order"})
+		return err
+	}
+	return context.JSON(order)
+}
+
+// Get the status timeline of an order
+func (r *Repository) GetOrderHistory(context *fiber.Ctx) error {
+	order, err := r.findOrderForCaller(context)
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Order not found"})
+		return nil
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve order"})
+		return err
+	}
+	var history []OrderHistory
+	err = r.DB.Where("order_id = ?", order.ID).Order("created_at, id").Find(&history).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve order history"})
+		return err
+	}
+	return context.JSON(history)
+}
+
+// Cancel one of the caller's pending orders
+func (r *Repository) CancelOrder(context *fiber.Ctx) error {
+	order, err := r.findOrderForCaller(context)
+	if err != nil {
+		return respondTransitionError(context, err)
+	}
+	account := currentAccount(context)
+	if order.AccountID != account.ID {
+		return respondTransitionError(context, gorm.ErrRecordNotFound)
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		order, err = transitionOrder(tx, order.ID, OrderCancelled, &account.ID, "cancelled by customer")
+		return err
+	})
+	if err != nil {
+		return respondTransitionError(context, err)
+	}
+	return context.JSON(order)
+}
+
+// Move an order to another status (Staff)
+func (r *Repository) TransitionOrder(context *fiber.Ctx) error {
+	orderID, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		return respondTransitionError(context, gorm.ErrRecordNotFound)
+	}
+	request := TransitionRequest{}
+	if err := context.BodyParser(&request); err != nil || request.Status == "" {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	// Payments and refunds move money, so they go through PayOrder and
+	// RefundOrder rather than a bare status change
+	if request.Status == OrderPaid || request.Status == OrderRefunded {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Orders are marked " + request.Status + " by the payment flow"})
+		return nil
+	}
+	account := currentAccount(context)
+	var order *Order
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		order, err = transitionOrder(tx, uint(orderID), request.Status, &account.ID, request.Reason)
+		return err
+	})
+	if err != nil {
+		return respondTransitionError(context, err)
+	}
+	return context.JSON(order)
+}
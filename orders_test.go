@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{OrderPending, OrderPaid, true},
+		{OrderPending, OrderCancelled, true},
+		{OrderPending, OrderShipped, false},
+		{OrderPending, OrderRefunded, false},
+		{OrderPaid, OrderPacked, true},
+		{OrderPaid, OrderRefunded, true},
+		{OrderPaid, OrderCancelled, false},
+		{OrderPacked, OrderShipped, true},
+		{OrderPacked, OrderRefunded, true},
+		{OrderShipped, OrderDelivered, true},
+		{OrderShipped, OrderRefunded, false},
+		{OrderDelivered, OrderRefunded, true},
+		{OrderDelivered, OrderPending, false},
+		{OrderCancelled, OrderPending, false},
+		{OrderCancelled, OrderPaid, false},
+		{OrderRefunded, OrderPaid, false},
+		{OrderPaid, OrderPaid, false},
+		{"unknown", OrderPaid, false},
+	}
+	for _, test := range tests {
+		if got := canTransition(test.from, test.to); got != test.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+}
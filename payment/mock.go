@@ -0,0 +1,126 @@
+package payment
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// DeclinedSource is a payment source the mock provider always declines
+const DeclinedSource = "tok_declined"
+
+// MockProvider keeps payments in memory. It is used for local development
+// and backs the stand-in HTTP server.
+type MockProvider struct {
+	WebhookSecret []byte
+
+	mu       sync.Mutex
+	payments map[string]*Result
+	refunded map[string]int64
+}
+
+// NewMockProvider returns an empty in-process provider
+func NewMockProvider(webhookSecret []byte) *MockProvider {
+	return &MockProvider{
+		WebhookSecret: webhookSecret,
+		payments:      map[string]*Result{},
+		refunded:      map[string]int64{},
+	}
+}
+
+func (m *MockProvider) Name() string { return "mock" }
+
+func (m *MockProvider) Authorize(ctx context.Context, request AuthorizeRequest) (*Result, error) {
+	if request.Source == DeclinedSource {
+		return nil, ErrDeclined
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	payment := &Result{
+		ID:       "pay_" + randomID(),
+		Status:   StatusAuthorized,
+		Amount:   request.Amount,
+		Currency: request.Currency,
+	}
+	m.payments[payment.ID] = payment
+	copied := *payment
+	return &copied, nil
+}
+
+func (m *MockProvider) Capture(ctx context.Context, paymentID string, amount int64) (*Result, error) {
+	return m.update(paymentID, func(payment *Result) error {
+		if payment.Status != StatusAuthorized || amount > payment.Amount {
+			return ErrInvalidState
+		}
+		payment.Status = StatusCaptured
+		payment.Amount = amount
+		return nil
+	})
+}
+
+func (m *MockProvider) Void(ctx context.Context, paymentID string) (*Result, error) {
+	return m.update(paymentID, func(payment *Result) error {
+		if payment.Status != StatusAuthorized {
+			return ErrInvalidState
+		}
+		payment.Status = StatusVoided
+		return nil
+	})
+}
+
+func (m *MockProvider) Refund(ctx context.Context, paymentID string, amount int64) (*Result, error) {
+	return m.update(paymentID, func(payment *Result) error {
+		if payment.Status != StatusCaptured && payment.Status != StatusRefunded {
+			return ErrInvalidState
+		}
+		if m.refunded[paymentID]+amount > payment.Amount {
+			return ErrInvalidState
+		}
+		m.refunded[paymentID] += amount
+		payment.Status = StatusRefunded
+		return nil
+	})
+}
+
+func (m *MockProvider) update(paymentID string, apply func(*Result) error) (*Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	payment, ok := m.payments[paymentID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if err := apply(payment); err != nil {
+		return nil, err
+	}
+	copied := *payment
+	return &copied, nil
+}
+
+func (m *MockProvider) ParseWebhook(payload []byte, signature string) (*Event, error) {
+	return parseSignedEvent(m.WebhookSecret, payload, signature)
+}
+
+// SignedEvent encodes an event as the mock gateway would deliver it and
+// returns the body with its signature
+func (m *MockProvider) SignedEvent(eventType string, payment *Result) ([]byte, string, error) {
+	payload, err := json.Marshal(Event{
+		ID:        "evt_" + randomID(),
+		Type:      eventType,
+		PaymentID: payment.ID,
+		Amount:    payment.Amount,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, Sign(m.WebhookSecret, payload), nil
+}
+
+func randomID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
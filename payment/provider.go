@@ -0,0 +1,93 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// Payment statuses reported by providers
+const (
+	StatusAuthorized = "authorized"
+	StatusCaptured   = "captured"
+	StatusVoided     = "voided"
+	StatusRefunded   = "refunded"
+	StatusFailed     = "failed"
+)
+
+// Webhook event types
+const (
+	EventCaptured = "payment.captured"
+	EventFailed   = "payment.failed"
+	EventRefunded = "payment.refunded"
+)
+
+var (
+	ErrInvalidSignature = errors.New("payment: invalid webhook signature")
+	ErrNotFound         = errors.New("payment: payment not found")
+	ErrInvalidState     = errors.New("payment: operation not allowed in current state")
+	ErrDeclined         = errors.New("payment: card declined")
+)
+
+// AuthorizeRequest asks the provider to hold Amount (in minor units) on the
+// customer's payment method
+type AuthorizeRequest struct {
+	Reference string `json:"reference"` // our order reference
+	Amount    int64  `json:"amount"`
+	Currency  string `json:"currency"`
+	Source    string `json:"source"` // card token or other payment method handle
+}
+
+// Result describes a payment after an operation
+type Result struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// Event is a verified webhook notification
+type Event struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	PaymentID string `json:"payment_id"`
+	Amount    int64  `json:"amount"`
+}
+
+// Provider is implemented by payment gateways
+type Provider interface {
+	Name() string
+	Authorize(ctx context.Context, request AuthorizeRequest) (*Result, error)
+	Capture(ctx context.Context, paymentID string, amount int64) (*Result, error)
+	Void(ctx context.Context, paymentID string) (*Result, error)
+	Refund(ctx context.Context, paymentID string, amount int64) (*Result, error)
+	// ParseWebhook verifies the signature of a webhook body and decodes it
+	ParseWebhook(payload []byte, signature string) (*Event, error)
+}
+
+// Sign returns the hex HMAC-SHA256 of payload, as sent in webhook headers
+func Sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks a webhook signature in constant time
+func VerifySignature(secret, payload []byte, signature string) bool {
+	expected := Sign(secret, payload)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func parseSignedEvent(secret, payload []byte, signature string) (*Event, error) {
+	if !VerifySignature(secret, payload, signature) {
+		return nil, ErrInvalidSignature
+	}
+	event := &Event{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
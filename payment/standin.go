@@ -0,0 +1,207 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the webhook HMAC for the mock and stand-in gateways
+const SignatureHeader = "X-Payment-Signature"
+
+// StandInServer is a local HTTP imitation of a payment gateway. It speaks
+// the API used by HTTPProvider and, when WebhookURL is set, delivers
+// signed webhooks after captures and refunds.
+type StandInServer struct {
+	Mock       *MockProvider
+	WebhookURL string
+	Client     *http.Client
+}
+
+// NewStandInServer returns a stand-in gateway backed by a fresh MockProvider
+func NewStandInServer(webhookSecret []byte, webhookURL string) *StandInServer {
+	return &StandInServer{
+		Mock:       NewMockProvider(webhookSecret),
+		WebhookURL: webhookURL,
+		Client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type amountRequest struct {
+	Amount int64 `json:"amount"`
+}
+
+// ServeHTTP handles
+//
+//	POST /v1/payments
+//	POST /v1/payments/{id}/capture
+//	POST /v1/payments/{id}/void
+//	POST /v1/payments/{id}/refund
+func (s *StandInServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1/payments"), "/")
+	var (
+		result *Result
+		err    error
+	)
+	if path == "" {
+		request := AuthorizeRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err = s.Mock.Authorize(req.Context(), request)
+	} else {
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 {
+			http.NotFound(w, req)
+			return
+		}
+		body := amountRequest{}
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		switch parts[1] {
+		case "capture":
+			result, err = s.Mock.Capture(req.Context(), parts[0], body.Amount)
+			if err == nil {
+				s.deliver(EventCaptured, result)
+			}
+		case "void":
+			result, err = s.Mock.Void(req.Context(), parts[0])
+		case "refund":
+			result, err = s.Mock.Refund(req.Context(), parts[0], body.Amount)
+			if err == nil {
+				s.deliver(EventRefunded, result)
+			}
+		default:
+			http.NotFound(w, req)
+			return
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// deliver posts a signed event to WebhookURL in the background
+func (s *StandInServer) deliver(eventType string, result *Result) {
+	if s.WebhookURL == "" {
+		return
+	}
+	payload, signature, err := s.Mock.SignedEvent(eventType, result)
+	if err != nil {
+		return
+	}
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, s.WebhookURL, bytes.NewReader(payload))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(SignatureHeader, signature)
+		if resp, err := s.Client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+}
+
+var errorCodes = map[error]string{
+	ErrNotFound:     "not_found",
+	ErrInvalidState: "invalid_state",
+	ErrDeclined:     "declined",
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrNotFound) {
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": errorCodes[err]})
+}
+
+// HTTPProvider talks to a gateway that speaks the stand-in API
+type HTTPProvider struct {
+	BaseURL       string
+	WebhookSecret []byte
+	Client        *http.Client
+}
+
+func (p *HTTPProvider) Name() string { return "http" }
+
+func (p *HTTPProvider) Authorize(ctx context.Context, request AuthorizeRequest) (*Result, error) {
+	return p.post(ctx, "/v1/payments", request)
+}
+
+func (p *HTTPProvider) Capture(ctx context.Context, paymentID string, amount int64) (*Result, error) {
+	return p.post(ctx, "/v1/payments/"+paymentID+"/capture", amountRequest{Amount: amount})
+}
+
+func (p *HTTPProvider) Void(ctx context.Context, paymentID string) (*Result, error) {
+	return p.post(ctx, "/v1/payments/"+paymentID+"/void", nil)
+}
+
+func (p *HTTPProvider) Refund(ctx context.Context, paymentID string, amount int64) (*Result, error) {
+	return p.post(ctx, "/v1/payments/"+paymentID+"/refund", amountRequest{Amount: amount})
+}
+
+func (p *HTTPProvider) ParseWebhook(payload []byte, signature string) (*Event, error) {
+	return parseSignedEvent(p.WebhookSecret, payload, signature)
+}
+
+func (p *HTTPProvider) post(ctx context.Context, path string, body interface{}) (*Result, error) {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(p.BaseURL, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		failure := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		for known, code := range errorCodes {
+			if failure["error"] == code {
+				return nil, known
+			}
+		}
+		return nil, fmt.Errorf("payment: gateway returned %s", resp.Status)
+	}
+	result := &Result{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/payment"
+)
+
+// Struct PaymentIntent
+// One row per attempt to pay an order through a provider.
+type PaymentIntent struct {
+	ID          uint      `json:"id" gorm:"primary_key"`
+	OrderID     uint      `json:"order_id" gorm:"index;not null"`
+	Provider    string    `json:"provider" gorm:"not null"`
+	ProviderRef *string   `json:"provider_ref" gorm:"unique_index"`
+	Amount      int64     `json:"amount"`
+	Currency    string    `json:"currency"`
+	Status      string    `json:"status" gorm:"not null"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// intentPending marks an intent whose payment is still being taken. An
+// order has at most one.
+const intentPending = "pending"
+
+var (
+	errOrderNotPending    = errors.New("order is not awaiting payment")
+	errReservationExpired = errors.New("stock reservation expired")
+	errPaymentInProgress  = errors.New("payment already in progress")
+)
+
+// Struct WebhookEvent
+// Records processed provider events so redelivered webhooks are ignored.
+type WebhookEvent struct {
+	ID        uint   `gorm:"primary_key"`
+	Provider  string `gorm:"unique_index:idx_webhook_events_provider_event;not null"`
+	EventID   string `gorm:"unique_index:idx_webhook_events_provider_event;not null"`
+	Type      string
+	CreatedAt time.Time
+}
+
+// Struct PayOrderRequest
+type PayOrderRequest struct {
+	Source string `json:"source"`
+}
+
+// MigratePayments adds the index that allows one pending intent per order
+func MigratePayments(db *gorm.DB) error {
+	return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_payment_intents_pending
+		ON payment_intents (order_id) WHERE status = 'pending'`).Error
+}
+
+// newPaymentProvider builds the provider named by PAYMENT_PROVIDER:
+// "mock" (default) keeps payments in memory, "http" calls PAYMENT_API_URL,
+// and "standin" starts a local stand-in gateway on PAYMENT_STANDIN_ADDR and
+// talks to it over HTTP.
+func newPaymentProvider() (payment.Provider, error) {
+	secret := []byte(os.Getenv("PAYMENT_WEBHOOK_SECRET"))
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "", "mock":
+		return payment.NewMockProvider(secret), nil
+	case "http":
+		return &payment.HTTPProvider{
+			BaseURL:       os.Getenv("PAYMENT_API_URL"),
+			WebhookSecret: secret,
+			Client:        &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "standin":
+		addr := os.Getenv("PAYMENT_STANDIN_ADDR")
+		server := payment.NewStandInServer(secret, os.Getenv("PAYMENT_WEBHOOK_URL"))
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, server))
+		}()
+		return &payment.HTTPProvider{
+			BaseURL:       "http://" + addr,
+			WebhookSecret: secret,
+			Client:        &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+}
+
+// claimPayment records a pending intent for a pending order. The order row
+// lock and the one-pending-intent-per-order index make sure only one
+// request takes the customer's money at a time.
+func claimPayment(tx *gorm.DB, intent *PaymentIntent) error {
+	order := Order{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", intent.OrderID).First(&order).Error
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderPending {
+		return errOrderNotPending
+	}
+	// The stock may already be sold to someone else once the hold lapses
+	if order.ReservedUntil != nil && time.Now().After(*order.ReservedUntil) {
+		return errReservationExpired
+	}
+	var pending int
+	err = tx.Model(&PaymentIntent{}).Where("order_id = ? AND status = ?", order.ID, intentPending).Count(&pending).Error
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return errPaymentInProgress
+	}
+	return tx.Create(intent).Error
+}
+
+// capturePayment captures an authorized intent and marks its order paid.
+// The order is locked across the capture so the reservation sweeper cannot
+// cancel it in between; captured reports whether the money was taken.
+func (r *Repository) capturePayment(ctx context.Context, tx *gorm.DB, intent *PaymentIntent) (captured bool, err error) {
+	order := Order{}
+	err = tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", intent.OrderID).First(&order).Error
+	if err != nil {
+		return false, err
+	}
+	if order.Status != OrderPending {
+		return false, errOrderNotPending
+	}
+	if order.ReservedUntil != nil && time.Now().After(*order.ReservedUntil) {
+		return false, errReservationExpired
+	}
+	result, err := r.Payments.Capture(ctx, *intent.ProviderRef, intent.Amount)
+	if err != nil {
+		return false, err
+	}
+	intent.Status = result.Status
+	if err := tx.Model(intent).Update("status", result.Status).Error; err != nil {
+		return true, err
+	}
+	_, err = transitionOrder(tx, order.ID, OrderPaid, nil, "payment captured")
+	return true, err
+}
+
+// refundPayment gives back a captured payment whose order could not be
+// marked paid
+func (r *Repository) refundPayment(ctx context.Context, intent *PaymentIntent) {
+	if _, err := r.Payments.Refund(ctx, *intent.ProviderRef, intent.Amount); err != nil {
+		log.Printf("refund payment %s for order %d: %v", *intent.ProviderRef, intent.OrderID, err)
+		return
+	}
+	intent.Status = payment.StatusRefunded
+	r.DB.Model(intent).Update("status", payment.StatusRefunded)
+}
+
+// voidPayment releases an authorization that will not be captured
+func (r *Repository) voidPayment(ctx context.Context, intent *PaymentIntent) {
+	if _, err := r.Payments.Void(ctx, *intent.ProviderRef); err != nil {
+		log.Printf("void payment %s for order %d: %v", *intent.ProviderRef, intent.OrderID, err)
+		intent.Status = payment.StatusFailed
+		r.DB.Model(intent).Update("status", payment.StatusFailed)
+		return
+	}
+	intent.Status = payment.StatusVoided
+	r.DB.Model(intent).Update("status", payment.StatusVoided)
+}
+
+// respondPaymentError writes the response for errors while taking a payment
+func respondPaymentError(context *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errOrderNotPending):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Order is not awaiting payment"})
+		return nil
+	case errors.Is(err, errReservationExpired):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Stock reservation expired"})
+		return nil
+	case errors.Is(err, errInsufficientStock):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Not enough stock at the active locations to fulfil the order"})
+		return nil
+	case errors.Is(err, errPaymentInProgress):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "A payment for this order is already in progress"})
+		return nil
+	case errors.Is(err, payment.ErrDeclined):
+		context.Status(http.StatusPaymentRequired).JSON(
+			&fiber.Map{"message": "Payment was declined"})
+		return nil
+	case gorm.IsRecordNotFoundError(err):
+		return respondTransitionError(context, err)
+	}
+	context.Status(http.StatusBadGateway).JSON(
+		&fiber.Map{"message": "Payment provider error"})
+	return err
+}
+
+// markOrderPaid moves a pending order to paid. Orders that were already
+// paid are left alone so repeated notifications are harmless; a cancelled
+// order returns errOrderNotPending and its payment must be given back.
+func markOrderPaid(tx *gorm.DB, orderID uint, reason string) error {
+	order := Order{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", orderID).First(&order).Error
+	if err != nil {
+		return err
+	}
+	if order.Status == OrderCancelled {
+		return errOrderNotPending
+	}
+	if order.Status != OrderPending {
+		return nil
+	}
+	_, err = transitionOrder(tx, orderID, OrderPaid, nil, reason)
+	return err
+}
+
+// Pay for one of the caller's pending orders
+func (r *Repository) PayOrder(context *fiber.Ctx) error {
+	request := PayOrderRequest{}
+	if err := context.BodyParser(&request); err != nil || request.Source == "" {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	order, err := r.findOrderForCaller(context)
+	if err != nil || order.AccountID != currentAccount(context).ID {
+		return respondTransitionError(context, gorm.ErrRecordNotFound)
+	}
+
+	intent := PaymentIntent{
+		OrderID:  order.ID,
+		Provider: r.Payments.Name(),
+		Amount:   order.Total.Amount,
+		Currency: order.Total.Currency,
+		Status:   intentPending,
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		return claimPayment(tx, &intent)
+	})
+	if errors.Is(err, errReservationExpired) {
+		// Cancelled in a transaction of its own; the claim was rolled back
+		expireErr := r.DB.Transaction(func(tx *gorm.DB) error {
+			_, err := expireOrder(tx, order.ID)
+			return err
+		})
+		if expireErr != nil {
+			return respondTransitionError(context, expireErr)
+		}
+	}
+	if err != nil {
+		return respondPaymentError(context, err)
+	}
+
+	result, err := r.Payments.Authorize(context.Context(), payment.AuthorizeRequest{
+		Reference: fmt.Sprintf("order-%d", order.ID),
+		Amount:    intent.Amount,
+		Currency:  intent.Currency,
+		Source:    request.Source,
+	})
+	if err != nil {
+		r.DB.Model(&intent).Update("status", payment.StatusFailed)
+		return respondPaymentError(context, err)
+	}
+	// Saved before capturing so a webhook for the capture can find it
+	intent.ProviderRef = &result.ID
+	err = r.DB.Model(&intent).Updates(map[string]interface{}{
+		"provider_ref": result.ID,
+		"status":       result.Status,
+	}).Error
+	if err != nil {
+		r.voidPayment(context.Context(), &intent)
+		return respondPaymentError(context, err)
+	}
+	captured := false
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		captured, err = r.capturePayment(context.Context(), tx, &intent)
+		return err
+	})
+	if err != nil {
+		// Leave nothing taken or held for an order that was not paid
+		if captured {
+			r.refundPayment(context.Context(), &intent)
+		} else {
+			r.voidPayment(context.Context(), &intent)
+		}
+		return respondPaymentError(context, err)
+	}
+	return context.JSON(intent)
+}
+
+// Refund a paid order (Staff)
+func (r *Repository) RefundOrder(context *fiber.Ctx) error {
+	order, err := r.findOrderForCaller(context)
+	if err != nil {
+		return respondTransitionError(context, err)
+	}
+	if !canTransition(order.Status, OrderRefunded) {
+		return respondTransitionError(context, errIllegalTransition)
+	}
+	intent := PaymentIntent{}
+	err = r.DB.Where("order_id = ? AND status = ?", order.ID, payment.StatusCaptured).First(&intent).Error
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "Order has no captured payment"})
+		return nil
+	}
+	if err != nil {
+		return respondTransitionError(context, err)
+	}
+	if _, err := r.Payments.Refund(context.Context(), *intent.ProviderRef, intent.Amount); err != nil {
+		context.Status(http.StatusBadGateway).JSON(
+			&fiber.Map{"message": "Payment provider error"})
+		return err
+	}
+	account := currentAccount(context)
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&intent).Update("status", payment.StatusRefunded).Error; err != nil {
+			return err
+		}
+		order, err = transitionOrder(tx, order.ID, OrderRefunded, &account.ID, "payment refunded")
+		return err
+	})
+	if err != nil {
+		return respondTransitionError(context, err)
+	}
+	return context.JSON(order)
+}
+
+// Receive payment provider webhooks
+func (r *Repository) PaymentWebhook(context *fiber.Ctx) error {
+	event, err := r.Payments.ParseWebhook(context.Body(), context.Get(payment.SignatureHeader))
+	if err != nil {
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "Invalid webhook"})
+		return nil
+	}
+	intent := PaymentIntent{}
+	orphaned := false
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		inserted := tx.Exec(`INSERT INTO webhook_events (provider, event_id, type, created_at)
+			VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			r.Payments.Name(), event.ID, event.Type, time.Now())
+		if inserted.Error != nil {
+			return inserted.Error
+		}
+		if inserted.RowsAffected == 0 {
+			// Already processed
+			return nil
+		}
+		err := tx.Where("provider = ? AND provider_ref = ?", r.Payments.Name(), event.PaymentID).
+			First(&intent).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Lock the order before the intent, in the same order as PayOrder
+		err = tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", intent.OrderID).First(&Order{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", intent.ID).First(&intent).Error
+		if err != nil {
+			return err
+		}
+		switch event.Type {
+		case payment.EventCaptured:
+			if intent.Status == payment.StatusRefunded || intent.Status == payment.StatusVoided {
+				return nil
+			}
+			if err := tx.Model(&intent).Update("status", payment.StatusCaptured).Error; err != nil {
+				return err
+			}
+			err := markOrderPaid(tx, intent.OrderID, "payment captured (webhook)")
+			if errors.Is(err, errOrderNotPending) {
+				orphaned = true
+				return nil
+			}
+			return err
+		case payment.EventFailed:
+			return tx.Model(&intent).Update("status", payment.StatusFailed).Error
+		case payment.EventRefunded:
+			return tx.Model(&intent).Update("status", payment.StatusRefunded).Error
+		}
+		return nil
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to process webhook"})
+		return err
+	}
+	// The order was cancelled before the payment went through
+	if orphaned {
+		r.refundPayment(context.Context(), &intent)
+	}
+	return context.SendStatus(http.StatusOK)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+// currencyLocal is the fiber locals key of the currency chosen by the caller
+const currencyLocal = "currency"
+
+// Struct ProductPrice
+// An explicit price for a product, or one of its variants, in a currency
+// other than the store currency. Without one the store price is converted
+// at the current exchange rate.
+type ProductPrice struct {
+	ID        uint        `json:"id" gorm:"primary_key"`
+	ProductID uint        `json:"product_id" gorm:"index;not null"`
+	VariantID uint        `json:"variant_id" gorm:"not null;default:0"`
+	Price     money.Money `json:"price" gorm:"embedded;embedded_prefix:price_"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// Struct ProductPricesRequest
+// Replaces the explicit prices of the product, or of VariantID when set.
+type ProductPricesRequest struct {
+	VariantID uint          `json:"variant_id"`
+	Prices    []money.Money `json:"prices"`
+}
+
+// MigratePricing creates the explicit price table and fills in the store
+// currency totals of orders placed before orders had a display currency
+func MigratePricing(db *gorm.DB) error {
+	if err := db.AutoMigrate(&ProductPrice{}).Error; err != nil {
+		return err
+	}
+	err := db.Model(&ProductPrice{}).
+		AddUniqueIndex("idx_product_prices_currency", "product_id", "variant_id", "price_currency").Error
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		`UPDATE orders SET base_total_amount = total_amount, base_total_currency = total_currency,
+			exchange_rate = '1' WHERE base_total_currency IS NULL`,
+		`UPDATE order_lines SET base_unit_price_amount = unit_price_amount,
+			base_unit_price_currency = unit_price_currency WHERE base_unit_price_currency IS NULL`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelectCurrency reads the currency the caller wants prices in from the
+// currency query parameter or the X-Currency header. Only currencies the
+// store has an exchange rate for are accepted, even when some products
+// have explicit prices in others.
+func (r *Repository) SelectCurrency(context *fiber.Ctx) error {
+	currency := strings.ToUpper(strings.TrimSpace(context.Query("currency")))
+	if currency == "" {
+		currency = strings.ToUpper(strings.TrimSpace(context.Get("X-Currency")))
+	}
+	if currency == "" || currency == r.Currency {
+		return context.Next()
+	}
+	if !money.Valid(currency) {
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "Unknown currency " + currency})
+		return nil
+	}
+	if _, err := r.Rates.Rate(context.Context(), r.Currency, currency); err != nil {
+		if errors.Is(err, errRateUnavailable) {
+			context.Status(http.StatusBadRequest).JSON(
+				&fiber.Map{"message": "Prices are not available in " + currency + ": no exchange rate is configured"})
+			return nil
+		}
+		return err
+	}
+	context.Locals(currencyLocal, currency)
+	return context.Next()
+}
+
+// requestCurrency returns the currency chosen for this request
+func (r *Repository) requestCurrency(context *fiber.Ctx) string {
+	if currency, ok := context.Locals(currencyLocal).(string); ok {
+		return currency
+	}
+	return r.Currency
+}
+
+// localPrice is one price to show in another currency. Base is the store
+// currency price; Inherit marks variants without their own price, which
+// fall back to the product's explicit prices.
+type localPrice struct {
+	ProductID uint
+	VariantID uint
+	Base      money.Money
+	Inherit   bool
+
+	Local    money.Money
+	Explicit bool
+}
+
+// localizePrices fills in Local for every price: an explicit price in
+// currency when one is set, otherwise Base converted at the current rate.
+// It returns the rate, which is nil when currency is the store currency.
+func (r *Repository) localizePrices(ctx context.Context, db *gorm.DB, currency string, prices []*localPrice) (*ExchangeRate, error) {
+	if currency == r.Currency {
+		for _, price := range prices {
+			price.Local = price.Base
+		}
+		return nil, nil
+	}
+	rate, err := r.Rates.Rate(ctx, r.Currency, currency)
+	if err != nil {
+		return nil, err
+	}
+	if len(prices) == 0 {
+		return &rate, nil
+	}
+	productIDs := make([]uint, len(prices))
+	for i, price := range prices {
+		productIDs[i] = price.ProductID
+	}
+	var rows []ProductPrice
+	err = db.Where("product_id IN (?) AND price_currency = ?", productIDs, currency).Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	explicit := map[[2]uint]money.Money{}
+	for _, row := range rows {
+		explicit[[2]uint{row.ProductID, row.VariantID}] = row.Price
+	}
+	for _, price := range prices {
+		if local, ok := explicit[[2]uint{price.ProductID, price.VariantID}]; ok {
+			price.Local, price.Explicit = local, true
+			continue
+		}
+		if local, ok := explicit[[2]uint{price.ProductID, 0}]; ok && (price.VariantID == 0 || price.Inherit) {
+			price.Local, price.Explicit = local, price.VariantID == 0
+			continue
+		}
+		price.Local, err = price.Base.Convert(currency, rate.Rate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &rate, nil
+}
+
+// localizeProducts shows the prices of products and their variants in the
+// request currency
+func (r *Repository) localizeProducts(context *fiber.Ctx, products []*Product) error {
+	currency := r.requestCurrency(context)
+	if currency == r.Currency {
+		return nil
+	}
+	var prices []*localPrice
+	for _, product := range products {
+		prices = append(prices, &localPrice{ProductID: product.ID, Base: product.Price})
+		for _, variant := range product.Variants {
+			base, inherit := product.Price, variant.Price == nil
+			if !inherit {
+				base = *variant.Price
+			}
+			prices = append(prices, &localPrice{ProductID: product.ID, VariantID: variant.ID, Base: base, Inherit: inherit})
+		}
+	}
+	if _, err := r.localizePrices(context.Context(), r.DB, currency, prices); err != nil {
+		return err
+	}
+	next := 0
+	for _, product := range products {
+		product.Price = prices[next].Local
+		next++
+		for i := range product.Variants {
+			price := prices[next]
+			next++
+			// Variants that inherit the product price keep showing null
+			if !price.Inherit || price.Explicit {
+				local := price.Local
+				product.Variants[i].Price = &local
+			}
+		}
+	}
+	return nil
+}
+
+// Get the explicit prices of a product and its variants
+func (r *Repository) GetProductPrices(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	prices := []ProductPrice{}
+	err = r.DB.Where("product_id = ?", product.ID).Order("variant_id, price_currency").Find(&prices).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve prices"})
+		return err
+	}
+	return context.JSON(&fiber.Map{"base": product.Price, "prices": prices})
+}
+
+// Replace the explicit prices of a product or one of its variants
+func (r *Repository) SetProductPrices(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	request := ProductPricesRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request: " + err.Error()})
+		return nil
+	}
+	problems := map[string]string{}
+	seen := map[string]bool{}
+	for _, price := range request.Prices {
+		field := "prices." + price.Currency
+		switch {
+		case price.Currency == r.Currency:
+			problems[field] = "the store currency price is set on the product"
+		case seen[price.Currency]:
+			problems[field] = "is listed twice"
+		case price.IsNegative():
+			problems[field] = "must not be negative"
+		}
+		seen[price.Currency] = true
+	}
+	if request.VariantID != 0 {
+		var count int
+		r.DB.Model(&ProductVariant{}).Where("id = ? AND product_id = ?", request.VariantID, product.ID).Count(&count)
+		if count == 0 {
+			problems["variant_id"] = "is not a variant of this product"
+		}
+	}
+	if len(problems) > 0 {
+		return respondInvalidProduct(context, problems)
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("product_id = ? AND variant_id = ?", product.ID, request.VariantID).
+			Delete(&ProductPrice{}).Error
+		if err != nil {
+			return err
+		}
+		for _, price := range request.Prices {
+			row := ProductPrice{ProductID: product.ID, VariantID: request.VariantID, Price: price}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to save prices"})
+		return err
+	}
+	return r.GetProductPrices(context)
+}
+
+// identityRate is frozen on orders placed in the store currency
+func identityRate(currency string) *ExchangeRate {
+	return &ExchangeRate{Base: currency, Quote: currency, Rate: big.NewRat(1, 1), Source: "identity"}
+}
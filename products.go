@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+// Struct ProductRequest
+// Fields are pointers so PATCH can tell a missing field from a zero value.
+type ProductRequest struct {
+	SKU         *string      `json:"sku"`
+	Slug        *string      `json:"slug"`
+	Title       *string      `json:"title"`
+	Description *string      `json:"description"`
+	Price       *money.Input `json:"price"`
+	TaxClass    *string      `json:"tax_class"`
+	WeightGrams *int         `json:"weight_grams"`
+	LengthMM    *int         `json:"length_mm"`
+	WidthMM     *int         `json:"width_mm"`
+	HeightMM    *int         `json:"height_mm"`
+	Quantity    *int         `json:"quantity"`
+	CategoryIDs *[]uint      `json:"category_ids"`
+}
+
+var (
+	slugInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+	slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+)
+
+// slugify turns a title into a URL-safe slug
+func slugify(title string) string {
+	return strings.Trim(slugInvalid.ReplaceAllString(strings.ToLower(title), "-"), "-")
+}
+
+// MigrateProducts creates the product table and backfills the SKU and slug
+// of rows created before those columns existed
+func MigrateProducts(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Product{}).Error; err != nil {
+		return err
+	}
+	err := db.Exec(`UPDATE product SET sku = 'SKU-' || id WHERE sku IS NULL OR sku = ''`).Error
+	if err != nil {
+		return err
+	}
+	err = db.Exec(`UPDATE product
+		SET slug = trim(both '-' from regexp_replace(lower(title), '[^a-z0-9]+', '-', 'g')) || '-' || id
+		WHERE slug IS NULL OR slug = ''`).Error
+	if err != nil {
+		return err
+	}
+	if err := db.Model(&Product{}).AddUniqueIndex("idx_product_sku", "sku").Error; err != nil {
+		return err
+	}
+	if err := db.Model(&Product{}).AddUniqueIndex("idx_product_slug", "slug").Error; err != nil {
+		return err
+	}
+	return createProductListIndexes(db)
+}
+
+// apply copies the fields present in the request onto product. A price
+// without a currency is in the product's current currency, or currency for
+// new products.
+func (request *ProductRequest) apply(product *Product, currency string) map[string]string {
+	problems := map[string]string{}
+	if request.SKU != nil {
+		product.SKU = strings.TrimSpace(*request.SKU)
+	}
+	if request.Title != nil {
+		product.Title = strings.TrimSpace(*request.Title)
+	}
+	if request.Slug != nil {
+		product.Slug = *request.Slug
+	}
+	if request.Description != nil {
+		product.Description = *request.Description
+	}
+	if request.Price != nil {
+		if product.Price.Currency != "" {
+			currency = product.Price.Currency
+		}
+		price, err := request.Price.In(currency)
+		if err != nil {
+			problems["price"] = err.Error()
+		}
+		product.Price = price
+	}
+	if request.TaxClass != nil {
+		product.TaxClass = strings.TrimSpace(*request.TaxClass)
+	}
+	if product.TaxClass == "" {
+		product.TaxClass = DefaultTaxClass
+	}
+	for target, value := range map[*int]*int{
+		&product.WeightGrams: request.WeightGrams,
+		&product.LengthMM:    request.LengthMM,
+		&product.WidthMM:     request.WidthMM,
+		&product.HeightMM:    request.HeightMM,
+	} {
+		if value != nil {
+			*target = *value
+		}
+	}
+	if request.Quantity != nil {
+		product.Quantity = *request.Quantity
+	}
+	if product.Slug == "" {
+		product.Slug = slugify(product.Title)
+	}
+	return problems
+}
+
+// complete reports the fields a full create or replace must include
+func (request *ProductRequest) complete() map[string]string {
+	problems := map[string]string{}
+	if request.SKU == nil {
+		problems["sku"] = "is required"
+	}
+	if request.Title == nil {
+		problems["title"] = "is required"
+	}
+	if request.Price == nil {
+		problems["price"] = "is required"
+	}
+	if request.Quantity == nil {
+		problems["quantity"] = "is required"
+	}
+	return problems
+}
+
+// validateProduct checks a product before it is saved. Prices must be in
+// the store currency.
+func validateProduct(db *gorm.DB, product *Product, currency string) (map[string]string, error) {
+	problems := map[string]string{}
+	if product.SKU == "" {
+		problems["sku"] = "must not be empty"
+	}
+	if product.Title == "" {
+		problems["title"] = "must not be empty"
+	}
+	if !slugPattern.MatchString(product.Slug) {
+		problems["slug"] = "must be lowercase letters, digits and single dashes"
+	}
+	if product.Price.IsNegative() {
+		problems["price"] = "must not be negative"
+	}
+	if product.Price.Currency != currency {
+		problems["price"] = "must be in " + currency
+	}
+	if !taxClassPattern.MatchString(product.TaxClass) {
+		problems["tax_class"] = "must be lowercase letters and digits separated by dashes or underscores"
+	}
+	if product.Quantity < 0 {
+		problems["quantity"] = "must not be negative"
+	}
+	for field, value := range map[string]int{
+		"weight_grams": product.WeightGrams,
+		"length_mm":    product.LengthMM,
+		"width_mm":     product.WidthMM,
+		"height_mm":    product.HeightMM,
+	} {
+		if value < 0 {
+			problems[field] = "must not be negative"
+		}
+	}
+	var count int
+	// Deleted products keep their SKU and slug, so include them
+	err := db.Unscoped().Model(&Product{}).Where("sku = ? AND id <> ?", product.SKU, product.ID).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		problems["sku"] = "is already used by another product"
+	}
+	if count == 0 {
+		if err := db.Unscoped().Model(&ProductVariant{}).Where("sku = ?", product.SKU).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			problems["sku"] = "is already used by a variant"
+		}
+	}
+	err = db.Unscoped().Model(&Product{}).Where("slug = ? AND id <> ?", product.Slug, product.ID).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		problems["slug"] = "is already used by another product"
+	}
+	return problems, nil
+}
+
+// validateCategoryIDs checks that every requested category exists
+func (request *ProductRequest) validateCategoryIDs(db *gorm.DB, problems map[string]string) {
+	if request.CategoryIDs == nil {
+		return
+	}
+	*request.CategoryIDs = sortCategoryIDs(*request.CategoryIDs)
+	if missing := missingCategories(db, *request.CategoryIDs); len(missing) > 0 {
+		problems["category_ids"] = fmt.Sprintf("unknown categories %v", missing)
+	}
+}
+
+// saveWithCategories saves product and, when the request names categories,
+// replaces its category assignments in the same transaction. The stock is
+// only written when the request sets it, so sales made since the product
+// was read are kept.
+func (request *ProductRequest) saveWithCategories(db *gorm.DB, product *Product) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		save := tx
+		if product.ID != 0 {
+			current := Product{}
+			err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", product.ID).First(&current).Error
+			if err != nil {
+				return err
+			}
+			if request.Quantity == nil {
+				product.Quantity = current.Quantity
+				save = tx.Omit("quantity")
+			}
+		}
+		if err := save.Save(product).Error; err != nil {
+			return err
+		}
+		if request.Quantity != nil {
+			if err := setOnHand(tx, product.ID, 0, product.Quantity); err != nil {
+				return err
+			}
+		}
+		if request.CategoryIDs == nil {
+			return nil
+		}
+		return setProductCategories(tx, product.ID, *request.CategoryIDs)
+	})
+}
+
+// preloadProducts loads the categories, variants, images, stock and
+// ratings shown with products, and prices them in the request currency
+func (r *Repository) preloadProducts(context *fiber.Ctx, products []*Product) error {
+	if err := preloadCategories(r.DB, products); err != nil {
+		return err
+	}
+	if err := preloadProductVariants(r.DB, products); err != nil {
+		return err
+	}
+	if err := r.preloadImages(products); err != nil {
+		return err
+	}
+	if err := preloadAvailability(r.DB, products); err != nil {
+		return err
+	}
+	if err := preloadRatings(r.DB, products); err != nil {
+		return err
+	}
+	return r.localizeProducts(context, products)
+}
+
+func respondInvalidProduct(context *fiber.Ctx, problems map[string]string) error {
+	context.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+		"message": "Invalid product",
+		"errors":  problems,
+	})
+	return nil
+}
+
+// findProduct loads the product named by the :id route parameter
+func (r *Repository) findProduct(context *fiber.Ctx) (*Product, error) {
+	id, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	product := &Product{}
+	err = r.DB.Where("id = ?", id).First(product).Error
+	return product, err
+}
+
+func respondProductLookupError(context *fiber.Ctx, err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Product not found"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to retrieve product"})
+	return err
+}
+
+// Get a product by ID
+func (r *Repository) GetProduct(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	if err := r.preloadProducts(context, []*Product{product}); err != nil {
+		return err
+	}
+	return context.JSON(product)
+}
+
+// Create a product
+func (r *Repository) CreateProduct(context *fiber.Ctx) error {
+	request := ProductRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	if problems := request.complete(); len(problems) > 0 {
+		return respondInvalidProduct(context, problems)
+	}
+	product := &Product{}
+	applyProblems := request.apply(product, r.Currency)
+	problems, err := validateProduct(r.DB, product, r.Currency)
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to create product"})
+		return err
+	}
+	for field, problem := range applyProblems {
+		problems[field] = problem
+	}
+	request.validateCategoryIDs(r.DB, problems)
+	if len(problems) > 0 {
+		return respondInvalidProduct(context, problems)
+	}
+	if err := request.saveWithCategories(r.DB, product); err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to create product"})
+		return err
+	}
+	if err := r.preloadProducts(context, []*Product{product}); err != nil {
+		return err
+	}
+	return context.Status(http.StatusCreated).JSON(product)
+}
+
+// saveProduct handles PUT (replace) and PATCH (partial update)
+func (r *Repository) saveProduct(context *fiber.Ctx, replace bool) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	return r.updateProduct(context, product, replace)
+}
+
+// updateProduct applies the request body to product, validates it and
+// saves it, answering with the updated product
+func (r *Repository) updateProduct(context *fiber.Ctx, product *Product, replace bool) error {
+	request := ProductRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	// The stock of a product with variants is the sum of the variants
+	withVariants, err := hasVariants(r.DB, product.ID)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	if withVariants && request.Quantity != nil && *request.Quantity != product.Quantity {
+		return respondInvalidProduct(context, map[string]string{
+			"quantity": "is managed through the product's variants",
+		})
+	}
+	if replace {
+		if problems := request.complete(); len(problems) > 0 {
+			return respondInvalidProduct(context, problems)
+		}
+		// A replace without a slug regenerates it from the new title
+		if request.Slug == nil {
+			product.Slug = ""
+		}
+		if request.Description == nil {
+			product.Description = ""
+		}
+		if request.CategoryIDs == nil {
+			request.CategoryIDs = &[]uint{}
+		}
+	}
+	applyProblems := request.apply(product, r.Currency)
+	problems, err := validateProduct(r.DB, product, r.Currency)
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to update product"})
+		return err
+	}
+	for field, problem := range applyProblems {
+		problems[field] = problem
+	}
+	request.validateCategoryIDs(r.DB, problems)
+	if len(problems) > 0 {
+		return respondInvalidProduct(context, problems)
+	}
+	if err := request.saveWithCategories(r.DB, product); err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to update product"})
+		return err
+	}
+	if err := r.preloadProducts(context, []*Product{product}); err != nil {
+		return err
+	}
+	return context.JSON(product)
+}
+
+// Replace a product
+func (r *Repository) ReplaceProduct(context *fiber.Ctx) error {
+	return r.saveProduct(context, true)
+}
+
+// Update some fields of a product
+func (r *Repository) PatchProduct(context *fiber.Ctx) error {
+	return r.saveProduct(context, false)
+}
+
+// Delete a product by ID. The row is kept (soft delete) so past orders and
+// carts still resolve it.
+func (r *Repository) DeleteProductByID(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	if err := r.DB.Delete(product).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to delete product"})
+		return err
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": fmt.Sprintf("Product %d deleted successfully", product.ID)})
+	return nil
+}
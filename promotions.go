@@ -0,0 +1,524 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+// Promotion kinds
+const (
+	PromotionPercent      = "percent"
+	PromotionFixed        = "fixed"
+	PromotionBuyXGetY     = "buy_x_get_y"
+	PromotionFreeShipping = "free_shipping"
+)
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]{2,31}$`)
+
+var (
+	errCouponNotFound     = errors.New("coupon not found")
+	errCouponNotStarted   = errors.New("coupon is not valid yet")
+	errCouponExpired      = errors.New("coupon has expired")
+	errCouponUsedUp       = errors.New("coupon has been used up")
+	errCouponCustomerUsed = errors.New("coupon has already been used the maximum number of times by this customer")
+)
+
+// Struct Promotion
+// Promotions without a code apply automatically to every cart; the others
+// apply once their code is entered. Percent is a decimal string such as
+// "15" used by percent and buy_x_get_y promotions; Amount is the discount of
+// fixed promotions and MinSubtotal the spend the eligible lines must reach,
+// both in the store currency. CategoryID limits the promotion to products in
+// that category or below it. Promotions are evaluated by ascending Priority,
+// then ID; one that is not Stackable only applies on its own.
+type Promotion struct {
+	ID               uint        `json:"id" gorm:"primary_key"`
+	Code             *string     `json:"code"`
+	Name             string      `json:"name" gorm:"not null"`
+	Kind             string      `json:"kind" gorm:"not null"`
+	Percent          string      `json:"percent,omitempty"`
+	Amount           money.Money `json:"amount" gorm:"embedded;embedded_prefix:amount_"`
+	BuyQuantity      int         `json:"buy_quantity,omitempty"`
+	GetQuantity      int         `json:"get_quantity,omitempty"`
+	CategoryID       *uint       `json:"category_id"`
+	MinSubtotal      money.Money `json:"min_subtotal" gorm:"embedded;embedded_prefix:min_subtotal_"`
+	StartsAt         *time.Time  `json:"starts_at"`
+	EndsAt           *time.Time  `json:"ends_at"`
+	UsageLimit       *int        `json:"usage_limit"`
+	PerCustomerLimit *int        `json:"per_customer_limit"`
+	Priority         int         `json:"priority" gorm:"not null"`
+	Stackable        bool        `json:"stackable" gorm:"not null"`
+	Active           bool        `json:"active" gorm:"not null"`
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"updated_at"`
+	DeletedAt        *time.Time  `json:"-" sql:"index"`
+}
+
+// Struct CartCoupon
+type CartCoupon struct {
+	CartID      uint `gorm:"primary_key;auto_increment:false"`
+	PromotionID uint `gorm:"primary_key;auto_increment:false;index"`
+	CreatedAt   time.Time
+}
+
+// Struct PromotionRedemption
+// One row per promotion applied to an order. Usage limits count the
+// redemptions of orders that were not cancelled.
+type PromotionRedemption struct {
+	ID          uint      `gorm:"primary_key"`
+	PromotionID uint      `gorm:"not null"`
+	OrderID     uint      `gorm:"index;not null"`
+	AccountID   uint      `gorm:"index;not null"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Struct OrderDiscount
+// A promotion as it was applied to an order
+type OrderDiscount struct {
+	ID           uint        `json:"id" gorm:"primary_key"`
+	OrderID      uint        `json:"order_id" gorm:"index;not null"`
+	PromotionID  uint        `json:"promotion_id" gorm:"not null"`
+	Code         string      `json:"code,omitempty"`
+	Name         string      `json:"name"`
+	Kind         string      `json:"kind"`
+	Amount       money.Money `json:"amount" gorm:"embedded;embedded_prefix:amount_"`
+	FreeShipping bool        `json:"free_shipping,omitempty"`
+}
+
+// Struct PromotionRequest
+// Limits of 0 remove the limit and a category_id of 0 removes the category.
+type PromotionRequest struct {
+	Code             *string      `json:"code"`
+	Name             *string      `json:"name"`
+	Kind             *string      `json:"kind"`
+	Percent          *string      `json:"percent"`
+	Amount           *money.Input `json:"amount"`
+	BuyQuantity      *int         `json:"buy_quantity"`
+	GetQuantity      *int         `json:"get_quantity"`
+	CategoryID       *uint        `json:"category_id"`
+	MinSubtotal      *money.Input `json:"min_subtotal"`
+	StartsAt         *time.Time   `json:"starts_at"`
+	EndsAt           *time.Time   `json:"ends_at"`
+	UsageLimit       *int         `json:"usage_limit"`
+	PerCustomerLimit *int         `json:"per_customer_limit"`
+	Priority         *int         `json:"priority"`
+	Stackable        *bool        `json:"stackable"`
+	Active           *bool        `json:"active"`
+}
+
+// Struct ApplyCouponRequest
+type ApplyCouponRequest struct {
+	Code string `json:"code"`
+}
+
+// MigratePromotions creates the promotion tables and gives orders placed
+// before promotions existed a subtotal and zero discounts
+func MigratePromotions(db *gorm.DB) error {
+	err := db.AutoMigrate(&Promotion{}, &CartCoupon{}, &PromotionRedemption{}, &OrderDiscount{}).Error
+	if err != nil {
+		return err
+	}
+	if err := db.Model(&Promotion{}).AddUniqueIndex("idx_promotions_code", "code").Error; err != nil {
+		return err
+	}
+	err = db.Model(&PromotionRedemption{}).
+		AddUniqueIndex("idx_promotion_redemptions_order", "promotion_id", "order_id").Error
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		`UPDATE orders SET subtotal_amount = total_amount, subtotal_currency = total_currency,
+			discount_total_currency = total_currency WHERE subtotal_currency IS NULL`,
+		`UPDATE order_lines SET discount_currency = unit_price_currency WHERE discount_currency IS NULL`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (request *PromotionRequest) apply(promotion *Promotion, currency string) map[string]string {
+	problems := map[string]string{}
+	if request.Code != nil {
+		if code := normalizeCouponCode(*request.Code); code == "" {
+			promotion.Code = nil
+		} else {
+			promotion.Code = &code
+		}
+	}
+	if request.Name != nil {
+		promotion.Name = strings.TrimSpace(*request.Name)
+	}
+	if request.Kind != nil {
+		promotion.Kind = *request.Kind
+	}
+	if request.Percent != nil {
+		promotion.Percent = strings.TrimSpace(*request.Percent)
+	}
+	if request.Amount != nil {
+		amount, err := request.Amount.In(currency)
+		if err != nil {
+			problems["amount"] = err.Error()
+		}
+		promotion.Amount = amount
+	}
+	if request.BuyQuantity != nil {
+		promotion.BuyQuantity = *request.BuyQuantity
+	}
+	if request.GetQuantity != nil {
+		promotion.GetQuantity = *request.GetQuantity
+	}
+	if request.CategoryID != nil {
+		promotion.CategoryID = request.CategoryID
+		if *request.CategoryID == 0 {
+			promotion.CategoryID = nil
+		}
+	}
+	if request.MinSubtotal != nil {
+		minimum, err := request.MinSubtotal.In(currency)
+		if err != nil {
+			problems["min_subtotal"] = err.Error()
+		}
+		promotion.MinSubtotal = minimum
+	}
+	if request.StartsAt != nil {
+		promotion.StartsAt = request.StartsAt
+	}
+	if request.EndsAt != nil {
+		promotion.EndsAt = request.EndsAt
+	}
+	if request.UsageLimit != nil {
+		promotion.UsageLimit = request.UsageLimit
+		if *request.UsageLimit == 0 {
+			promotion.UsageLimit = nil
+		}
+	}
+	if request.PerCustomerLimit != nil {
+		promotion.PerCustomerLimit = request.PerCustomerLimit
+		if *request.PerCustomerLimit == 0 {
+			promotion.PerCustomerLimit = nil
+		}
+	}
+	if request.Priority != nil {
+		promotion.Priority = *request.Priority
+	}
+	if request.Stackable != nil {
+		promotion.Stackable = *request.Stackable
+	}
+	if request.Active != nil {
+		promotion.Active = *request.Active
+	}
+	if promotion.Amount.Currency == "" {
+		promotion.Amount = money.Zero(currency)
+	}
+	if promotion.MinSubtotal.Currency == "" {
+		promotion.MinSubtotal = money.Zero(currency)
+	}
+	return problems
+}
+
+// validPercent reports whether text is a decimal above 0 and at most 100
+func validPercent(text string) bool {
+	percent, ok := new(big.Rat).SetString(text)
+	return ok && percent.Sign() > 0 && percent.Cmp(big.NewRat(100, 1)) <= 0
+}
+
+func validatePromotion(db *gorm.DB, promotion *Promotion, currency string) (map[string]string, error) {
+	problems := map[string]string{}
+	if promotion.Name == "" {
+		problems["name"] = "must not be empty"
+	}
+	if promotion.Code != nil {
+		if !couponCodePattern.MatchString(*promotion.Code) {
+			problems["code"] = "must be 3 to 32 letters, digits, dashes or underscores"
+		} else {
+			var count int
+			err := db.Model(&Promotion{}).Where("code = ? AND id <> ?", *promotion.Code, promotion.ID).Count(&count).Error
+			if err != nil {
+				return nil, err
+			}
+			if count > 0 {
+				problems["code"] = "is already used by another promotion"
+			}
+		}
+	}
+	switch promotion.Kind {
+	case PromotionPercent:
+		if !validPercent(promotion.Percent) {
+			problems["percent"] = "must be above 0 and at most 100"
+		}
+	case PromotionFixed:
+		if promotion.Amount.Amount <= 0 {
+			problems["amount"] = "must be positive"
+		}
+	case PromotionBuyXGetY:
+		if promotion.Percent == "" {
+			promotion.Percent = "100"
+		}
+		if !validPercent(promotion.Percent) {
+			problems["percent"] = "must be above 0 and at most 100"
+		}
+		if promotion.BuyQuantity < 1 {
+			problems["buy_quantity"] = "must be at least 1"
+		}
+		if promotion.GetQuantity < 1 {
+			problems["get_quantity"] = "must be at least 1"
+		}
+	case PromotionFreeShipping:
+	default:
+		problems["kind"] = "must be percent, fixed, buy_x_get_y or free_shipping"
+	}
+	if _, ok := problems["amount"]; !ok && promotion.Amount.Currency != currency {
+		problems["amount"] = "must be in " + currency
+	}
+	if _, ok := problems["min_subtotal"]; !ok {
+		if promotion.MinSubtotal.Currency != currency {
+			problems["min_subtotal"] = "must be in " + currency
+		} else if promotion.MinSubtotal.IsNegative() {
+			problems["min_subtotal"] = "must not be negative"
+		}
+	}
+	if promotion.StartsAt != nil && promotion.EndsAt != nil && !promotion.EndsAt.After(*promotion.StartsAt) {
+		problems["ends_at"] = "must be after starts_at"
+	}
+	if promotion.UsageLimit != nil && *promotion.UsageLimit < 0 {
+		problems["usage_limit"] = "must not be negative"
+	}
+	if promotion.PerCustomerLimit != nil && *promotion.PerCustomerLimit < 0 {
+		problems["per_customer_limit"] = "must not be negative"
+	}
+	if promotion.CategoryID != nil {
+		var count int
+		if err := db.Model(&Category{}).Where("id = ?", *promotion.CategoryID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			problems["category_id"] = "does not exist"
+		}
+	}
+	return problems, nil
+}
+
+func respondInvalidPromotion(context *fiber.Ctx, problems map[string]string) error {
+	context.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+		"message": "Invalid promotion",
+		"errors":  problems,
+	})
+	return nil
+}
+
+func findPromotion(db *gorm.DB, context *fiber.Ctx) (*Promotion, error) {
+	id, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	promotion := &Promotion{}
+	err = db.Where("id = ?", id).First(promotion).Error
+	return promotion, err
+}
+
+func respondPromotionLookupError(context *fiber.Ctx, err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Promotion not found"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to retrieve promotion"})
+	return err
+}
+
+// countRedemptions counts uses of a promotion by orders that were not
+// cancelled, only those of accountID when it is not zero
+func countRedemptions(db *gorm.DB, promotionID, accountID uint) (int, error) {
+	query := db.Table("promotion_redemptions").
+		Joins("JOIN orders ON orders.id = promotion_redemptions.order_id").
+		Where("promotion_redemptions.promotion_id = ? AND orders.status <> ?", promotionID, OrderCancelled)
+	if accountID != 0 {
+		query = query.Where("promotion_redemptions.account_id = ?", accountID)
+	}
+	var count int
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// checkPromotion reports why a promotion cannot be used at now by
+// accountID. The per-customer limit is only checked for known accounts.
+func checkPromotion(db *gorm.DB, promotion *Promotion, accountID uint, now time.Time) error {
+	if !promotion.Active {
+		return errCouponNotFound
+	}
+	if promotion.StartsAt != nil && now.Before(*promotion.StartsAt) {
+		return errCouponNotStarted
+	}
+	if promotion.EndsAt != nil && !now.Before(*promotion.EndsAt) {
+		return errCouponExpired
+	}
+	if promotion.UsageLimit != nil {
+		used, err := countRedemptions(db, promotion.ID, 0)
+		if err != nil {
+			return err
+		}
+		if used >= *promotion.UsageLimit {
+			return errCouponUsedUp
+		}
+	}
+	if promotion.PerCustomerLimit != nil && accountID != 0 {
+		used, err := countRedemptions(db, promotion.ID, accountID)
+		if err != nil {
+			return err
+		}
+		if used >= *promotion.PerCustomerLimit {
+			return errCouponCustomerUsed
+		}
+	}
+	return nil
+}
+
+// respondCouponError writes the response for a coupon that cannot be used
+func respondCouponError(context *fiber.Ctx, code string, err error) error {
+	switch {
+	case errors.Is(err, errCouponNotFound), gorm.IsRecordNotFoundError(err):
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Coupon not found", "code": code})
+		return nil
+	case isCouponRejection(err):
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Coupon " + code + ": " + err.Error(), "code": code})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to apply coupon"})
+	return err
+}
+
+// Get every promotion
+func (r *Repository) GetPromotions(context *fiber.Ctx) error {
+	promotions := []Promotion{}
+	if err := r.DB.Order("priority, id").Find(&promotions).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve promotions"})
+		return err
+	}
+	return context.JSON(promotions)
+}
+
+// Get a promotion with the number of times it was used
+func (r *Repository) GetPromotion(context *fiber.Ctx) error {
+	promotion, err := findPromotion(r.DB, context)
+	if err != nil {
+		return respondPromotionLookupError(context, err)
+	}
+	used, err := countRedemptions(r.DB, promotion.ID, 0)
+	if err != nil {
+		return respondPromotionLookupError(context, err)
+	}
+	return context.JSON(&fiber.Map{"promotion": promotion, "used": used})
+}
+
+// Create a promotion
+func (r *Repository) CreatePromotion(context *fiber.Ctx) error {
+	request := PromotionRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request: " + err.Error()})
+		return nil
+	}
+	promotion := &Promotion{Active: true}
+	problems := request.apply(promotion, r.Currency)
+	invalid, err := validatePromotion(r.DB, promotion, r.Currency)
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to create promotion"})
+		return err
+	}
+	for field, problem := range invalid {
+		if _, ok := problems[field]; !ok {
+			problems[field] = problem
+		}
+	}
+	if len(problems) > 0 {
+		return respondInvalidPromotion(context, problems)
+	}
+	if err := r.DB.Create(promotion).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to create promotion"})
+		return err
+	}
+	return context.Status(http.StatusCreated).JSON(promotion)
+}
+
+// Change some fields of a promotion
+func (r *Repository) UpdatePromotion(context *fiber.Ctx) error {
+	promotion, err := findPromotion(r.DB, context)
+	if err != nil {
+		return respondPromotionLookupError(context, err)
+	}
+	request := PromotionRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request: " + err.Error()})
+		return nil
+	}
+	problems := request.apply(promotion, r.Currency)
+	invalid, err := validatePromotion(r.DB, promotion, r.Currency)
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to update promotion"})
+		return err
+	}
+	for field, problem := range invalid {
+		if _, ok := problems[field]; !ok {
+			problems[field] = problem
+		}
+	}
+	if len(problems) > 0 {
+		return respondInvalidPromotion(context, problems)
+	}
+	if err := r.DB.Save(promotion).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to update promotion"})
+		return err
+	}
+	return context.JSON(promotion)
+}
+
+// Delete a promotion. Orders keep the discounts it gave.
+func (r *Repository) DeletePromotion(context *fiber.Ctx) error {
+	promotion, err := findPromotion(r.DB, context)
+	if err != nil {
+		return respondPromotionLookupError(context, err)
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("promotion_id = ?", promotion.ID).Delete(&CartCoupon{}).Error; err != nil {
+			return err
+		}
+		// Free the code for reuse; the soft deleted row keeps its name
+		if err := tx.Model(promotion).Update("code", gorm.Expr("NULL")).Error; err != nil {
+			return err
+		}
+		return tx.Delete(promotion).Error
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to delete promotion"})
+		return err
+	}
+	return context.JSON(&fiber.Map{"message": "Promotion deleted"})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+// Role names
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
+// Struct Role
+type Role struct {
+	ID          uint         `json:"id" gorm:"primary_key"`
+	Name        string       `json:"name" gorm:"unique_index;not null"`
+	Permissions []Permission `json:"permissions,omitempty" gorm:"many2many:role_permissions"`
+}
+
+// Struct Permission
+type Permission struct {
+	ID   uint   `json:"id" gorm:"primary_key"`
+	Name string `json:"name" gorm:"unique_index;not null"`
+}
+
+// Struct GrantRoleRequest
+type GrantRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// defaultRolePermissions is seeded on startup. Permissions added here are
+// created if missing; grants made through the database are left alone.
+var defaultRolePermissions = map[string][]string{
+	RoleCustomer: {},
+	RoleStaff: {
+		"products:write",
+		"orders:manage",
+		"categories:manage",
+		"promotions:manage",
+		"shipping:manage",
+		"inventory:manage",
+		"reviews:moderate",
+	},
+	RoleAdmin: {
+		"products:write",
+		"orders:manage",
+		"categories:manage",
+		"promotions:manage",
+		"shipping:manage",
+		"inventory:manage",
+		"reviews:moderate",
+		"products:delete",
+		"accounts:read",
+		"accounts:update",
+		"accounts:delete",
+		"roles:manage",
+	},
+}
+
+// SeedRoles creates the default roles and permissions
+func SeedRoles(db *gorm.DB) error {
+	for roleName, permissionNames := range defaultRolePermissions {
+		role := Role{}
+		if err := db.Where(Role{Name: roleName}).FirstOrCreate(&role).Error; err != nil {
+			return err
+		}
+		for _, permissionName := range permissionNames {
+			permission := Permission{}
+			if err := db.Where(Permission{Name: permissionName}).FirstOrCreate(&permission).Error; err != nil {
+				return err
+			}
+			if err := db.Model(&role).Association("Permissions").Append(&permission).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// grantRole adds a role to an account, ignoring existing grants
+func grantRole(db *gorm.DB, accountID uint, roleName string) error {
+	role := Role{}
+	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return err
+	}
+	return db.Model(&Account{ID: accountID}).Association("Roles").Append(&role).Error
+}
+
+// hasPermission reports whether any of the account's roles grants permission
+func hasPermission(db *gorm.DB, accountID uint, permission string) (bool, error) {
+	var count int
+	err := db.Table("account_roles").
+		Joins("JOIN role_permissions ON role_permissions.role_id = account_roles.role_id").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Where("account_roles.account_id = ? AND permissions.name = ?", accountID, permission).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// RequirePermission only lets through callers whose roles grant permission.
+// It must run after RequireAuth.
+func (r *Repository) RequirePermission(permission string) fiber.Handler {
+	return func(context *fiber.Ctx) error {
+		account := currentAccount(context)
+		if account == nil {
+			context.Status(http.StatusUnauthorized).JSON(
+				&fiber.Map{"message": "Unauthorized"})
+			return nil
+		}
+		allowed, err := hasPermission(r.DB, account.ID, permission)
+		if err != nil {
+			context.Status(http.StatusInternalServerError).JSON(
+				&fiber.Map{"message": "Failed to check permissions"})
+			return err
+		}
+		if !allowed {
+			context.Status(http.StatusForbidden).JSON(
+				&fiber.Map{"message": "Forbidden"})
+			return nil
+		}
+		return context.Next()
+	}
+}
+
+// Get roles of an account (Admin)
+func (r *Repository) GetAccountRoles(context *fiber.Ctx) error {
+	accountID, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid account ID"})
+		return nil
+	}
+	var account Account
+	err = r.DB.Preload("Roles.Permissions").Where("id = ?", accountID).First(&account).Error
+	if err != nil {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "User not found"})
+		return nil
+	}
+	return context.JSON(account.Roles)
+}
+
+// Grant a role to an account (Admin)
+func (r *Repository) GrantRole(context *fiber.Ctx) error {
+	accountID, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid account ID"})
+		return nil
+	}
+	request := GrantRoleRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	var account Account
+	if err := r.DB.Where("id = ?", accountID).First(&account).Error; err != nil {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "User not found"})
+		return nil
+	}
+	err = grantRole(r.DB, account.ID, request.Role)
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Role not found"})
+		return nil
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to grant role"})
+		return err
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Role granted successfully"})
+	return nil
+}
+
+// Revoke a role from an account (Admin)
+func (r *Repository) RevokeRole(context *fiber.Ctx) error {
+	accountID, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid account ID"})
+		return nil
+	}
+	var role Role
+	if err := r.DB.Where("name = ?", context.Params("role")).First(&role).Error; err != nil {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Role not found"})
+		return nil
+	}
+	err = r.DB.Model(&Account{ID: uint(accountID)}).Association("Roles").Delete(&role).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to revoke role"})
+		return err
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Role revoked successfully"})
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Stock hold statuses
+const (
+	HoldActive    = "active"
+	HoldCommitted = "committed"
+	HoldReleased  = "released"
+)
+
+// defaultHoldTTL is how long checkout holds stock when RESERVATION_TTL is
+// not set
+const defaultHoldTTL = 15 * time.Minute
+
+// Struct StockHold
+// Units set aside for a pending order. A hold is active from checkout until
+// the order is paid, when it is committed and taken off the stock, or until
+// it expires or the order is cancelled, when it is released.
+type StockHold struct {
+	ID        uint      `json:"id" gorm:"primary_key"`
+	OrderID   uint      `json:"order_id" gorm:"index;not null"`
+	ProductID uint      `json:"product_id" gorm:"not null"`
+	VariantID uint      `json:"variant_id" gorm:"not null;default:0"`
+	Quantity  int       `json:"quantity" gorm:"not null"`
+	Status    string    `json:"status" gorm:"not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// activeHoldsSQL is the quantity held for the product in the enclosing query
+const activeHoldsSQL = `coalesce((SELECT sum(stock_holds.quantity) FROM stock_holds
+	WHERE stock_holds.product_id = product.id AND stock_holds.status = 'active'), 0)`
+
+// MigrateReservations creates the holds table. Orders placed before holds
+// existed already took their stock, so they get committed holds that are
+// given back if the order is cancelled.
+func MigrateReservations(db *gorm.DB) error {
+	if err := db.AutoMigrate(&StockHold{}).Error; err != nil {
+		return err
+	}
+	err := db.Model(&StockHold{}).
+		AddIndex("idx_stock_holds_product_status", "product_id", "variant_id", "status").Error
+	if err != nil {
+		return err
+	}
+	return db.Exec(`INSERT INTO stock_holds
+			(order_id, product_id, variant_id, quantity, status, expires_at, created_at, updated_at)
+		SELECT order_lines.order_id, order_lines.product_id, order_lines.variant_id, order_lines.quantity,
+			?, orders.created_at, orders.created_at, orders.created_at
+		FROM order_lines JOIN orders ON orders.id = order_lines.order_id
+		WHERE orders.status <> ?
+			AND NOT EXISTS (SELECT 1 FROM stock_holds WHERE stock_holds.order_id = orders.id)`,
+		HoldCommitted, OrderCancelled).Error
+}
+
+// stockKey names a product, or one variant of it
+type stockKey struct {
+	ProductID uint
+	VariantID uint
+}
+
+// heldStock returns the quantities under active holds for the products,
+// per product and per product variant
+func heldStock(db *gorm.DB, productIDs []uint) (map[uint]int, map[stockKey]int, error) {
+	byProduct := map[uint]int{}
+	byItem := map[stockKey]int{}
+	if len(productIDs) == 0 {
+		return byProduct, byItem, nil
+	}
+	var rows []struct {
+		ProductID uint
+		VariantID uint
+		Quantity  int
+	}
+	err := db.Model(&StockHold{}).
+		Select("product_id, variant_id, sum(quantity) AS quantity").
+		Where("product_id IN (?) AND status = ?", productIDs, HoldActive).
+		Group("product_id, variant_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, row := range rows {
+		byProduct[row.ProductID] += row.Quantity
+		byItem[stockKey{row.ProductID, row.VariantID}] = row.Quantity
+	}
+	return byProduct, byItem, nil
+}
+
+// preloadAvailability sets the available-to-sell quantity of the products
+// and their variants: stock on hand less units held by pending orders
+func preloadAvailability(db *gorm.DB, products []*Product) error {
+	ids := make([]uint, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+	}
+	byProduct, byItem, err := heldStock(db, ids)
+	if err != nil {
+		return err
+	}
+	for _, product := range products {
+		product.Available = availableToSell(product.Quantity, byProduct[product.ID])
+		for i := range product.Variants {
+			variant := &product.Variants[i]
+			variant.Available = availableToSell(variant.Quantity, byItem[stockKey{product.ID, variant.ID}])
+		}
+	}
+	return nil
+}
+
+func availableToSell(onHand, held int) int {
+	if onHand < held {
+		return 0
+	}
+	return onHand - held
+}
+
+// placeHolds sets the order's quantities aside until expiresAt
+func placeHolds(tx *gorm.DB, order *Order, expiresAt time.Time) error {
+	for _, line := range order.Lines {
+		hold := StockHold{
+			OrderID:   order.ID,
+			ProductID: line.ProductID,
+			VariantID: line.VariantID,
+			Quantity:  line.Quantity,
+			Status:    HoldActive,
+			ExpiresAt: expiresAt,
+		}
+		if err := tx.Create(&hold).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderHolds locks the order's holds with the given status, in the order
+// products are locked elsewhere
+func orderHolds(tx *gorm.DB, orderID uint, status string) ([]StockHold, error) {
+	var holds []StockHold
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("order_id = ? AND status = ?", orderID, status).
+		Order("product_id, variant_id").
+		Find(&holds).Error
+	return holds, err
+}
+
+// commitHolds takes a paid order's held quantities off the stock
+func commitHolds(tx *gorm.DB, orderID uint) error {
+	holds, err := orderHolds(tx, orderID, HoldActive)
+	if err != nil {
+		return err
+	}
+	for _, hold := range holds {
+		if err := sellStock(tx, orderID, hold.ProductID, hold.VariantID, hold.Quantity); err != nil {
+			return err
+		}
+		if err := tx.Model(&hold).Update("status", HoldCommitted).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseHolds frees the stock of a cancelled order. Active holds simply
+// lapse; committed ones are returned to stock.
+func releaseHolds(tx *gorm.DB, orderID uint) error {
+	committed, err := orderHolds(tx, orderID, HoldCommitted)
+	if err != nil {
+		return err
+	}
+	for _, hold := range committed {
+		if err := returnStock(tx, orderID, hold.ProductID, hold.VariantID, hold.Quantity); err != nil {
+			return err
+		}
+	}
+	return tx.Model(&StockHold{}).
+		Where("order_id = ? AND status IN (?)", orderID, []string{HoldActive, HoldCommitted}).
+		Update("status", HoldReleased).Error
+}
+
+// expireOrder cancels a pending order whose holds have run out and reports
+// whether it did. Orders that were paid or cancelled in the meantime are
+// left alone.
+func expireOrder(tx *gorm.DB, orderID uint) (bool, error) {
+	_, err := transitionOrder(tx, orderID, OrderCancelled, nil, "stock reservation expired")
+	if errors.Is(err, errIllegalTransition) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// sweepReservations cancels the pending orders whose holds expired before
+// now and returns how many it cancelled. Orders that cannot be cancelled
+// are logged and left for the next sweep.
+func sweepReservations(db *gorm.DB, now time.Time) (int, error) {
+	var orderIDs []uint
+	err := db.Model(&StockHold{}).
+		Where("status = ? AND expires_at <= ?", HoldActive, now).
+		Order("order_id").
+		Pluck("DISTINCT order_id", &orderIDs).Error
+	if err != nil {
+		return 0, err
+	}
+	cancelled := 0
+	for _, orderID := range orderIDs {
+		expired := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			expired, err = expireOrder(tx, orderID)
+			return err
+		})
+		if err != nil {
+			log.Printf("reservation sweep: order %d: %v", orderID, err)
+			continue
+		}
+		if expired {
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+// runReservationSweeper releases expired holds every interval until the
+// process exits
+func runReservationSweeper(db *gorm.DB, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if _, err := sweepReservations(db, now); err != nil {
+			log.Printf("reservation sweep: %v", err)
+		}
+	}
+}
+
+// reservationTTL reads RESERVATION_TTL, a duration such as "15m"
+func reservationTTL() (time.Duration, error) {
+	value := os.Getenv("RESERVATION_TTL")
+	if value == "" {
+		return defaultHoldTTL, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("RESERVATION_TTL %q must be a positive duration", value)
+	}
+	return ttl, nil
+}
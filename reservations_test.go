@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSweepReservations(t *testing.T) {
+	db := testDB(t)
+	if err := db.AutoMigrate(&Order{}, &OrderHistory{}, &StockHold{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		name      string
+		status    string
+		expiresAt time.Time
+		order     string
+		hold      string
+	}{
+		{"expired", OrderPending, now.Add(-time.Minute), OrderCancelled, HoldReleased},
+		{"expires now", OrderPending, now, OrderCancelled, HoldReleased},
+		{"still held", OrderPending, now.Add(time.Minute), OrderPending, HoldActive},
+		// Paid just before the sweep reached it: not cancelled, not counted
+		{"paid meanwhile", OrderPaid, now.Add(-time.Minute), OrderPaid, HoldActive},
+	}
+	orders := make([]Order, len(tests))
+	for i, test := range tests {
+		orders[i] = Order{AccountID: 1, Status: test.status}
+		if err := db.Create(&orders[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+		hold := StockHold{OrderID: orders[i].ID, ProductID: 1, Quantity: 1, Status: HoldActive, ExpiresAt: test.expiresAt}
+		if err := db.Create(&hold).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancelled, err := sweepReservations(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled != 2 {
+		t.Errorf("sweepReservations cancelled %d orders, want 2", cancelled)
+	}
+	for i, test := range tests {
+		order := Order{}
+		if err := db.Where("id = ?", orders[i].ID).First(&order).Error; err != nil {
+			t.Fatal(err)
+		}
+		hold := StockHold{}
+		if err := db.Where("order_id = ?", orders[i].ID).First(&hold).Error; err != nil {
+			t.Fatal(err)
+		}
+		if order.Status != test.order || hold.Status != test.hold {
+			t.Errorf("%s: order %s with hold %s, want %s with %s", test.name, order.Status, hold.Status, test.order, test.hold)
+		}
+	}
+
+	// A second sweep finds nothing left to cancel
+	if cancelled, err := sweepReservations(db, now); err != nil || cancelled != 0 {
+		t.Errorf("second sweep cancelled %d, %v; want 0", cancelled, err)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+// Review moderation statuses
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+const (
+	maxReviewTitle = 150
+	maxReviewBody  = 5000
+)
+
+var (
+	errReviewNotFound = errors.New("review not found")
+	errOwnReview      = errors.New("cannot vote on own review")
+)
+
+// Struct Review
+// One review per account and product. New and edited reviews wait for a
+// moderator before they are shown. VerifiedPurchase is set when the
+// reviewer has a delivered order containing the product.
+type Review struct {
+	ID               uint       `json:"id" gorm:"primary_key"`
+	ProductID        uint       `json:"product_id" gorm:"unique_index:idx_reviews_product_account;not null"`
+	AccountID        uint       `json:"account_id" gorm:"unique_index:idx_reviews_product_account;not null"`
+	AuthorName       string     `json:"author_name" gorm:"-"`
+	Rating           int        `json:"rating" gorm:"not null"`
+	Title            string     `json:"title"`
+	Body             string     `json:"body"`
+	VerifiedPurchase bool       `json:"verified_purchase" gorm:"not null;default:false"`
+	Status           string     `json:"status" gorm:"index;not null"`
+	ModerationNote   string     `json:"-"`
+	ModeratedBy      *uint      `json:"-"`
+	ModeratedAt      *time.Time `json:"moderated_at,omitempty"`
+	HelpfulCount     int        `json:"helpful_count" gorm:"not null;default:0"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// Struct ModeratedReview
+// A review as moderators see it, with who moderated it and why.
+type ModeratedReview struct {
+	Review
+	ModerationNote string `json:"moderation_note,omitempty"`
+	ModeratedBy    *uint  `json:"moderated_by,omitempty"`
+}
+
+func moderatedView(review Review) ModeratedReview {
+	return ModeratedReview{Review: review, ModerationNote: review.ModerationNote, ModeratedBy: review.ModeratedBy}
+}
+
+// Struct ReviewVote
+// An account marking a review as helpful, at most once.
+type ReviewVote struct {
+	ReviewID  uint `gorm:"primary_key;auto_increment:false"`
+	AccountID uint `gorm:"primary_key;auto_increment:false"`
+	CreatedAt time.Time
+}
+
+// Struct ProductRating
+// Aggregates of a product's approved reviews. Histogram counts reviews by
+// star rating, "1" to "5".
+type ProductRating struct {
+	Average   float64        `json:"average"`
+	Count     int            `json:"count"`
+	Histogram map[string]int `json:"histogram"`
+}
+
+// Struct ReviewRequest
+type ReviewRequest struct {
+	Rating *int    `json:"rating"`
+	Title  *string `json:"title"`
+	Body   *string `json:"body"`
+}
+
+// Struct ModerateReviewRequest
+type ModerateReviewRequest struct {
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+// MigrateReviews creates the review tables
+func MigrateReviews(db *gorm.DB) error {
+	return db.AutoMigrate(&Review{}, &ReviewVote{}).Error
+}
+
+// apply copies the fields present in the request onto review and returns
+// any problems
+func (request *ReviewRequest) apply(review *Review) map[string]string {
+	problems := map[string]string{}
+	if request.Rating != nil {
+		review.Rating = *request.Rating
+	}
+	if request.Title != nil {
+		review.Title = strings.TrimSpace(*request.Title)
+	}
+	if request.Body != nil {
+		review.Body = strings.TrimSpace(*request.Body)
+	}
+	if review.Rating < 1 || review.Rating > 5 {
+		problems["rating"] = "must be from 1 to 5"
+	}
+	if len(review.Title) > maxReviewTitle {
+		problems["title"] = "must be at most " + strconv.Itoa(maxReviewTitle) + " characters"
+	}
+	if len(review.Body) > maxReviewBody {
+		problems["body"] = "must be at most " + strconv.Itoa(maxReviewBody) + " characters"
+	}
+	return problems
+}
+
+// verifiedPurchase reports whether the account has received the product
+func verifiedPurchase(db *gorm.DB, accountID, productID uint) (bool, error) {
+	var count int
+	err := db.Table("order_lines").
+		Joins("JOIN orders ON orders.id = order_lines.order_id").
+		Where("orders.account_id = ? AND orders.status = ? AND order_lines.product_id = ?",
+			accountID, OrderDelivered, productID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// preloadRatings sets the rating aggregates of the products
+func preloadRatings(db *gorm.DB, products []*Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(products))
+	byID := map[uint]*Product{}
+	for i, product := range products {
+		ids[i] = product.ID
+		byID[product.ID] = product
+		product.Rating = &ProductRating{Histogram: map[string]int{"1": 0, "2": 0, "3": 0, "4": 0, "5": 0}}
+	}
+	var rows []struct {
+		ProductID uint
+		Rating    int
+		Count     int
+	}
+	err := db.Model(&Review{}).
+		Select("product_id, rating, count(*) AS count").
+		Where("product_id IN (?) AND status = ?", ids, ReviewApproved).
+		Group("product_id, rating").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	totals := map[uint]int{}
+	for _, row := range rows {
+		rating := byID[row.ProductID].Rating
+		rating.Histogram[strconv.Itoa(row.Rating)] = row.Count
+		rating.Count += row.Count
+		totals[row.ProductID] += row.Rating * row.Count
+	}
+	for id, total := range totals {
+		rating := byID[id].Rating
+		rating.Average = math.Round(float64(total)/float64(rating.Count)*100) / 100
+	}
+	return nil
+}
+
+// preloadAuthors fills in the names of the reviewers
+func preloadAuthors(db *gorm.DB, reviews []Review) error {
+	if len(reviews) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(reviews))
+	for i, review := range reviews {
+		ids[i] = review.AccountID
+	}
+	var accounts []Account
+	if err := db.Select("id, fullname").Where("id IN (?)", ids).Find(&accounts).Error; err != nil {
+		return err
+	}
+	names := map[uint]string{}
+	for _, account := range accounts {
+		names[account.ID] = account.Fullname
+	}
+	for i := range reviews {
+		reviews[i].AuthorName = names[reviews[i].AccountID]
+	}
+	return nil
+}
+
+func respondInvalidReview(context *fiber.Ctx, problems map[string]string) error {
+	context.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+		"message": "Invalid review",
+		"errors":  problems,
+	})
+	return nil
+}
+
+func respondReviewLookupError(context *fiber.Ctx, err error) error {
+	if gorm.IsRecordNotFoundError(err) || errors.Is(err, errReviewNotFound) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Review not found"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to retrieve review"})
+	return err
+}
+
+// findReview loads the review named by the :id route parameter. Reviews
+// that are not approved are only visible to their author and moderators.
+func (r *Repository) findReview(context *fiber.Ctx) (*Review, error) {
+	id, err := parseIDParam(context, "id")
+	if err != nil {
+		return nil, err
+	}
+	review := &Review{}
+	if err := r.DB.Where("id = ?", id).First(review).Error; err != nil {
+		return nil, err
+	}
+	if review.Status == ReviewApproved {
+		return review, nil
+	}
+	account := currentAccount(context)
+	if account != nil && account.ID == review.AccountID {
+		return review, nil
+	}
+	if account != nil {
+		moderator, err := hasPermission(r.DB, account.ID, "reviews:moderate")
+		if err != nil || moderator {
+			return review, err
+		}
+	}
+	return nil, errReviewNotFound
+}
+
+// List the approved reviews of a product. sort is newest (default),
+// helpful, highest or lowest; pages use limit and offset.
+func (r *Repository) GetProductReviews(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	orders := map[string]string{
+		"newest":  "created_at DESC, id DESC",
+		"helpful": "helpful_count DESC, created_at DESC, id DESC",
+		"highest": "rating DESC, created_at DESC, id DESC",
+		"lowest":  "rating, created_at DESC, id DESC",
+	}
+	order, ok := orders[context.Query("sort", "newest")]
+	if !ok {
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "Invalid query: sort"})
+		return nil
+	}
+	limit, err := strconv.Atoi(context.Query("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 {
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "Invalid query: limit"})
+		return nil
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	offset, err := strconv.Atoi(context.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "Invalid query: offset"})
+		return nil
+	}
+	query := r.DB.Where("product_id = ? AND status = ?", product.ID, ReviewApproved)
+	if context.Query("verified") == "true" {
+		query = query.Where("verified_purchase = ?", true)
+	}
+	reviews := []Review{}
+	if err := query.Order(order).Limit(limit).Offset(offset).Find(&reviews).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve reviews"})
+		return err
+	}
+	if err := preloadAuthors(r.DB, reviews); err != nil {
+		return err
+	}
+	if err := preloadRatings(r.DB, []*Product{product}); err != nil {
+		return err
+	}
+	return context.JSON(fiber.Map{"rating": product.Rating, "reviews": reviews})
+}
+
+// Review a product. Each account may review a product once.
+func (r *Repository) CreateReview(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	request := ReviewRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	account := currentAccount(context)
+	review := &Review{ProductID: product.ID, AccountID: account.ID, Status: ReviewPending}
+	if problems := request.apply(review); len(problems) > 0 {
+		return respondInvalidReview(context, problems)
+	}
+	review.VerifiedPurchase, err = verifiedPurchase(r.DB, account.ID, product.ID)
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to create review"})
+		return err
+	}
+	// The unique index settles concurrent submissions
+	inserted := r.DB.Exec(`INSERT INTO reviews
+			(product_id, account_id, rating, title, body, verified_purchase, status, helpful_count, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, now(), now())
+		ON CONFLICT (product_id, account_id) DO NOTHING`,
+		review.ProductID, review.AccountID, review.Rating, review.Title, review.Body,
+		review.VerifiedPurchase, review.Status)
+	if inserted.Error != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to create review"})
+		return inserted.Error
+	}
+	if inserted.RowsAffected == 0 {
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "You have already reviewed this product"})
+		return nil
+	}
+	err = r.DB.Where("product_id = ? AND account_id = ?", product.ID, account.ID).First(review).Error
+	if err != nil {
+		return respondReviewLookupError(context, err)
+	}
+	review.AuthorName = account.Fullname
+	return context.Status(http.StatusCreated).JSON(review)
+}
+
+// Edit one of the caller's reviews. The edit goes back to moderation.
+func (r *Repository) UpdateReview(context *fiber.Ctx) error {
+	review, err := r.findReview(context)
+	account := currentAccount(context)
+	if err == nil && review.AccountID != account.ID {
+		err = errReviewNotFound
+	}
+	if err != nil {
+		return respondReviewLookupError(context, err)
+	}
+	request := ReviewRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	if problems := request.apply(review); len(problems) > 0 {
+		return respondInvalidReview(context, problems)
+	}
+	review.VerifiedPurchase, err = verifiedPurchase(r.DB, account.ID, review.ProductID)
+	// Only the edited columns are written so votes cast meanwhile are kept
+	if err == nil {
+		err = r.DB.Model(review).Updates(map[string]interface{}{
+			"rating":            review.Rating,
+			"title":             review.Title,
+			"body":              review.Body,
+			"verified_purchase": review.VerifiedPurchase,
+			"status":            ReviewPending,
+			"moderation_note":   "",
+			"moderated_by":      nil,
+			"moderated_at":      nil,
+		}).Error
+	}
+	if err == nil {
+		err = r.DB.Where("id = ?", review.ID).First(review).Error
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to update review"})
+		return err
+	}
+	review.AuthorName = account.Fullname
+	return context.JSON(review)
+}
+
+// Delete a review: the author's own, or any review for moderators
+func (r *Repository) DeleteReview(context *fiber.Ctx) error {
+	review, err := r.findReview(context)
+	if err != nil {
+		return respondReviewLookupError(context, err)
+	}
+	account := currentAccount(context)
+	if review.AccountID != account.ID {
+		moderator, err := hasPermission(r.DB, account.ID, "reviews:moderate")
+		if err != nil {
+			return respondReviewLookupError(context, err)
+		}
+		if !moderator {
+			context.Status(http.StatusForbidden).JSON(
+				&fiber.Map{"message": "Forbidden"})
+			return nil
+		}
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("review_id = ?", review.ID).Delete(&ReviewVote{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(review).Error
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to delete review"})
+		return err
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Review deleted successfully"})
+	return nil
+}
+
+// setHelpfulVote adds or removes the caller's helpful vote and keeps the
+// review's count in step
+func (r *Repository) setHelpfulVote(context *fiber.Ctx, helpful bool) error {
+	review, err := r.findReview(context)
+	if err == nil && review.Status != ReviewApproved {
+		err = errReviewNotFound
+	}
+	if err != nil {
+		return respondReviewLookupError(context, err)
+	}
+	account := currentAccount(context)
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if review.AccountID == account.ID {
+			return errOwnReview
+		}
+		var changed *gorm.DB
+		delta := 1
+		if helpful {
+			changed = tx.Exec(`INSERT INTO review_votes (review_id, account_id, created_at)
+				VALUES (?, ?, now()) ON CONFLICT DO NOTHING`, review.ID, account.ID)
+		} else {
+			delta = -1
+			changed = tx.Where("review_id = ? AND account_id = ?", review.ID, account.ID).Delete(&ReviewVote{})
+		}
+		if changed.Error != nil || changed.RowsAffected == 0 {
+			return changed.Error
+		}
+		return tx.Model(review).UpdateColumn("helpful_count", gorm.Expr("helpful_count + ?", delta)).Error
+	})
+	if errors.Is(err, errOwnReview) {
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "You cannot vote on your own review"})
+		return nil
+	}
+	if err == nil {
+		err = r.DB.Where("id = ?", review.ID).First(review).Error
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to record vote"})
+		return err
+	}
+	return context.JSON(fiber.Map{"id": review.ID, "helpful_count": review.HelpfulCount, "voted": helpful})
+}
+
+// Mark a review as helpful
+func (r *Repository) VoteReviewHelpful(context *fiber.Ctx) error {
+	return r.setHelpfulVote(context, true)
+}
+
+// Take back a helpful vote
+func (r *Repository) UnvoteReviewHelpful(context *fiber.Ctx) error {
+	return r.setHelpfulVote(context, false)
+}
+
+// List reviews for moderation; status is pending (default), approved,
+// rejected or all (Staff)
+func (r *Repository) GetReviewsForModeration(context *fiber.Ctx) error {
+	query := r.DB.Order("created_at, id")
+	switch status := context.Query("status", ReviewPending); status {
+	case ReviewPending, ReviewApproved, ReviewRejected:
+		query = query.Where("status = ?", status)
+	case "all":
+	default:
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "Invalid query: status"})
+		return nil
+	}
+	if productID := context.Query("product_id"); productID != "" {
+		query = query.Where("product_id = ?", productID)
+	}
+	reviews := []Review{}
+	if err := query.Limit(maxPageSize).Find(&reviews).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve reviews"})
+		return err
+	}
+	if err := preloadAuthors(r.DB, reviews); err != nil {
+		return err
+	}
+	views := make([]ModeratedReview, len(reviews))
+	for i, review := range reviews {
+		views[i] = moderatedView(review)
+	}
+	return context.JSON(views)
+}
+
+// Approve or reject a review (Staff)
+func (r *Repository) ModerateReview(context *fiber.Ctx) error {
+	review, err := r.findReview(context)
+	if err != nil {
+		return respondReviewLookupError(context, err)
+	}
+	request := ModerateReviewRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	if request.Status != ReviewApproved && request.Status != ReviewRejected && request.Status != ReviewPending {
+		return respondInvalidReview(context, map[string]string{
+			"status": "must be approved, rejected or pending",
+		})
+	}
+	account := currentAccount(context)
+	now := time.Now()
+	err = r.DB.Model(review).Updates(map[string]interface{}{
+		"status":          request.Status,
+		"moderation_note": strings.TrimSpace(request.Note),
+		"moderated_by":    account.ID,
+		"moderated_at":    now,
+	}).Error
+	if err == nil {
+		err = r.DB.Where("id = ?", review.ID).First(review).Error
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to moderate review"})
+		return err
+	}
+	return context.JSON(moderatedView(*review))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+// Typo tolerance: titles this similar to the query match even when no
+// word matches exactly
+const searchSimilarityThreshold = 0.4
+
+var searchWord = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// Struct SearchHit
+type SearchHit struct {
+	Product
+	Rank float64 `json:"rank"`
+	// The highlights are HTML: the product text is escaped and the matched
+	// words are wrapped in <mark> tags
+	TitleHighlight       string `json:"title_highlight"`
+	DescriptionHighlight string `json:"description_highlight"`
+}
+
+// Struct FacetCount
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Struct SearchResponse
+type SearchResponse struct {
+	Data   []SearchHit             `json:"data"`
+	Total  int                     `json:"total"`
+	Facets map[string][]FacetCount `json:"facets"`
+}
+
+// MigrateProductSearch adds the weighted search vector (title A,
+// description B), the trigger that keeps it current, and the GIN indexes
+// for full-text and trigram matching
+func MigrateProductSearch(db *gorm.DB) error {
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`ALTER TABLE product ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+		`CREATE OR REPLACE FUNCTION product_search_vector_update() RETURNS trigger AS $$
+		BEGIN
+			NEW.search_vector :=
+				setweight(to_tsvector('english', coalesce(NEW.title, '')), 'A') ||
+				setweight(to_tsvector('english', coalesce(NEW.description, '')), 'B');
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS product_search_vector_trigger ON product`,
+		`CREATE TRIGGER product_search_vector_trigger
+			BEFORE INSERT OR UPDATE OF title, description ON product
+			FOR EACH ROW EXECUTE PROCEDURE product_search_vector_update()`,
+		`UPDATE product SET search_vector =
+			setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+			setweight(to_tsvector('english', coalesce(description, '')), 'B')
+		WHERE search_vector IS NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_product_search_vector ON product USING GIN (search_vector)`,
+		`CREATE INDEX IF NOT EXISTS idx_product_title_trgm ON product USING GIN (title gin_trgm_ops)`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapedHTMLSQL is the SQL expression for column with the characters
+// that are special in HTML escaped, so highlights can be rendered as HTML
+func escapedHTMLSQL(column string) string {
+	escaped := column
+	for _, entity := range [][2]string{{"&", "&amp;"}, {"<", "&lt;"}, {">", "&gt;"}, {`"`, "&quot;"}, {"'", "&#39;"}} {
+		escaped = "replace(" + escaped + ", '" + strings.Replace(entity[0], "'", "''", -1) + "', '" + entity[1] + "')"
+	}
+	return escaped
+}
+
+// prefixQuery turns free text into a tsquery where every word must match
+// as a prefix, e.g. "red sho" becomes "red:* & sho:*"
+func prefixQuery(text string) string {
+	words := searchWord.FindAllString(strings.ToLower(text), -1)
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// Search products
+func (r *Repository) SearchProducts(context *fiber.Ctx) error {
+	text := strings.TrimSpace(context.Query("q"))
+	tsquery := prefixQuery(text)
+	if tsquery == "" {
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "q must contain at least one word"})
+		return nil
+	}
+	limit, err := strconv.Atoi(context.Query("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	offset, err := strconv.Atoi(context.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	// matchesWith builds the FROM and WHERE clauses shared by every query,
+	// with optional joins for the facets. The <% operator, unlike calling
+	// word_similarity, can use the trigram index on the title.
+	matchesWith := func(joins string) string {
+		return `FROM product ` + joins + `, (SELECT to_tsquery('english', ?) AS query) q
+		WHERE product.deleted_at IS NULL
+		AND (product.search_vector @@ q.query OR ? <% product.title)`
+	}
+	matches := matchesWith("")
+	args := []interface{}{tsquery, text}
+
+	// Categories are counted under their top-level ancestor
+	facets := map[string]struct{ joins, expression string }{
+		"category": {
+			`LEFT JOIN product_categories ON product_categories.product_id = product.id
+			LEFT JOIN categories ON categories.id = product_categories.category_id
+			LEFT JOIN categories AS top ON top.path = '/' || split_part(categories.path, '/', 2) || '/'`,
+			`coalesce(top.slug, 'uncategorized')`,
+		},
+		"in_stock": {"", `CASE WHEN product.quantity > ` + activeHoldsSQL + ` THEN 'true' ELSE 'false' END`},
+	}
+
+	response := SearchResponse{Data: []SearchHit{}, Facets: map[string][]FacetCount{}}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		// <% compares against this setting, which only lasts for the
+		// transaction
+		err := tx.Exec(`SELECT set_config('pg_trgm.word_similarity_threshold', ?, true)`,
+			strconv.FormatFloat(searchSimilarityThreshold, 'f', -1, 64)).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Raw(`SELECT product.*,
+				ts_rank_cd(product.search_vector, q.query) + word_similarity(?, product.title) AS rank,
+				ts_headline('english', `+escapedHTMLSQL("product.title")+`, q.query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true') AS title_highlight,
+				ts_headline('english', `+escapedHTMLSQL("coalesce(product.description, '')")+`, q.query, 'StartSel=<mark>, StopSel=</mark>, MaxWords=35, MinWords=15') AS description_highlight
+			`+matches+`
+			ORDER BY rank DESC, product.id
+			LIMIT ? OFFSET ?`,
+			append(append([]interface{}{text}, args...), limit, offset)...).
+			Scan(&response.Data).Error
+		if err != nil {
+			return err
+		}
+
+		var total struct{ Count int }
+		if err := tx.Raw(`SELECT count(*) AS count `+matches, args...).Scan(&total).Error; err != nil {
+			return err
+		}
+		response.Total = total.Count
+
+		for name, facet := range facets {
+			counts := []FacetCount{}
+			err := tx.Raw(`SELECT `+facet.expression+` AS value, count(DISTINCT product.id) AS count `+matchesWith(facet.joins)+`
+				GROUP BY value ORDER BY count DESC, value`, args...).
+				Scan(&counts).Error
+			if err != nil {
+				return err
+			}
+			response.Facets[name] = counts
+		}
+		return nil
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to search products"})
+		return err
+	}
+	products := make([]*Product, len(response.Data))
+	for i := range response.Data {
+		products[i] = &response.Data[i].Product
+	}
+	if err := r.preloadProducts(context, products); err != nil {
+		return err
+	}
+	return context.JSON(response)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+// Struct RefreshToken
+// Every refresh token issued from one login shares a FamilyID. Tokens are
+// single use: presenting a token that was already rotated revokes the family.
+type RefreshToken struct {
+	ID        uint      `gorm:"primary_key"`
+	FamilyID  string    `gorm:"index;not null"`
+	AccountID uint      `gorm:"index;not null"`
+	TokenHash string    `gorm:"unique_index;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// Struct TokenResponse
+type TokenResponse struct {
+	Message      string `json:"message,omitempty"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Struct RefreshRequest
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+const accountLocalsKey = "account"
+
+func randomToken(size int) string {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates an access token and a refresh token in the given family
+func (r *Repository) issueTokens(db *gorm.DB, accountID uint, familyID string) (*TokenResponse, error) {
+	now := time.Now()
+	accessToken, err := r.Tokens.Sign(accountID, now)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken := randomToken(32)
+	err = db.Create(&RefreshToken{
+		FamilyID:  familyID,
+		AccountID: accountID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: now.Add(r.Tokens.RefreshTTL),
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(r.Tokens.AccessTTL.Seconds()),
+	}, nil
+}
+
+func revokeFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// Rotate refresh token
+func (r *Repository) RefreshSession(context *fiber.Ctx) error {
+	request := RefreshRequest{}
+	if err := context.BodyParser(&request); err != nil || request.RefreshToken == "" {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "invalid request"})
+		return nil
+	}
+	var response *TokenResponse
+	reused := false
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		var stored RefreshToken
+		err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("token_hash = ?", hashToken(request.RefreshToken)).
+			First(&stored).Error
+		if err != nil {
+			return err
+		}
+		if stored.UsedAt != nil || stored.RevokedAt != nil {
+			// A rotated token came back: assume it was stolen
+			reused = true
+			return revokeFamily(tx, stored.FamilyID)
+		}
+		if time.Now().After(stored.ExpiresAt) {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Model(&stored).Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		response, err = r.issueTokens(tx, stored.AccountID, stored.FamilyID)
+		return err
+	})
+	if gorm.IsRecordNotFoundError(err) || (err == nil && reused) {
+		context.Status(http.StatusUnauthorized).JSON(
+			&fiber.Map{"message": "Invalid or expired refresh token"})
+		return nil
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to refresh session"})
+		return err
+	}
+	return context.JSON(response)
+}
+
+// Log out: revokes every refresh token issued from the same login
+func (r *Repository) Logout(context *fiber.Ctx) error {
+	request := RefreshRequest{}
+	if err := context.BodyParser(&request); err != nil || request.RefreshToken == "" {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "invalid request"})
+		return nil
+	}
+	var stored RefreshToken
+	err := r.DB.Where("token_hash = ?", hashToken(request.RefreshToken)).First(&stored).Error
+	if err == nil {
+		err = revokeFamily(r.DB, stored.FamilyID)
+	}
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to log out"})
+		return err
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Logged out"})
+	return nil
+}
+
+// authenticate resolves the bearer token on the request, if any
+func (r *Repository) authenticate(context *fiber.Ctx) (*Account, error) {
+	header := context.Get(fiber.HeaderAuthorization)
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, errInvalidToken
+	}
+	claims, err := r.Tokens.Parse(strings.TrimPrefix(header, "Bearer "), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	account := &Account{}
+	if err := r.DB.Where("id = ?", claims.Subject).First(account).Error; err != nil {
+		return nil, errInvalidToken
+	}
+	return account, nil
+}
+
+// RequireAuth rejects requests without a valid access token and stores
+// the caller's Account in the context locals
+func (r *Repository) RequireAuth(context *fiber.Ctx) error {
+	account, err := r.authenticate(context)
+	if err != nil {
+		context.Status(http.StatusUnauthorized).JSON(
+			&fiber.Map{"message": "Unauthorized"})
+		return nil
+	}
+	context.Locals(accountLocalsKey, account)
+	return context.Next()
+}
+
+// currentAccount returns the account stored by RequireAuth
+func currentAccount(context *fiber.Ctx) *Account {
+	account, _ := context.Locals(accountLocalsKey).(*Account)
+	return account
+}
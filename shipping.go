@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+// Shipping method kinds
+const (
+	ShippingFlat    = "flat"
+	ShippingWeight  = "weight"
+	ShippingPrice   = "price"
+	ShippingCarrier = "carrier"
+)
+
+var (
+	errShippingUnavailable    = errors.New("no shipping method is available for this address")
+	errShippingMethodRequired = errors.New("shipping_method_id is required")
+)
+
+// Struct ShippingZone
+// A zone groups the destinations that share shipping methods. When several
+// zones cover an address the one with the most specific area wins.
+type ShippingZone struct {
+	ID        uint               `json:"id" gorm:"primary_key"`
+	Name      string             `json:"name" gorm:"not null"`
+	Areas     []ShippingZoneArea `json:"areas"`
+	Methods   []ShippingMethod   `json:"methods"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// Struct ShippingZoneArea
+// Empty Region and PostalPrefix cover the whole country.
+type ShippingZoneArea struct {
+	ID           uint   `json:"id" gorm:"primary_key"`
+	ZoneID       uint   `json:"-" gorm:"index;not null"`
+	Country      string `json:"country" gorm:"not null"`
+	Region       string `json:"region"`
+	PostalPrefix string `json:"postal_prefix"`
+}
+
+// Struct ShippingMethod
+// Flat methods charge Rate. Weight and price methods charge the rate of the
+// highest tier whose From the shipment's weight in grams, or discounted
+// subtotal in minor units, reaches. Carrier methods ask the carrier for
+// Service. Any method is free once the discounted subtotal reaches
+// FreeOver, when it is set. Amounts are in the store currency.
+type ShippingMethod struct {
+	ID        uint               `json:"id" gorm:"primary_key"`
+	ZoneID    uint               `json:"zone_id" gorm:"index;not null"`
+	Name      string             `json:"name" gorm:"not null"`
+	Kind      string             `json:"kind" gorm:"not null"`
+	Rate      money.Money        `json:"rate" gorm:"embedded;embedded_prefix:rate_"`
+	Tiers     []ShippingRateTier `json:"tiers,omitempty"`
+	FreeOver  *money.Money       `json:"free_over" gorm:"-"`
+	Service   string             `json:"service,omitempty"`
+	Position  int                `json:"position"`
+	Active    bool               `json:"active" gorm:"not null"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+
+	FreeOverAmount   *int64  `json:"-"`
+	FreeOverCurrency *string `json:"-" gorm:"type:char(3)"`
+}
+
+// AfterFind fills FreeOver from its nullable columns
+func (method *ShippingMethod) AfterFind() error {
+	method.FreeOver = nil
+	if method.FreeOverAmount != nil && method.FreeOverCurrency != nil {
+		threshold := money.New(*method.FreeOverAmount, *method.FreeOverCurrency)
+		method.FreeOver = &threshold
+	}
+	return nil
+}
+
+// BeforeSave stores FreeOver in its nullable columns
+func (method *ShippingMethod) BeforeSave() error {
+	method.FreeOverAmount, method.FreeOverCurrency = nil, nil
+	if method.FreeOver != nil {
+		amount, currency := method.FreeOver.Amount, method.FreeOver.Currency
+		method.FreeOverAmount, method.FreeOverCurrency = &amount, &currency
+	}
+	return nil
+}
+
+// Struct ShippingRateTier
+type ShippingRateTier struct {
+	ID       uint        `json:"-" gorm:"primary_key"`
+	MethodID uint        `json:"-" gorm:"index;not null"`
+	From     int64       `json:"from"`
+	Rate     money.Money `json:"rate" gorm:"embedded;embedded_prefix:rate_"`
+}
+
+// Struct ShippingZoneRequest
+// Areas, when present, replace the zone's areas.
+type ShippingZoneRequest struct {
+	Name  *string             `json:"name"`
+	Areas *[]ShippingZoneArea `json:"areas"`
+}
+
+// Struct ShippingMethodRequest
+// Tiers, when present, replace the method's tiers. A free_over of null
+// removes the threshold.
+type ShippingMethodRequest struct {
+	Name     *string                `json:"name"`
+	Kind     *string                `json:"kind"`
+	Rate     *money.Input           `json:"rate"`
+	Tiers    *[]ShippingTierRequest `json:"tiers"`
+	FreeOver optionalMoneyInput     `json:"free_over"`
+	Service  *string                `json:"service"`
+	Position *int                   `json:"position"`
+	Active   *bool                  `json:"active"`
+}
+
+// Struct ShippingTierRequest
+type ShippingTierRequest struct {
+	From int64       `json:"from"`
+	Rate money.Input `json:"rate"`
+}
+
+// optionalMoneyInput tells an absent amount from an explicit null
+type optionalMoneyInput struct {
+	Set   bool
+	Input *money.Input
+}
+
+func (o *optionalMoneyInput) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if strings.TrimSpace(string(data)) == "null" {
+		return nil
+	}
+	o.Input = &money.Input{}
+	return o.Input.UnmarshalJSON(data)
+}
+
+// ShippingQuote is the price of a shipping method for a cart. BaseRate is
+// Rate in the store currency.
+type ShippingQuote struct {
+	MethodID      uint        `json:"method_id"`
+	Name          string      `json:"name"`
+	Kind          string      `json:"kind"`
+	Rate          money.Money `json:"rate"`
+	Free          bool        `json:"free"`
+	EstimatedDays int         `json:"estimated_days,omitempty"`
+	BaseRate      money.Money `json:"-"`
+}
+
+// shipment is what shipping is priced on. Subtotal is after discounts,
+// in the currency quotes are shown in.
+type shipment struct {
+	Destination  TaxAddress
+	Parcels      []Parcel
+	Subtotal     money.Money
+	FreeShipping bool
+}
+
+func (s *shipment) weight() int64 {
+	var grams int64
+	for _, parcel := range s.Parcels {
+		grams += int64(parcel.WeightGrams)
+	}
+	return grams
+}
+
+// MigrateShipping creates the shipping tables and gives orders placed
+// before shipping existed a zero shipping charge
+func MigrateShipping(db *gorm.DB) error {
+	err := db.AutoMigrate(&ShippingZone{}, &ShippingZoneArea{}, &ShippingMethod{}, &ShippingRateTier{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec(`UPDATE orders SET shipping_total_currency = total_currency
+		WHERE shipping_total_currency IS NULL`).Error
+}
+
+// zoneFor returns the zone that covers address, or nil
+func zoneFor(db *gorm.DB, address TaxAddress) (*ShippingZone, error) {
+	var areas []ShippingZoneArea
+	if err := db.Where("country = ?", address.Country).Order("zone_id, id").Find(&areas).Error; err != nil {
+		return nil, err
+	}
+	var zoneID uint
+	best := -1
+	for _, area := range areas {
+		if ok, specificity := address.within(area.Country, area.Region, area.PostalPrefix); ok && specificity > best {
+			zoneID, best = area.ZoneID, specificity
+		}
+	}
+	if best < 0 {
+		return nil, nil
+	}
+	zone := &ShippingZone{}
+	err := db.Preload("Methods", func(db *gorm.DB) *gorm.DB {
+		return db.Where("active = ?", true).Order("position, id")
+	}).Preload("Methods.Tiers").Where("id = ?", zoneID).First(zone).Error
+	return zone, err
+}
+
+// shippingConfigured reports whether any shipping method exists. Until one
+// does, checkout does not ask for shipping.
+func shippingConfigured(db *gorm.DB) (bool, error) {
+	var count int
+	err := db.Model(&ShippingMethod{}).Where("active = ?", true).Count(&count).Error
+	return count > 0, err
+}
+
+// quoteShipping prices every method of the zone covering the shipment's
+// destination, cheapest first. convert turns store currency amounts into
+// the currency of the shipment's subtotal. Carrier methods the carrier
+// cannot serve are left out.
+func (r *Repository) quoteShipping(ctx context.Context, db *gorm.DB, s *shipment,
+	convert func(money.Money) (money.Money, error)) ([]ShippingQuote, error) {
+	quotes := []ShippingQuote{}
+	zone, err := zoneFor(db, s.Destination)
+	if err != nil || zone == nil {
+		return quotes, err
+	}
+	for _, method := range zone.Methods {
+		quote := ShippingQuote{MethodID: method.ID, Name: method.Name, Kind: method.Kind}
+		switch method.Kind {
+		case ShippingFlat:
+			quote.BaseRate = method.Rate
+		case ShippingWeight, ShippingPrice:
+			reaches := func(from int64) (bool, error) {
+				return s.weight() >= from, nil
+			}
+			if method.Kind == ShippingPrice {
+				reaches = func(from int64) (bool, error) {
+					bound, err := convert(money.New(from, r.Currency))
+					return s.Subtotal.Cmp(bound) >= 0, err
+				}
+			}
+			tier, err := highestTier(method.Tiers, reaches)
+			if err != nil {
+				return nil, err
+			}
+			if tier == nil {
+				continue
+			}
+			quote.BaseRate = tier.Rate
+		case ShippingCarrier:
+			if r.Carrier == nil {
+				continue
+			}
+			rate, err := r.Carrier.Rate(ctx, CarrierRateRequest{
+				Service:     method.Service,
+				Destination: s.Destination,
+				Parcels:     s.Parcels,
+				Currency:    r.Currency,
+			})
+			if errors.Is(err, errCarrierUnavailable) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			quote.BaseRate, quote.EstimatedDays = rate.Rate, rate.EstimatedDays
+		default:
+			continue
+		}
+		if method.FreeOver != nil {
+			threshold, err := convert(*method.FreeOver)
+			if err != nil {
+				return nil, err
+			}
+			quote.Free = s.Subtotal.Cmp(threshold) >= 0
+		}
+		quote.Free = quote.Free || s.FreeShipping
+		if quote.Free {
+			quote.BaseRate = money.Zero(r.Currency)
+		}
+		if quote.Rate, err = convert(quote.BaseRate); err != nil {
+			return nil, err
+		}
+		quotes = append(quotes, quote)
+	}
+	sort.SliceStable(quotes, func(i, j int) bool { return quotes[i].Rate.Amount < quotes[j].Rate.Amount })
+	return quotes, nil
+}
+
+// highestTier returns the tier with the highest From that the shipment
+// reaches, or nil
+func highestTier(tiers []ShippingRateTier, reaches func(from int64) (bool, error)) (*ShippingRateTier, error) {
+	var best *ShippingRateTier
+	for i := range tiers {
+		ok, err := reaches(tiers[i].From)
+		if err != nil {
+			return nil, err
+		}
+		if ok && (best == nil || tiers[i].From > best.From) {
+			best = &tiers[i]
+		}
+	}
+	return best, nil
+}
+
+// cartParcels returns one parcel per unit of each product in quantities
+func cartParcels(db *gorm.DB, quantities map[uint]int) ([]Parcel, error) {
+	if len(quantities) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, 0, len(quantities))
+	for id := range quantities {
+		ids = append(ids, id)
+	}
+	var products []Product
+	if err := db.Where("id IN (?)", ids).Order("id").Find(&products).Error; err != nil {
+		return nil, err
+	}
+	var parcels []Parcel
+	for _, product := range products {
+		for n := 0; n < quantities[product.ID]; n++ {
+			parcels = append(parcels, product.parcel())
+		}
+	}
+	return parcels, nil
+}
+
+func (product *Product) parcel() Parcel {
+	return Parcel{
+		WeightGrams: product.WeightGrams,
+		LengthMM:    product.LengthMM,
+		WidthMM:     product.WidthMM,
+		HeightMM:    product.HeightMM,
+	}
+}
+
+// Get the shipping methods and rates available for the caller's cart at
+// the address in the country, region and postal_code query parameters
+func (r *Repository) GetShippingRates(ctx *fiber.Ctx) error {
+	address := cartTaxAddress(ctx)
+	if address == nil {
+		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+			"message": "country is required",
+		})
+		return nil
+	}
+	cart, err := r.cartForRequest(ctx, false)
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	if cart == nil {
+		return ctx.JSON(&fiber.Map{"rates": []ShippingQuote{}})
+	}
+	currency := r.requestCurrency(ctx)
+	response, err := r.loadCart(ctx.Context(), cart, currency, nil)
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	quantities := map[uint]int{}
+	for _, line := range response.Items {
+		quantities[line.ProductID] += line.Quantity
+	}
+	parcels, err := cartParcels(r.DB, quantities)
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	convert, err := r.converterTo(ctx.Context(), currency)
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	quotes, err := r.quoteShipping(ctx.Context(), r.DB, &shipment{
+		Destination:  *address,
+		Parcels:      parcels,
+		Subtotal:     response.Subtotal.Sub(response.DiscountTotal),
+		FreeShipping: response.FreeShipping,
+	}, convert)
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return ctx.JSON(&fiber.Map{"address": address, "rates": quotes})
+}
+
+// converterTo returns a converter from the store currency to currency at
+// the current rate
+func (r *Repository) converterTo(ctx context.Context, currency string) (func(money.Money) (money.Money, error), error) {
+	if currency == r.Currency {
+		return converter(nil), nil
+	}
+	rate, err := r.Rates.Rate(ctx, r.Currency, currency)
+	if err != nil {
+		return nil, err
+	}
+	return converter(&rate), nil
+}
+
+func respondInvalidShipping(context *fiber.Ctx, problems map[string]string) error {
+	context.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+		"message": "Invalid shipping settings",
+		"errors":  problems,
+	})
+	return nil
+}
+
+func parseIDParam(context *fiber.Ctx, name string) (uint, error) {
+	id, err := strconv.ParseUint(context.Params(name), 10, 64)
+	if err != nil {
+		return 0, gorm.ErrRecordNotFound
+	}
+	return uint(id), nil
+}
+
+func respondShippingLookupError(context *fiber.Ctx, what string, err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": what + " not found"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to retrieve " + strings.ToLower(what)})
+	return err
+}
+
+// normalizeAreas upper-cases the area codes and reports invalid ones
+func normalizeAreas(areas []ShippingZoneArea, problems map[string]string) []ShippingZoneArea {
+	normalized := make([]ShippingZoneArea, len(areas))
+	for i, area := range areas {
+		address := TaxAddress{Country: area.Country, Region: area.Region, PostalCode: area.PostalPrefix}.normalize()
+		normalized[i] = ShippingZoneArea{Country: address.Country, Region: address.Region, PostalPrefix: address.PostalCode}
+		if len(address.Country) != 2 {
+			problems["areas."+strconv.Itoa(i)+".country"] = "must be a two-letter country code"
+		}
+	}
+	return normalized
+}
+
+// Get every shipping zone with its areas and methods
+func (r *Repository) GetShippingZones(context *fiber.Ctx) error {
+	zones := []ShippingZone{}
+	err := r.DB.Preload("Areas").Preload("Methods", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position, id")
+	}).Preload("Methods.Tiers", func(db *gorm.DB) *gorm.DB {
+		return db.Order("\"from\"")
+	}).Order("id").Find(&zones).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve shipping zones"})
+		return err
+	}
+	return context.JSON(zones)
+}
+
+// Create a shipping zone
+func (r *Repository) CreateShippingZone(context *fiber.Ctx) error {
+	request := ShippingZoneRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request: " + err.Error()})
+		return nil
+	}
+	zone := &ShippingZone{}
+	if request.Areas == nil {
+		request.Areas = &[]ShippingZoneArea{}
+	}
+	return r.saveShippingZone(context, zone, request, http.StatusCreated)
+}
+
+// Rename a shipping zone or replace its areas
+func (r *Repository) UpdateShippingZone(context *fiber.Ctx) error {
+	id, err := parseIDParam(context, "id")
+	zone := &ShippingZone{}
+	if err == nil {
+		err = r.DB.Where("id = ?", id).First(zone).Error
+	}
+	if err != nil {
+		return respondShippingLookupError(context, "Shipping zone", err)
+	}
+	request := ShippingZoneRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request: " + err.Error()})
+		return nil
+	}
+	return r.saveShippingZone(context, zone, request, http.StatusOK)
+}
+
+func (r *Repository) saveShippingZone(context *fiber.Ctx, zone *ShippingZone, request ShippingZoneRequest, status int) error {
+	problems := map[string]string{}
+	if request.Name != nil {
+		zone.Name = strings.TrimSpace(*request.Name)
+	}
+	if zone.Name == "" {
+		problems["name"] = "must not be empty"
+	}
+	var areas []ShippingZoneArea
+	if request.Areas != nil {
+		areas = normalizeAreas(*request.Areas, problems)
+	}
+	if len(problems) > 0 {
+		return respondInvalidShipping(context, problems)
+	}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Areas", "Methods").Save(zone).Error; err != nil {
+			return err
+		}
+		if request.Areas == nil {
+			return nil
+		}
+		if err := tx.Where("zone_id = ?", zone.ID).Delete(&ShippingZoneArea{}).Error; err != nil {
+			return err
+		}
+		for i := range areas {
+			areas[i].ZoneID = zone.ID
+			if err := tx.Create(&areas[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to save shipping zone"})
+		return err
+	}
+	err = r.DB.Preload("Areas").Preload("Methods.Tiers").Where("id = ?", zone.ID).First(zone).Error
+	if err != nil {
+		return respondShippingLookupError(context, "Shipping zone", err)
+	}
+	return context.Status(status).JSON(zone)
+}
+
+// Delete a shipping zone with its areas and methods
+func (r *Repository) DeleteShippingZone(context *fiber.Ctx) error {
+	id, err := parseIDParam(context, "id")
+	if err != nil {
+		return respondShippingLookupError(context, "Shipping zone", err)
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		statements := []string{
+			`DELETE FROM shipping_rate_tiers WHERE method_id IN (SELECT id FROM shipping_methods WHERE zone_id = ?)`,
+			`DELETE FROM shipping_methods WHERE zone_id = ?`,
+			`DELETE FROM shipping_zone_areas WHERE zone_id = ?`,
+			`DELETE FROM shipping_zones WHERE id = ?`,
+		}
+		for _, statement := range statements {
+			if err := tx.Exec(statement, id).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to delete shipping zone"})
+		return err
+	}
+	return context.JSON(&fiber.Map{"message": "Shipping zone deleted"})
+}
+
+func (request *ShippingMethodRequest) apply(method *ShippingMethod, currency string) ([]ShippingRateTier, map[string]string) {
+	problems := map[string]string{}
+	if request.Name != nil {
+		method.Name = strings.TrimSpace(*request.Name)
+	}
+	if request.Kind != nil {
+		method.Kind = *request.Kind
+	}
+	if request.Rate != nil {
+		rate, err := request.Rate.In(currency)
+		if err != nil {
+			problems["rate"] = err.Error()
+		}
+		method.Rate = rate
+	}
+	if method.Rate.Currency == "" {
+		method.Rate = money.Zero(currency)
+	}
+	if request.FreeOver.Set {
+		method.FreeOver = nil
+		if request.FreeOver.Input != nil {
+			threshold, err := request.FreeOver.Input.In(currency)
+			if err != nil {
+				problems["free_over"] = err.Error()
+			}
+			method.FreeOver = &threshold
+		}
+	}
+	if request.Service != nil {
+		method.Service = strings.TrimSpace(*request.Service)
+	}
+	if request.Position != nil {
+		method.Position = *request.Position
+	}
+	if request.Active != nil {
+		method.Active = *request.Active
+	}
+	var tiers []ShippingRateTier
+	if request.Tiers != nil {
+		tiers = []ShippingRateTier{}
+		for i, tier := range *request.Tiers {
+			rate, err := tier.Rate.In(currency)
+			field := "tiers." + strconv.Itoa(i)
+			switch {
+			case err != nil:
+				problems[field+".rate"] = err.Error()
+			case rate.Currency != currency || rate.IsNegative():
+				problems[field+".rate"] = "must be a positive amount in " + currency
+			case tier.From < 0:
+				problems[field+".from"] = "must not be negative"
+			}
+			tiers = append(tiers, ShippingRateTier{From: tier.From, Rate: rate})
+		}
+	}
+	return tiers, problems
+}
+
+// validateShippingMethod checks a method with the tiers it will have
+func validateShippingMethod(method *ShippingMethod, tiers []ShippingRateTier, currency string, problems map[string]string) {
+	if method.Name == "" {
+		problems["name"] = "must not be empty"
+	}
+	switch method.Kind {
+	case ShippingFlat:
+	case ShippingWeight, ShippingPrice:
+		if len(tiers) == 0 {
+			problems["tiers"] = "must list at least one tier"
+		}
+	case ShippingCarrier:
+		if method.Service == "" {
+			problems["service"] = "is required for carrier methods"
+		}
+	default:
+		problems["kind"] = "must be flat, weight, price or carrier"
+	}
+	if _, ok := problems["rate"]; !ok && (method.Rate.Currency != currency || method.Rate.IsNegative()) {
+		problems["rate"] = "must be a positive amount in " + currency
+	}
+	if _, ok := problems["free_over"]; !ok && method.FreeOver != nil &&
+		(method.FreeOver.Currency != currency || method.FreeOver.IsNegative()) {
+		problems["free_over"] = "must be a positive amount in " + currency
+	}
+}
+
+// Add a shipping method to a zone
+func (r *Repository) CreateShippingMethod(context *fiber.Ctx) error {
+	zoneID, err := parseIDParam(context, "id")
+	if err == nil {
+		err = r.DB.Where("id = ?", zoneID).First(&ShippingZone{}).Error
+	}
+	if err != nil {
+		return respondShippingLookupError(context, "Shipping zone", err)
+	}
+	request := ShippingMethodRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request: " + err.Error()})
+		return nil
+	}
+	method := &ShippingMethod{ZoneID: zoneID, Active: true}
+	return r.saveShippingMethod(context, method, request, http.StatusCreated)
+}
+
+// Change a shipping method
+func (r *Repository) UpdateShippingMethod(context *fiber.Ctx) error {
+	id, err := parseIDParam(context, "id")
+	method := &ShippingMethod{}
+	if err == nil {
+		err = r.DB.Preload("Tiers").Where("id = ?", id).First(method).Error
+	}
+	if err != nil {
+		return respondShippingLookupError(context, "Shipping method", err)
+	}
+	request := ShippingMethodRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request: " + err.Error()})
+		return nil
+	}
+	return r.saveShippingMethod(context, method, request, http.StatusOK)
+}
+
+func (r *Repository) saveShippingMethod(context *fiber.Ctx, method *ShippingMethod, request ShippingMethodRequest, status int) error {
+	tiers, problems := request.apply(method, r.Currency)
+	effective := tiers
+	if effective == nil {
+		effective = method.Tiers
+	}
+	validateShippingMethod(method, effective, r.Currency, problems)
+	if len(problems) > 0 {
+		return respondInvalidShipping(context, problems)
+	}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Tiers").Save(method).Error; err != nil {
+			return err
+		}
+		if tiers == nil {
+			return nil
+		}
+		if err := tx.Where("method_id = ?", method.ID).Delete(&ShippingRateTier{}).Error; err != nil {
+			return err
+		}
+		for i := range tiers {
+			tiers[i].MethodID = method.ID
+			if err := tx.Create(&tiers[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to save shipping method"})
+		return err
+	}
+	err = r.DB.Preload("Tiers").Where("id = ?", method.ID).First(method).Error
+	if err != nil {
+		return respondShippingLookupError(context, "Shipping method", err)
+	}
+	return context.Status(status).JSON(method)
+}
+
+// Delete a shipping method. Orders keep the method name and charge.
+func (r *Repository) DeleteShippingMethod(context *fiber.Ctx) error {
+	id, err := parseIDParam(context, "id")
+	if err != nil {
+		return respondShippingLookupError(context, "Shipping method", err)
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("method_id = ?", id).Delete(&ShippingRateTier{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&ShippingMethod{}).Error
+	})
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to delete shipping method"})
+		return err
+	}
+	return context.JSON(&fiber.Map{"message": "Shipping method deleted"})
+}
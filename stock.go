@@ -0,0 +1,843 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+// Stock movement kinds
+const (
+	MovementReceipt    = "receipt"
+	MovementSale       = "sale"
+	MovementReturn     = "return"
+	MovementAdjustment = "adjustment"
+	MovementTransfer   = "transfer"
+)
+
+var locationCodePattern = regexp.MustCompile(`^[A-Z0-9]+([_-][A-Z0-9]+)*$`)
+
+var (
+	errNoStockLocation  = errors.New("no active stock location")
+	errLocationShortage = errors.New("not enough stock at location")
+)
+
+// Struct StockLocation
+// A warehouse or store that holds stock. Sales take stock from active
+// locations in Priority order, lowest first; the first active location also
+// receives stock set through product and variant quantities.
+type StockLocation struct {
+	ID        uint      `json:"id" gorm:"primary_key"`
+	Code      string    `json:"code" gorm:"unique_index;not null"`
+	Name      string    `json:"name" gorm:"not null"`
+	Priority  int       `json:"priority" gorm:"not null;default:0"`
+	Active    bool      `json:"active" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Struct StockMovement
+// One row per change to the stock of a product or variant at a location.
+// Rows are never updated or deleted: on-hand stock is their sum, and the
+// quantity columns on products and variants are a cache of it.
+type StockMovement struct {
+	ID         uint      `json:"id" gorm:"primary_key"`
+	LocationID uint      `json:"location_id" gorm:"not null"`
+	ProductID  uint      `json:"product_id" gorm:"not null"`
+	VariantID  uint      `json:"variant_id" gorm:"not null;default:0"`
+	Kind       string    `json:"kind" gorm:"not null"`
+	Quantity   int       `json:"quantity" gorm:"not null"`
+	OrderID    *uint     `json:"order_id,omitempty" gorm:"index"`
+	TransferID *uint     `json:"transfer_id,omitempty" gorm:"index"`
+	AccountID  *uint     `json:"account_id,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Struct StockTransfer
+// Moves stock between two locations; recorded as a pair of transfer
+// movements that leave the total on hand unchanged.
+type StockTransfer struct {
+	ID             uint      `json:"id" gorm:"primary_key"`
+	FromLocationID uint      `json:"from_location_id" gorm:"not null"`
+	ToLocationID   uint      `json:"to_location_id" gorm:"not null"`
+	ProductID      uint      `json:"product_id" gorm:"not null"`
+	VariantID      uint      `json:"variant_id" gorm:"not null;default:0"`
+	Quantity       int       `json:"quantity" gorm:"not null"`
+	AccountID      *uint     `json:"account_id,omitempty"`
+	Note           string    `json:"note,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Struct StockLocationRequest
+type StockLocationRequest struct {
+	Code     *string `json:"code"`
+	Name     *string `json:"name"`
+	Priority *int    `json:"priority"`
+	Active   *bool   `json:"active"`
+}
+
+// Struct StockMovementRequest
+// Kind is receipt, return or adjustment; sales and transfers are recorded
+// by checkout and the transfer endpoint.
+type StockMovementRequest struct {
+	LocationID uint   `json:"location_id"`
+	ProductID  uint   `json:"product_id"`
+	VariantID  uint   `json:"variant_id"`
+	Kind       string `json:"kind"`
+	Quantity   int    `json:"quantity"`
+	Note       string `json:"note"`
+}
+
+// Struct StockTransferRequest
+type StockTransferRequest struct {
+	FromLocationID uint   `json:"from_location_id"`
+	ToLocationID   uint   `json:"to_location_id"`
+	ProductID      uint   `json:"product_id"`
+	VariantID      uint   `json:"variant_id"`
+	Quantity       int    `json:"quantity"`
+	Note           string `json:"note"`
+}
+
+// Struct LocationStock
+type LocationStock struct {
+	ProductID uint   `json:"product_id"`
+	VariantID uint   `json:"variant_id"`
+	SKU       string `json:"sku"`
+	Title     string `json:"title"`
+	OnHand    int    `json:"on_hand"`
+}
+
+// Struct StockDiscrepancy
+// Difference is the ledger on hand less the cached quantity.
+type StockDiscrepancy struct {
+	ProductID  uint   `json:"product_id"`
+	VariantID  uint   `json:"variant_id"`
+	SKU        string `json:"sku"`
+	Title      string `json:"title"`
+	Cached     int    `json:"cached"`
+	Ledger     int    `json:"ledger"`
+	Difference int    `json:"difference"`
+}
+
+// MigrateStock creates the location and ledger tables, a MAIN location when
+// there is none, and an opening balance at it for every product and variant
+// that has no movements yet
+func MigrateStock(db *gorm.DB) error {
+	if err := db.AutoMigrate(&StockLocation{}, &StockMovement{}, &StockTransfer{}).Error; err != nil {
+		return err
+	}
+	err := db.Model(&StockMovement{}).
+		AddIndex("idx_stock_movements_item", "product_id", "variant_id", "location_id").Error
+	if err != nil {
+		return err
+	}
+	var count int
+	if err := db.Model(&StockLocation{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		warehouse := StockLocation{Code: "MAIN", Name: "Main warehouse", Active: true}
+		if err := db.Create(&warehouse).Error; err != nil {
+			return err
+		}
+	}
+	location, err := defaultLocation(db)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	statements := []string{
+		`INSERT INTO stock_movements (location_id, product_id, variant_id, kind, quantity, note, created_at)
+		SELECT ?, product.id, 0, ?, product.quantity, 'opening balance', ?
+		FROM product
+		WHERE product.quantity <> 0
+			AND NOT EXISTS (SELECT 1 FROM product_variants
+				WHERE product_variants.product_id = product.id AND product_variants.deleted_at IS NULL)
+			AND NOT EXISTS (SELECT 1 FROM stock_movements
+				WHERE stock_movements.product_id = product.id AND stock_movements.variant_id = 0)`,
+		`INSERT INTO stock_movements (location_id, product_id, variant_id, kind, quantity, note, created_at)
+		SELECT ?, product_variants.product_id, product_variants.id, ?, product_variants.quantity, 'opening balance', ?
+		FROM product_variants
+		WHERE product_variants.quantity <> 0
+			AND NOT EXISTS (SELECT 1 FROM stock_movements
+				WHERE stock_movements.variant_id = product_variants.id)`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement, location.ID, MovementAdjustment, now).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activeLocations returns the active locations in the order sales use them
+func activeLocations(db *gorm.DB) ([]StockLocation, error) {
+	var locations []StockLocation
+	err := db.Where("active = ?", true).Order("priority, id").Find(&locations).Error
+	return locations, err
+}
+
+// defaultLocation is the first active location
+func defaultLocation(db *gorm.DB) (*StockLocation, error) {
+	locations, err := activeLocations(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(locations) == 0 {
+		return nil, errNoStockLocation
+	}
+	return &locations[0], nil
+}
+
+// locationLevels returns the on-hand stock of a product or variant at each
+// location that has any
+func locationLevels(db *gorm.DB, productID, variantID uint) (map[uint]int, error) {
+	var rows []struct {
+		LocationID uint
+		OnHand     int
+	}
+	err := db.Model(&StockMovement{}).
+		Select("location_id, sum(quantity) AS on_hand").
+		Where("product_id = ? AND variant_id = ?", productID, variantID).
+		Group("location_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	levels := map[uint]int{}
+	for _, row := range rows {
+		levels[row.LocationID] = row.OnHand
+	}
+	return levels, nil
+}
+
+// moveStock records a movement and applies it to the cached quantity.
+// Transfers leave the cached total alone.
+func moveStock(tx *gorm.DB, movement *StockMovement) error {
+	if err := tx.Create(movement).Error; err != nil {
+		return err
+	}
+	if movement.Kind == MovementTransfer {
+		return nil
+	}
+	return adjustStock(tx, movement.ProductID, movement.VariantID, movement.Quantity)
+}
+
+// setOnHand records the adjustments that bring the ledger total of a
+// product without variants, or of a variant, to quantity. It is used when
+// the quantity is set through the product or variant itself, after the
+// cached column has been saved. Increases go to the first active location;
+// decreases are taken from the locations in the order sales use them.
+func setOnHand(tx *gorm.DB, productID, variantID uint, quantity int) error {
+	if variantID == 0 {
+		withVariants, err := hasVariants(tx, productID)
+		if err != nil || withVariants {
+			return err
+		}
+	}
+	levels, err := locationLevels(tx, productID, variantID)
+	if err != nil {
+		return err
+	}
+	delta := quantity
+	for _, onHand := range levels {
+		delta -= onHand
+	}
+	if delta == 0 {
+		return nil
+	}
+	adjust := func(locationID uint, quantity int) error {
+		movement := StockMovement{
+			LocationID: locationID,
+			ProductID:  productID,
+			VariantID:  variantID,
+			Kind:       MovementAdjustment,
+			Quantity:   quantity,
+			Note:       "quantity set on product",
+		}
+		return tx.Create(&movement).Error
+	}
+	if delta > 0 {
+		location, err := defaultLocation(tx)
+		if err != nil {
+			return err
+		}
+		return adjust(location.ID, delta)
+	}
+
+	locations, err := activeLocations(tx)
+	if err != nil {
+		return err
+	}
+	// Stock left at inactive locations is taken last
+	order := []uint{}
+	active := map[uint]bool{}
+	for _, location := range locations {
+		order = append(order, location.ID)
+		active[location.ID] = true
+	}
+	inactive := []uint{}
+	for locationID := range levels {
+		if !active[locationID] {
+			inactive = append(inactive, locationID)
+		}
+	}
+	sort.Slice(inactive, func(i, j int) bool { return inactive[i] < inactive[j] })
+	remaining := -delta
+	for _, locationID := range append(order, inactive...) {
+		take := levels[locationID]
+		if take > remaining {
+			take = remaining
+		}
+		if take <= 0 {
+			continue
+		}
+		if err := adjust(locationID, -take); err != nil {
+			return err
+		}
+		remaining -= take
+	}
+	if remaining > 0 {
+		// Only reachable when the ledger was already below zero somewhere
+		location, err := defaultLocation(tx)
+		if err != nil {
+			return err
+		}
+		return adjust(location.ID, -remaining)
+	}
+	return nil
+}
+
+// sellStock takes an order's quantity of a product or variant from the
+// active locations in priority order. It fails with errInsufficientStock
+// when the active locations cannot cover it.
+func sellStock(tx *gorm.DB, orderID, productID, variantID uint, quantity int) error {
+	locations, err := activeLocations(tx)
+	if err != nil {
+		return err
+	}
+	if len(locations) == 0 {
+		return errNoStockLocation
+	}
+	levels, err := locationLevels(tx, productID, variantID)
+	if err != nil {
+		return err
+	}
+	taken := map[uint]int{}
+	remaining := quantity
+	for _, location := range locations {
+		take := levels[location.ID]
+		if take > remaining {
+			take = remaining
+		}
+		if take > 0 {
+			taken[location.ID] = take
+			remaining -= take
+		}
+	}
+	if remaining > 0 {
+		return errInsufficientStock
+	}
+	for _, location := range locations {
+		if taken[location.ID] == 0 {
+			continue
+		}
+		movement := StockMovement{
+			LocationID: location.ID,
+			ProductID:  productID,
+			VariantID:  variantID,
+			Kind:       MovementSale,
+			Quantity:   -taken[location.ID],
+			OrderID:    &orderID,
+		}
+		if err := moveStock(tx, &movement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returnStock puts a cancelled order's quantity back where it was sold
+// from. Orders sold before the ledger existed return to the first active
+// location.
+func returnStock(tx *gorm.DB, orderID, productID, variantID uint, quantity int) error {
+	var sold []struct {
+		LocationID uint
+		Quantity   int
+	}
+	err := tx.Model(&StockMovement{}).
+		Select("location_id, -sum(quantity) AS quantity").
+		Where("order_id = ? AND product_id = ? AND variant_id = ? AND kind IN (?)",
+			orderID, productID, variantID, []string{MovementSale, MovementReturn}).
+		Group("location_id").
+		Order("location_id").
+		Scan(&sold).Error
+	if err != nil {
+		return err
+	}
+	returned := 0
+	for _, row := range sold {
+		if row.Quantity <= 0 {
+			continue
+		}
+		movement := StockMovement{
+			LocationID: row.LocationID,
+			ProductID:  productID,
+			VariantID:  variantID,
+			Kind:       MovementReturn,
+			Quantity:   row.Quantity,
+			OrderID:    &orderID,
+		}
+		if err := moveStock(tx, &movement); err != nil {
+			return err
+		}
+		returned += row.Quantity
+	}
+	if returned >= quantity {
+		return nil
+	}
+	location, err := defaultLocation(tx)
+	if err != nil {
+		return err
+	}
+	movement := StockMovement{
+		LocationID: location.ID,
+		ProductID:  productID,
+		VariantID:  variantID,
+		Kind:       MovementReturn,
+		Quantity:   quantity - returned,
+		OrderID:    &orderID,
+	}
+	return moveStock(tx, &movement)
+}
+
+// stockMovementError carries validation problems out of a transaction
+type stockMovementError struct {
+	Problems map[string]string
+}
+
+func (e *stockMovementError) Error() string { return "invalid stock movement" }
+
+func respondInvalidStock(context *fiber.Ctx, message string, problems map[string]string) error {
+	context.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+		"message": message,
+		"errors":  problems,
+	})
+	return nil
+}
+
+func respondStockLookupError(context *fiber.Ctx, err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Stock location not found"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to retrieve stock location"})
+	return err
+}
+
+// respondStockError writes the response for errors from recording movements
+// and transfers
+func respondStockError(context *fiber.Ctx, err error) error {
+	var invalid *stockMovementError
+	switch {
+	case errors.As(err, &invalid):
+		return respondInvalidStock(context, "Invalid stock movement", invalid.Problems)
+	case errors.Is(err, errLocationShortage):
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": err.Error()})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to record stock movement"})
+	return err
+}
+
+// List stock locations
+func (r *Repository) GetStockLocations(context *fiber.Ctx) error {
+	locations := []StockLocation{}
+	if err := r.DB.Order("priority, id").Find(&locations).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve stock locations"})
+		return err
+	}
+	return context.JSON(locations)
+}
+
+// Create a stock location
+func (r *Repository) CreateStockLocation(context *fiber.Ctx) error {
+	request := StockLocationRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	return r.saveStockLocation(context, &StockLocation{Active: true}, request, http.StatusCreated)
+}
+
+// Rename, reprioritise or deactivate a stock location
+func (r *Repository) UpdateStockLocation(context *fiber.Ctx) error {
+	id, err := parseIDParam(context, "id")
+	location := &StockLocation{}
+	if err == nil {
+		err = r.DB.Where("id = ?", id).First(location).Error
+	}
+	if err != nil {
+		return respondStockLookupError(context, err)
+	}
+	request := StockLocationRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	return r.saveStockLocation(context, location, request, http.StatusOK)
+}
+
+func (r *Repository) saveStockLocation(context *fiber.Ctx, location *StockLocation, request StockLocationRequest, status int) error {
+	problems := map[string]string{}
+	if request.Code != nil {
+		location.Code = strings.ToUpper(strings.TrimSpace(*request.Code))
+	}
+	if request.Name != nil {
+		location.Name = strings.TrimSpace(*request.Name)
+	}
+	if request.Priority != nil {
+		location.Priority = *request.Priority
+	}
+	if request.Active != nil {
+		location.Active = *request.Active
+	}
+	if !locationCodePattern.MatchString(location.Code) {
+		problems["code"] = "must be letters, digits, - and _"
+	} else {
+		var count int
+		err := r.DB.Model(&StockLocation{}).Where("code = ? AND id <> ?", location.Code, location.ID).Count(&count).Error
+		if err != nil {
+			return respondStockLookupError(context, err)
+		}
+		if count > 0 {
+			problems["code"] = "is already in use"
+		}
+	}
+	if location.Name == "" {
+		problems["name"] = "must not be empty"
+	}
+	if len(problems) > 0 {
+		return respondInvalidStock(context, "Invalid stock location", problems)
+	}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(location).Error; err != nil {
+			return err
+		}
+		// Sales and quantity edits need somewhere to put stock
+		_, err := defaultLocation(tx)
+		return err
+	})
+	if errors.Is(err, errNoStockLocation) {
+		context.Status(http.StatusConflict).JSON(
+			&fiber.Map{"message": "At least one stock location must stay active"})
+		return nil
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to save stock location"})
+		return err
+	}
+	return context.Status(status).JSON(location)
+}
+
+// List the stock on hand at a location
+func (r *Repository) GetLocationStock(context *fiber.Ctx) error {
+	id, err := parseIDParam(context, "id")
+	location := &StockLocation{}
+	if err == nil {
+		err = r.DB.Where("id = ?", id).First(location).Error
+	}
+	if err != nil {
+		return respondStockLookupError(context, err)
+	}
+	stock := []LocationStock{}
+	err = r.DB.Raw(`SELECT stock_movements.product_id, stock_movements.variant_id,
+			coalesce(product_variants.sku, product.sku) AS sku, product.title,
+			sum(stock_movements.quantity) AS on_hand
+		FROM stock_movements
+		JOIN product ON product.id = stock_movements.product_id
+		LEFT JOIN product_variants ON product_variants.id = stock_movements.variant_id
+		WHERE stock_movements.location_id = ?
+		GROUP BY stock_movements.product_id, stock_movements.variant_id, product_variants.sku, product.sku, product.title
+		HAVING sum(stock_movements.quantity) <> 0
+		ORDER BY stock_movements.product_id, stock_movements.variant_id`, location.ID).
+		Scan(&stock).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve stock"})
+		return err
+	}
+	return context.JSON(fiber.Map{"location": location, "stock": stock})
+}
+
+// List stock movements, newest first. Filters are product_id, variant_id,
+// location_id and kind; pages use limit and offset.
+func (r *Repository) GetStockMovements(context *fiber.Ctx) error {
+	query := r.DB.Model(&StockMovement{})
+	for _, filter := range []string{"product_id", "variant_id", "location_id", "order_id"} {
+		if value := context.Query(filter); value != "" {
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				context.Status(http.StatusBadRequest).JSON(
+					&fiber.Map{"message": "Invalid query: " + filter})
+				return nil
+			}
+			query = query.Where(filter+" = ?", id)
+		}
+	}
+	if kind := context.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	limit, offset := defaultPageSize, 0
+	if value := context.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			context.Status(http.StatusBadRequest).JSON(
+				&fiber.Map{"message": "Invalid query: limit"})
+			return nil
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		limit = n
+	}
+	if value := context.Query("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			context.Status(http.StatusBadRequest).JSON(
+				&fiber.Map{"message": "Invalid query: offset"})
+			return nil
+		}
+		offset = n
+	}
+	movements := []StockMovement{}
+	if err := query.Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&movements).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve stock movements"})
+		return err
+	}
+	return context.JSON(movements)
+}
+
+// checkStockItem reports problems with a product, variant and location
+// named in a request
+func checkStockItem(tx *gorm.DB, productID, variantID uint, locationIDs map[string]uint, problems map[string]string) error {
+	_, err := findSellable(tx, productID, variantID)
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		problems["product_id"] = "does not exist"
+	case errors.Is(err, errVariantRequired):
+		problems["variant_id"] = "is required for a product with variants"
+	case errors.Is(err, errVariantNotFound):
+		problems["variant_id"] = "does not exist"
+	case err != nil:
+		return err
+	}
+	for field, id := range locationIDs {
+		var count int
+		if err := tx.Model(&StockLocation{}).Where("id = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			problems[field] = "does not exist"
+		}
+	}
+	return nil
+}
+
+// Record a receipt, customer return or stock count adjustment
+func (r *Repository) CreateStockMovement(context *fiber.Ctx) error {
+	request := StockMovementRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	accountID := currentAccount(context).ID
+	movement := &StockMovement{
+		LocationID: request.LocationID,
+		ProductID:  request.ProductID,
+		VariantID:  request.VariantID,
+		Kind:       request.Kind,
+		Quantity:   request.Quantity,
+		AccountID:  &accountID,
+		Note:       strings.TrimSpace(request.Note),
+	}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		problems := map[string]string{}
+		switch request.Kind {
+		case MovementReceipt, MovementReturn:
+			if request.Quantity <= 0 {
+				problems["quantity"] = "must be positive"
+			}
+		case MovementAdjustment:
+			if request.Quantity == 0 {
+				problems["quantity"] = "must not be zero"
+			}
+		default:
+			problems["kind"] = "must be receipt, return or adjustment"
+		}
+		// Lock the product so levels cannot change underneath the check
+		if _, err := lockProduct(tx, request.ProductID); err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		err := checkStockItem(tx, request.ProductID, request.VariantID, map[string]uint{"location_id": request.LocationID}, problems)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return &stockMovementError{problems}
+		}
+		levels, err := locationLevels(tx, request.ProductID, request.VariantID)
+		if err != nil {
+			return err
+		}
+		if levels[request.LocationID]+request.Quantity < 0 {
+			return fmt.Errorf("%w: %d on hand", errLocationShortage, levels[request.LocationID])
+		}
+		return moveStock(tx, movement)
+	})
+	if err != nil {
+		return respondStockError(context, err)
+	}
+	return context.Status(http.StatusCreated).JSON(movement)
+}
+
+// Move stock from one location to another
+func (r *Repository) CreateStockTransfer(context *fiber.Ctx) error {
+	request := StockTransferRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	accountID := currentAccount(context).ID
+	transfer := &StockTransfer{
+		FromLocationID: request.FromLocationID,
+		ToLocationID:   request.ToLocationID,
+		ProductID:      request.ProductID,
+		VariantID:      request.VariantID,
+		Quantity:       request.Quantity,
+		AccountID:      &accountID,
+		Note:           strings.TrimSpace(request.Note),
+	}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		problems := map[string]string{}
+		if request.Quantity <= 0 {
+			problems["quantity"] = "must be positive"
+		}
+		if request.FromLocationID == request.ToLocationID {
+			problems["to_location_id"] = "must differ from from_location_id"
+		}
+		if _, err := lockProduct(tx, request.ProductID); err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		locations := map[string]uint{"from_location_id": request.FromLocationID, "to_location_id": request.ToLocationID}
+		if err := checkStockItem(tx, request.ProductID, request.VariantID, locations, problems); err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return &stockMovementError{problems}
+		}
+		levels, err := locationLevels(tx, request.ProductID, request.VariantID)
+		if err != nil {
+			return err
+		}
+		if levels[request.FromLocationID] < request.Quantity {
+			return fmt.Errorf("%w: %d on hand", errLocationShortage, levels[request.FromLocationID])
+		}
+		if err := tx.Create(transfer).Error; err != nil {
+			return err
+		}
+		legs := []struct {
+			locationID uint
+			quantity   int
+		}{
+			{request.FromLocationID, -request.Quantity},
+			{request.ToLocationID, request.Quantity},
+		}
+		for _, leg := range legs {
+			movement := StockMovement{
+				LocationID: leg.locationID,
+				ProductID:  request.ProductID,
+				VariantID:  request.VariantID,
+				Kind:       MovementTransfer,
+				Quantity:   leg.quantity,
+				TransferID: &transfer.ID,
+				AccountID:  &accountID,
+				Note:       transfer.Note,
+			}
+			if err := moveStock(tx, &movement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return respondStockError(context, err)
+	}
+	return context.Status(http.StatusCreated).JSON(transfer)
+}
+
+// List the products and variants whose cached quantity disagrees with the
+// movement ledger. Products with variants are checked against the ledger
+// totals of their variants.
+func (r *Repository) GetStockReconciliation(context *fiber.Ctx) error {
+	discrepancies := []StockDiscrepancy{}
+	err := r.DB.Raw(`SELECT product_id, variant_id, sku, title, cached, ledger, ledger - cached AS difference
+		FROM (
+			SELECT product.id AS product_id, 0 AS variant_id, product.sku, product.title,
+				product.quantity AS cached,
+				coalesce((SELECT sum(stock_movements.quantity) FROM stock_movements
+					WHERE stock_movements.product_id = product.id AND stock_movements.variant_id = 0), 0) AS ledger
+			FROM product
+			WHERE product.deleted_at IS NULL
+				AND NOT EXISTS (SELECT 1 FROM product_variants
+					WHERE product_variants.product_id = product.id AND product_variants.deleted_at IS NULL)
+			UNION ALL
+			SELECT product.id, 0, product.sku, product.title, product.quantity,
+				coalesce((SELECT sum(stock_movements.quantity) FROM stock_movements
+					JOIN product_variants ON product_variants.id = stock_movements.variant_id
+					WHERE product_variants.product_id = product.id AND product_variants.deleted_at IS NULL), 0)
+			FROM product
+			WHERE product.deleted_at IS NULL
+				AND EXISTS (SELECT 1 FROM product_variants
+					WHERE product_variants.product_id = product.id AND product_variants.deleted_at IS NULL)
+			UNION ALL
+			SELECT product_variants.product_id, product_variants.id, product_variants.sku, product.title,
+				product_variants.quantity,
+				coalesce((SELECT sum(stock_movements.quantity) FROM stock_movements
+					WHERE stock_movements.variant_id = product_variants.id), 0)
+			FROM product_variants JOIN product ON product.id = product_variants.product_id
+			WHERE product_variants.deleted_at IS NULL AND product.deleted_at IS NULL
+		) AS items
+		WHERE cached <> ledger
+		ORDER BY product_id, variant_id`).
+		Scan(&discrepancies).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to reconcile stock"})
+		return err
+	}
+	return context.JSON(fiber.Map{
+		"checked_at":    time.Now(),
+		"discrepancies": discrepancies,
+	})
+}
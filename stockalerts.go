@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+// Stock alert reasons and statuses
+const (
+	AlertBelowReorderPoint = "below_reorder_point"
+	AlertProjectedStockout = "projected_stockout"
+
+	AlertOpen     = "open"
+	AlertResolved = "resolved"
+)
+
+// StockAlertConfig controls the low-stock job. Sales velocity is the average
+// daily units sold over VelocityDays; items that will run out within
+// HorizonDays plus their lead time are flagged.
+type StockAlertConfig struct {
+	Interval     time.Duration
+	VelocityDays int
+	HorizonDays  int
+}
+
+// Struct ReorderThreshold
+// Stock at or below ReorderPoint raises an alert. ReorderQuantity is the
+// smallest quantity suggested for a purchase order and LeadTimeDays how
+// long the supplier takes to deliver.
+type ReorderThreshold struct {
+	ID              uint      `json:"id" gorm:"primary_key"`
+	ProductID       uint      `json:"product_id" gorm:"unique_index:idx_reorder_thresholds_item;not null"`
+	VariantID       uint      `json:"variant_id" gorm:"unique_index:idx_reorder_thresholds_item;not null;default:0"`
+	ReorderPoint    int       `json:"reorder_point" gorm:"not null"`
+	ReorderQuantity int       `json:"reorder_quantity" gorm:"not null"`
+	LeadTimeDays    int       `json:"lead_time_days" gorm:"not null"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Struct StockAlert
+// At most one alert per product or variant is open at a time. The job
+// refreshes open alerts and resolves them once stock recovers.
+type StockAlert struct {
+	ID                uint       `json:"id" gorm:"primary_key"`
+	ProductID         uint       `json:"product_id" gorm:"index;not null"`
+	VariantID         uint       `json:"variant_id" gorm:"not null;default:0"`
+	SKU               string     `json:"sku"`
+	Title             string     `json:"title"`
+	Reason            string     `json:"reason" gorm:"not null"`
+	Available         int        `json:"available"`
+	ReorderPoint      int        `json:"reorder_point"`
+	DailyVelocity     float64    `json:"daily_velocity"`
+	DaysOfCover       *float64   `json:"days_of_cover"`
+	SuggestedQuantity int        `json:"suggested_quantity"`
+	Status            string     `json:"status" gorm:"index;not null"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	ResolvedAt        *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Struct ReorderThresholdRequest
+type ReorderThresholdRequest struct {
+	ProductID       uint `json:"product_id"`
+	VariantID       uint `json:"variant_id"`
+	ReorderPoint    int  `json:"reorder_point"`
+	ReorderQuantity int  `json:"reorder_quantity"`
+	LeadTimeDays    int  `json:"lead_time_days"`
+}
+
+// stockPosition is the stock and recent sales of one product or variant
+type stockPosition struct {
+	ProductID       uint
+	VariantID       uint
+	SKU             string
+	Title           string
+	OnHand          int
+	Held            int
+	Sold            int
+	HasThreshold    bool
+	ReorderPoint    int
+	ReorderQuantity int
+	LeadTimeDays    int
+}
+
+// assess returns the alert for the position, or nil when it needs none
+func (position stockPosition) assess(config StockAlertConfig) *StockAlert {
+	available := availableToSell(position.OnHand, position.Held)
+	velocity := float64(position.Sold) / float64(config.VelocityDays)
+	alert := &StockAlert{
+		ProductID:     position.ProductID,
+		VariantID:     position.VariantID,
+		SKU:           position.SKU,
+		Title:         position.Title,
+		Available:     available,
+		ReorderPoint:  position.ReorderPoint,
+		DailyVelocity: math.Round(velocity*100) / 100,
+		Status:        AlertOpen,
+	}
+	horizon := float64(config.HorizonDays + position.LeadTimeDays)
+	if velocity > 0 {
+		cover := math.Round(float64(available)/velocity*10) / 10
+		alert.DaysOfCover = &cover
+	}
+	switch {
+	case position.HasThreshold && available <= position.ReorderPoint:
+		alert.Reason = AlertBelowReorderPoint
+	case alert.DaysOfCover != nil && *alert.DaysOfCover <= horizon:
+		alert.Reason = AlertProjectedStockout
+	default:
+		return nil
+	}
+	// Enough to cover the horizon and get back above the reorder point
+	target := int(math.Ceil(velocity*horizon)) + position.ReorderPoint
+	alert.SuggestedQuantity = target - available
+	if alert.SuggestedQuantity < position.ReorderQuantity {
+		alert.SuggestedQuantity = position.ReorderQuantity
+	}
+	if alert.SuggestedQuantity < 1 {
+		alert.SuggestedQuantity = 1
+	}
+	return alert
+}
+
+// MigrateStockAlerts creates the threshold and alert tables
+func MigrateStockAlerts(db *gorm.DB) error {
+	if err := db.AutoMigrate(&ReorderThreshold{}, &StockAlert{}).Error; err != nil {
+		return err
+	}
+	// Keep only the newest open alert per item before enforcing it
+	err := db.Exec(`UPDATE stock_alerts SET status = ?, resolved_at = now()
+		WHERE status = ? AND id NOT IN (
+			SELECT max(id) FROM stock_alerts WHERE status = ? GROUP BY product_id, variant_id)`,
+		AlertResolved, AlertOpen, AlertOpen).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_alerts_open
+		ON stock_alerts (product_id, variant_id) WHERE status = 'open'`).Error
+}
+
+// stockAlertConfig reads STOCK_ALERT_INTERVAL (a duration, default 1h),
+// STOCK_VELOCITY_DAYS (default 28) and STOCK_ALERT_HORIZON_DAYS (default 14)
+func stockAlertConfig() (StockAlertConfig, error) {
+	config := StockAlertConfig{Interval: time.Hour, VelocityDays: 28, HorizonDays: 14}
+	if value := os.Getenv("STOCK_ALERT_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return config, fmt.Errorf("STOCK_ALERT_INTERVAL %q must be a positive duration", value)
+		}
+		config.Interval = interval
+	}
+	days := map[string]*int{"STOCK_VELOCITY_DAYS": &config.VelocityDays, "STOCK_ALERT_HORIZON_DAYS": &config.HorizonDays}
+	for name, target := range days {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return config, fmt.Errorf("%s %q must be a positive number of days", name, value)
+			}
+			*target = n
+		}
+	}
+	return config, nil
+}
+
+// stockPositions loads every product without variants and every variant
+// with its stock, active holds, units sold since since and threshold
+func stockPositions(db *gorm.DB, since time.Time) ([]stockPosition, error) {
+	var positions []stockPosition
+	err := db.Raw(`SELECT items.product_id, items.variant_id, items.sku, items.title, items.on_hand,
+			coalesce((SELECT sum(stock_holds.quantity) FROM stock_holds
+				WHERE stock_holds.product_id = items.product_id AND stock_holds.variant_id = items.variant_id
+					AND stock_holds.status = ?), 0) AS held,
+			coalesce((SELECT sum(order_lines.quantity) FROM order_lines
+				JOIN orders ON orders.id = order_lines.order_id
+				WHERE order_lines.product_id = items.product_id AND order_lines.variant_id = items.variant_id
+					AND orders.status NOT IN (?) AND orders.created_at >= ?), 0) AS sold,
+			reorder_thresholds.id IS NOT NULL AS has_threshold,
+			coalesce(reorder_thresholds.reorder_point, 0) AS reorder_point,
+			coalesce(reorder_thresholds.reorder_quantity, 0) AS reorder_quantity,
+			coalesce(reorder_thresholds.lead_time_days, 0) AS lead_time_days
+		FROM (
+			SELECT product.id AS product_id, 0 AS variant_id, product.sku, product.title, product.quantity AS on_hand
+			FROM product
+			WHERE product.deleted_at IS NULL
+				AND NOT EXISTS (SELECT 1 FROM product_variants
+					WHERE product_variants.product_id = product.id AND product_variants.deleted_at IS NULL)
+			UNION ALL
+			SELECT product_variants.product_id, product_variants.id, product_variants.sku, product.title,
+				product_variants.quantity
+			FROM product_variants JOIN product ON product.id = product_variants.product_id
+			WHERE product_variants.deleted_at IS NULL AND product.deleted_at IS NULL
+		) AS items
+		LEFT JOIN reorder_thresholds ON reorder_thresholds.product_id = items.product_id
+			AND reorder_thresholds.variant_id = items.variant_id
+		ORDER BY items.product_id, items.variant_id`,
+		HoldActive, []string{OrderPending, OrderCancelled}, since).
+		Scan(&positions).Error
+	return positions, err
+}
+
+// reorderSuggestions returns an alert for every item that needs reordering
+func reorderSuggestions(db *gorm.DB, config StockAlertConfig, now time.Time) ([]StockAlert, error) {
+	positions, err := stockPositions(db, now.AddDate(0, 0, -config.VelocityDays))
+	if err != nil {
+		return nil, err
+	}
+	suggestions := []StockAlert{}
+	for _, position := range positions {
+		if alert := position.assess(config); alert != nil {
+			suggestions = append(suggestions, *alert)
+		}
+	}
+	return suggestions, nil
+}
+
+// stockAlertLock serialises alert checks so the job and a manual check
+// cannot both open an alert for the same item
+const stockAlertLock = 7042
+
+// checkStockAlerts opens alerts for items that need reordering, refreshes
+// the ones already open and resolves the rest. It returns the new alerts.
+func checkStockAlerts(db *gorm.DB, config StockAlertConfig, now time.Time) ([]StockAlert, error) {
+	suggestions, err := reorderSuggestions(db, config, now)
+	if err != nil {
+		return nil, err
+	}
+	var opened []StockAlert
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", stockAlertLock).Error; err != nil {
+			return err
+		}
+		var open []StockAlert
+		if err := tx.Where("status = ?", AlertOpen).Find(&open).Error; err != nil {
+			return err
+		}
+		existing := map[stockKey]*StockAlert{}
+		for i := range open {
+			existing[stockKey{open[i].ProductID, open[i].VariantID}] = &open[i]
+		}
+		for _, alert := range suggestions {
+			key := stockKey{alert.ProductID, alert.VariantID}
+			if current, ok := existing[key]; ok {
+				delete(existing, key)
+				alert.ID, alert.CreatedAt = current.ID, current.CreatedAt
+				if err := tx.Save(&alert).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Create(&alert).Error; err != nil {
+				return err
+			}
+			opened = append(opened, alert)
+		}
+		for _, alert := range existing {
+			err := tx.Model(alert).Updates(map[string]interface{}{"status": AlertResolved, "resolved_at": now}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return opened, err
+}
+
+// lowStockNotification describes newly opened alerts for staff
+func lowStockNotification(alerts []StockAlert) Notification {
+	var text strings.Builder
+	for _, alert := range alerts {
+		fmt.Fprintf(&text, "%s %s: %d available", alert.SKU, alert.Title, alert.Available)
+		if alert.DaysOfCover != nil {
+			fmt.Fprintf(&text, ", %.1f days of cover", *alert.DaysOfCover)
+		}
+		fmt.Fprintf(&text, ", suggest ordering %d\n", alert.SuggestedQuantity)
+	}
+	return Notification{
+		Kind:    "low_stock",
+		Subject: fmt.Sprintf("%d item(s) running low on stock", len(alerts)),
+		Text:    text.String(),
+		Data:    alerts,
+	}
+}
+
+// runStockAlerts checks stock and notifies staff of new alerts
+func (r *Repository) runStockAlerts(ctx context.Context, now time.Time) ([]StockAlert, error) {
+	opened, err := checkStockAlerts(r.DB, r.StockAlerts, now)
+	if err != nil || len(opened) == 0 {
+		return opened, err
+	}
+	if err := r.Notifier.Notify(ctx, lowStockNotification(opened)); err != nil {
+		log.Printf("low stock notification: %v", err)
+	}
+	return opened, nil
+}
+
+// runStockAlertJob checks stock every configured interval until the
+// process exits
+func (r *Repository) runStockAlertJob() {
+	for now := range time.Tick(r.StockAlerts.Interval) {
+		if _, err := r.runStockAlerts(context.Background(), now); err != nil {
+			log.Printf("stock alerts: %v", err)
+		}
+	}
+}
+
+// List reorder thresholds
+func (r *Repository) GetReorderThresholds(context *fiber.Ctx) error {
+	thresholds := []ReorderThreshold{}
+	if err := r.DB.Order("product_id, variant_id").Find(&thresholds).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve reorder thresholds"})
+		return err
+	}
+	return context.JSON(thresholds)
+}
+
+// Set the reorder threshold of a product or variant
+func (r *Repository) SetReorderThreshold(context *fiber.Ctx) error {
+	request := ReorderThresholdRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	problems := map[string]string{}
+	if err := checkStockItem(r.DB, request.ProductID, request.VariantID, nil, problems); err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to save reorder threshold"})
+		return err
+	}
+	fields := map[string]int{
+		"reorder_point":    request.ReorderPoint,
+		"reorder_quantity": request.ReorderQuantity,
+		"lead_time_days":   request.LeadTimeDays,
+	}
+	for field, value := range fields {
+		if value < 0 {
+			problems[field] = "must not be negative"
+		}
+	}
+	if len(problems) > 0 {
+		return respondInvalidStock(context, "Invalid reorder threshold", problems)
+	}
+	threshold := &ReorderThreshold{}
+	err := r.DB.Where("product_id = ? AND variant_id = ?", request.ProductID, request.VariantID).First(threshold).Error
+	if gorm.IsRecordNotFoundError(err) {
+		threshold.ProductID, threshold.VariantID = request.ProductID, request.VariantID
+		err = nil
+	}
+	if err == nil {
+		threshold.ReorderPoint = request.ReorderPoint
+		threshold.ReorderQuantity = request.ReorderQuantity
+		threshold.LeadTimeDays = request.LeadTimeDays
+		err = r.DB.Save(threshold).Error
+	}
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to save reorder threshold"})
+		return err
+	}
+	return context.JSON(threshold)
+}
+
+// Remove a reorder threshold
+func (r *Repository) DeleteReorderThreshold(context *fiber.Ctx) error {
+	id, err := parseIDParam(context, "id")
+	if err != nil {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Reorder threshold not found"})
+		return nil
+	}
+	result := r.DB.Where("id = ?", id).Delete(&ReorderThreshold{})
+	if result.Error != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to delete reorder threshold"})
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Reorder threshold not found"})
+		return nil
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Reorder threshold deleted successfully"})
+	return nil
+}
+
+// List stock alerts; status is open (default), resolved or all
+func (r *Repository) GetStockAlerts(context *fiber.Ctx) error {
+	query := r.DB.Order("created_at DESC, id DESC")
+	switch status := context.Query("status", AlertOpen); status {
+	case AlertOpen, AlertResolved:
+		query = query.Where("status = ?", status)
+	case "all":
+	default:
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "Invalid query: status"})
+		return nil
+	}
+	alerts := []StockAlert{}
+	if err := query.Find(&alerts).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve stock alerts"})
+		return err
+	}
+	return context.JSON(alerts)
+}
+
+// Check stock now instead of waiting for the next scheduled run
+func (r *Repository) CheckStockAlerts(context *fiber.Ctx) error {
+	opened, err := r.runStockAlerts(context.Context(), time.Now())
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to check stock"})
+		return err
+	}
+	if opened == nil {
+		opened = []StockAlert{}
+	}
+	return context.JSON(fiber.Map{"opened": opened})
+}
+
+// Export a suggested purchase order: every item that needs reordering with
+// the quantity to order. format=csv returns a spreadsheet.
+func (r *Repository) GetReorderSuggestions(context *fiber.Ctx) error {
+	suggestions, err := reorderSuggestions(r.DB, r.StockAlerts, time.Now())
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to build reorder suggestions"})
+		return err
+	}
+	switch context.Query("format", "json") {
+	case "json":
+		return context.JSON(suggestions)
+	case "csv":
+	default:
+		context.Status(http.StatusBadRequest).JSON(
+			&fiber.Map{"message": "Invalid query: format"})
+		return nil
+	}
+	context.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	context.Set(fiber.HeaderContentDisposition,
+		fmt.Sprintf(`attachment; filename="purchase-order-%s.csv"`, time.Now().Format("2006-01-02")))
+	writer := csv.NewWriter(context)
+	rows := [][]string{{"sku", "title", "product_id", "variant_id", "available", "daily_velocity", "days_of_cover", "reason", "quantity"}}
+	for _, suggestion := range suggestions {
+		cover := ""
+		if suggestion.DaysOfCover != nil {
+			cover = strconv.FormatFloat(*suggestion.DaysOfCover, 'f', 1, 64)
+		}
+		rows = append(rows, []string{
+			suggestion.SKU,
+			suggestion.Title,
+			strconv.FormatUint(uint64(suggestion.ProductID), 10),
+			strconv.FormatUint(uint64(suggestion.VariantID), 10),
+			strconv.Itoa(suggestion.Available),
+			strconv.FormatFloat(suggestion.DailyVelocity, 'f', 2, 64),
+			cover,
+			suggestion.Reason,
+			strconv.Itoa(suggestion.SuggestedQuantity),
+		})
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return nil
+}
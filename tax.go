@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+// DefaultTaxClass is the tax class of products that do not name one
+const DefaultTaxClass = "standard"
+
+var taxClassPattern = regexp.MustCompile(`^[a-z0-9]+([_-][a-z0-9]+)*$`)
+
+// TaxAddress is where goods are delivered, which decides the rates
+type TaxAddress struct {
+	Country    string `json:"country"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+}
+
+func (address TaxAddress) normalize() TaxAddress {
+	return TaxAddress{
+		Country:    strings.ToUpper(strings.TrimSpace(address.Country)),
+		Region:     strings.ToUpper(strings.TrimSpace(address.Region)),
+		PostalCode: strings.ToUpper(strings.ReplaceAll(address.PostalCode, " ", "")),
+	}
+}
+
+// TaxableLine is the amount of one line after discounts
+type TaxableLine struct {
+	TaxClass string
+	Amount   money.Money
+}
+
+// LineTax is the tax of one line. Rate is a percentage such as "20".
+type LineTax struct {
+	Name string      `json:"name,omitempty"`
+	Rate string      `json:"rate"`
+	Tax  money.Money `json:"tax"`
+}
+
+// TaxResult holds the tax of each line in order. With Inclusive set the
+// line amounts already contained their tax; otherwise Total is added on top.
+type TaxResult struct {
+	Inclusive bool
+	Lines     []LineTax
+	Total     money.Money
+}
+
+// TaxCalculator works out the tax on lines delivered to an address
+type TaxCalculator interface {
+	Calculate(ctx context.Context, address TaxAddress, currency string, lines []TaxableLine) (*TaxResult, error)
+}
+
+// TaxRule is one row of the rules table. Empty Region and PostalPrefix
+// match any address in the country. Rate is a percentage.
+type TaxRule struct {
+	Country      string `json:"country"`
+	Region       string `json:"region"`
+	PostalPrefix string `json:"postal_prefix"`
+	TaxClass     string `json:"tax_class"`
+	Rate         string `json:"rate"`
+	Name         string `json:"name"`
+
+	rate *big.Rat
+}
+
+// matches reports whether the rule covers class at address, and how
+// specific it is
+func (rule *TaxRule) matches(address TaxAddress, class string) (bool, int) {
+	if rule.TaxClass != class {
+		return false, 0
+	}
+	return address.within(rule.Country, rule.Region, rule.PostalPrefix)
+}
+
+// within reports whether the address lies in an area given by country and
+// optional region and postal prefix, and how specific the area is: a
+// postal prefix beats a region, which beats the whole country
+func (address TaxAddress) within(country, region, postalPrefix string) (bool, int) {
+	if country != address.Country {
+		return false, 0
+	}
+	specificity := 0
+	if region != "" {
+		if region != address.Region {
+			return false, 0
+		}
+		specificity = 1
+	}
+	if postalPrefix != "" {
+		if !strings.HasPrefix(address.PostalCode, postalPrefix) {
+			return false, 0
+		}
+		specificity = 2 + len(postalPrefix)
+	}
+	return true, specificity
+}
+
+// TableTaxCalculator reads rules from a JSON file of the form
+//
+//	{"prices_include_tax": false, "rules": [
+//		{"country": "US", "region": "CA", "tax_class": "standard", "rate": "7.25", "name": "CA sales tax"},
+//		{"country": "GB", "tax_class": "reduced", "rate": "5", "name": "VAT"}]}
+//
+// The most specific rule for the address and the product's tax class
+// applies; classes with no rule for the address are not taxed. The file is
+// read again when it changes, so rates can be updated without a restart.
+type TableTaxCalculator struct {
+	Path string
+
+	mu        sync.Mutex
+	modified  time.Time
+	inclusive bool
+	rules     []TaxRule
+}
+
+type taxFile struct {
+	PricesIncludeTax bool      `json:"prices_include_tax"`
+	Rules            []TaxRule `json:"rules"`
+}
+
+// NewTableTaxCalculator loads the rules file at path
+func NewTableTaxCalculator(path string) (*TableTaxCalculator, error) {
+	calculator := &TableTaxCalculator{Path: path}
+	if err := calculator.reload(); err != nil {
+		return nil, err
+	}
+	return calculator, nil
+}
+
+// reload reads the file if it changed since the last read. The caller
+// holds mu, or the calculator is not shared yet.
+func (c *TableTaxCalculator) reload() error {
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(c.modified) && c.rules != nil {
+		return nil
+	}
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	var file taxFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("tax rules %s: %w", c.Path, err)
+	}
+	rules := make([]TaxRule, 0, len(file.Rules))
+	for i, rule := range file.Rules {
+		rule.Country = strings.ToUpper(strings.TrimSpace(rule.Country))
+		rule.Region = strings.ToUpper(strings.TrimSpace(rule.Region))
+		rule.PostalPrefix = strings.ToUpper(strings.ReplaceAll(rule.PostalPrefix, " ", ""))
+		if rule.TaxClass == "" {
+			rule.TaxClass = DefaultTaxClass
+		}
+		rate, ok := new(big.Rat).SetString(rule.Rate)
+		if !ok || rate.Sign() < 0 || rule.Country == "" {
+			return fmt.Errorf("tax rules %s: rule %d needs a country and a rate of 0 or more", c.Path, i+1)
+		}
+		rule.rate = rate
+		rules = append(rules, rule)
+	}
+	c.modified = info.ModTime()
+	c.inclusive = file.PricesIncludeTax
+	c.rules = rules
+	return nil
+}
+
+func (c *TableTaxCalculator) Calculate(ctx context.Context, address TaxAddress, currency string, lines []TaxableLine) (*TaxResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Keep using the last good rules if the file is being rewritten
+	_ = c.reload()
+	address = address.normalize()
+	result := &TaxResult{Inclusive: c.inclusive, Lines: make([]LineTax, len(lines)), Total: money.Zero(currency)}
+	for i, line := range lines {
+		class := line.TaxClass
+		if class == "" {
+			class = DefaultTaxClass
+		}
+		var best *TaxRule
+		bestSpecificity := -1
+		for j := range c.rules {
+			if ok, specificity := c.rules[j].matches(address, class); ok && specificity > bestSpecificity {
+				best, bestSpecificity = &c.rules[j], specificity
+			}
+		}
+		tax := LineTax{Rate: "0", Tax: money.Zero(currency)}
+		if best != nil {
+			tax.Name, tax.Rate = best.Name, best.Rate
+			tax.Tax = lineTax(line.Amount, best.rate, c.inclusive)
+		}
+		result.Lines[i] = tax
+		result.Total = result.Total.Add(tax.Tax)
+	}
+	return result, nil
+}
+
+// lineTax is percent of amount, or the part of amount that is tax when
+// amount already includes it, rounded half to even
+func lineTax(amount money.Money, percent *big.Rat, inclusive bool) money.Money {
+	ratio := new(big.Rat).Quo(percent, big.NewRat(100, 1))
+	if inclusive {
+		// tax = amount * rate / (1 + rate)
+		ratio.Quo(ratio, new(big.Rat).Add(big.NewRat(1, 1), ratio))
+	}
+	return amount.Mul(ratio)
+}
+
+// noTax is used when no rules file is configured
+type noTax struct{}
+
+func (noTax) Calculate(ctx context.Context, address TaxAddress, currency string, lines []TaxableLine) (*TaxResult, error) {
+	result := &TaxResult{Lines: make([]LineTax, len(lines)), Total: money.Zero(currency)}
+	for i := range lines {
+		result.Lines[i] = LineTax{Rate: "0", Tax: money.Zero(currency)}
+	}
+	return result, nil
+}
+
+// MigrateTaxes gives orders placed before tax was calculated a zero tax in
+// their own currency
+func MigrateTaxes(db *gorm.DB) error {
+	statements := []string{
+		`UPDATE orders SET tax_total_currency = total_currency WHERE tax_total_currency IS NULL`,
+		`UPDATE order_lines SET tax_currency = unit_price_currency, tax_rate = '0' WHERE tax_currency IS NULL`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTaxCalculator reads TAX_RULES_FILE. Without it nothing is taxed.
+func newTaxCalculator() (TaxCalculator, error) {
+	path := os.Getenv("TAX_RULES_FILE")
+	if path == "" {
+		return noTax{}, nil
+	}
+	return NewTableTaxCalculator(path)
+}
+
+// taxLines turns discounted lines into taxable lines
+func taxLines(lines []*discountLine, classes []string) []TaxableLine {
+	taxable := make([]TaxableLine, len(lines))
+	for i, line := range lines {
+		taxable[i] = TaxableLine{TaxClass: classes[i], Amount: line.remaining()}
+	}
+	return taxable
+}
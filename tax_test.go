@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"golang_api/money"
+)
+
+func TestLineTax(t *testing.T) {
+	tests := []struct {
+		amount    money.Money
+		rate      string
+		inclusive bool
+		want      int64
+	}{
+		{money.New(10000, "USD"), "20", false, 2000},
+		{money.New(12000, "USD"), "20", true, 2000},
+		{money.New(1999, "USD"), "7.25", false, 145},
+		{money.New(1000, "USD"), "20", true, 167},
+		{money.New(1000, "JPY"), "10", true, 91},
+		{money.New(250, "USD"), "10", false, 25},
+		{money.New(50, "USD"), "5", false, 2},
+		{money.New(-1000, "USD"), "20", false, -200},
+		{money.New(1000, "USD"), "0", true, 0},
+	}
+	for _, test := range tests {
+		rate, _ := new(big.Rat).SetString(test.rate)
+		got := lineTax(test.amount, rate, test.inclusive)
+		if got.Amount != test.want || got.Currency != test.amount.Currency {
+			t.Errorf("lineTax(%v, %s%%, inclusive %v) = %v, want %d", test.amount, test.rate, test.inclusive, got, test.want)
+		}
+	}
+}
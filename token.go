@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token has expired")
+)
+
+// AccessClaims is the payload of an access token
+type AccessClaims struct {
+	Subject   uint   `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// TokenIssuer signs and verifies HS256 JWT access tokens
+type TokenIssuer struct {
+	Secret     []byte
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign issues an access token for the given account
+func (t *TokenIssuer) Sign(accountID uint, now time.Time) (string, error) {
+	claims := AccessClaims{
+		Subject:   accountID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(t.AccessTTL).Unix(),
+		ID:        randomToken(12),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + t.signature(unsigned), nil
+}
+
+// Parse verifies an access token and returns its claims
+func (t *TokenIssuer) Parse(token string, now time.Time) (*AccessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errInvalidToken
+	}
+	expected := t.signature(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	claims := &AccessClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, errExpiredToken
+	}
+	return claims, nil
+}
+
+func (t *TokenIssuer) signature(unsigned string) string {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newTokenIssuer reads JWT_SECRET, ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL
+func newTokenIssuer() (*TokenIssuer, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, errors.New("JWT_SECRET is not set")
+	}
+	issuer := &TokenIssuer{
+		Secret:     []byte(secret),
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: 30 * 24 * time.Hour,
+	}
+	var err error
+	if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+		if issuer.AccessTTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, err
+		}
+	}
+	if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+		if issuer.RefreshTTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, err
+		}
+	}
+	return issuer, nil
+}
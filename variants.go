@@ -0,0 +1,876 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+var (
+	errVariantRequired = errors.New("product has variants; choose one")
+	errVariantNotFound = errors.New("variant not found")
+)
+
+// Struct ProductOption
+// An option type such as size or colour, with the values a variant may pick.
+type ProductOption struct {
+	ID        uint                 `json:"id" gorm:"primary_key"`
+	ProductID uint                 `json:"-" gorm:"index;not null"`
+	Name      string               `json:"name" gorm:"not null"`
+	Position  int                  `json:"position"`
+	Values    []ProductOptionValue `json:"values" gorm:"-"`
+}
+
+// Struct ProductOptionValue
+type ProductOptionValue struct {
+	ID       uint   `json:"id" gorm:"primary_key"`
+	OptionID uint   `json:"-" gorm:"index;not null"`
+	Value    string `json:"value" gorm:"not null"`
+	Position int    `json:"position"`
+}
+
+// Struct ProductVariant
+// Price overrides the product price when set. Stock is kept per variant and
+// the product quantity is their sum.
+type ProductVariant struct {
+	ID        uint         `json:"id" gorm:"primary_key"`
+	ProductID uint         `json:"product_id" gorm:"index;not null"`
+	SKU       string       `json:"sku" gorm:"not null"`
+	Barcode   string       `json:"barcode"`
+	Price     *money.Money `json:"price" gorm:"-"`
+	Quantity  int          `json:"quantity"`
+	// Available is Quantity less the units held by pending orders
+	Available int `json:"available" gorm:"-"`
+	// PriceAmount and PriceCurrency store Price; both are null without an
+	// override
+	PriceAmount   *int64            `json:"-" gorm:"type:bigint"`
+	PriceCurrency *string           `json:"-" gorm:"type:char(3)"`
+	Options       map[string]string `json:"options" gorm:"-"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+	DeletedAt     *time.Time        `json:"-" sql:"index"`
+}
+
+// AfterFind rebuilds Price from its columns
+func (variant *ProductVariant) AfterFind() error {
+	variant.Price = nil
+	if variant.PriceAmount != nil && variant.PriceCurrency != nil {
+		price := money.New(*variant.PriceAmount, *variant.PriceCurrency)
+		variant.Price = &price
+	}
+	return nil
+}
+
+// BeforeSave copies Price into its columns
+func (variant *ProductVariant) BeforeSave() error {
+	variant.PriceAmount, variant.PriceCurrency = nil, nil
+	if variant.Price != nil {
+		amount, currency := variant.Price.Amount, variant.Price.Currency
+		variant.PriceAmount, variant.PriceCurrency = &amount, &currency
+	}
+	return nil
+}
+
+// Struct VariantOptionValue
+type VariantOptionValue struct {
+	VariantID     uint `gorm:"primary_key;auto_increment:false"`
+	OptionValueID uint `gorm:"primary_key;auto_increment:false;index"`
+}
+
+// Struct ProductOptionsRequest
+type ProductOptionsRequest struct {
+	Options []struct {
+		Name   string   `json:"name"`
+		Values []string `json:"values"`
+	} `json:"options"`
+}
+
+// Struct VariantRequest
+// Options maps each option name of the product to the chosen value.
+type VariantRequest struct {
+	SKU      *string            `json:"sku"`
+	Barcode  *string            `json:"barcode"`
+	Price    json.RawMessage    `json:"price"`
+	Quantity *int               `json:"quantity"`
+	Options  *map[string]string `json:"options"`
+}
+
+// Struct VariantMatrix
+type VariantMatrix struct {
+	Options  []ProductOption  `json:"options"`
+	Variants []ProductVariant `json:"variants"`
+	// Missing lists the option combinations no variant covers yet
+	Missing []map[string]string `json:"missing"`
+}
+
+// MigrateVariants creates the option and variant tables
+func MigrateVariants(db *gorm.DB) error {
+	err := db.AutoMigrate(&ProductOption{}, &ProductOptionValue{}, &ProductVariant{}, &VariantOptionValue{}).Error
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_product_variants_sku ON product_variants (sku)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_product_options_name ON product_options (product_id, lower(name))`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_product_option_values_value
+			ON product_option_values (option_id, lower(value))`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasVariants reports whether the product sells through variants
+func hasVariants(db *gorm.DB, productID uint) (bool, error) {
+	var count int
+	err := db.Model(&ProductVariant{}).Where("product_id = ?", productID).Count(&count).Error
+	return count > 0, err
+}
+
+// sellableItem is what a cart or order line points at: a product, or one
+// variant of it
+type sellableItem struct {
+	ProductID uint
+	VariantID uint
+	SKU       string
+	Title     string
+	Price     money.Money
+	Available int
+}
+
+// findSellable resolves a product and optional variant for the cart.
+// Products with variants must be bought through one of them.
+func findSellable(db *gorm.DB, productID, variantID uint) (*sellableItem, error) {
+	var product Product
+	if err := db.Where("id = ?", productID).First(&product).Error; err != nil {
+		return nil, err
+	}
+	item := &sellableItem{
+		ProductID: product.ID,
+		SKU:       product.SKU,
+		Title:     product.Title,
+		Price:     product.Price,
+	}
+	heldByProduct, heldByItem, err := heldStock(db, []uint{product.ID})
+	if err != nil {
+		return nil, err
+	}
+	item.Available = availableToSell(product.Quantity, heldByProduct[product.ID])
+	if variantID == 0 {
+		withVariants, err := hasVariants(db, product.ID)
+		if err != nil {
+			return nil, err
+		}
+		if withVariants {
+			return nil, errVariantRequired
+		}
+		return item, nil
+	}
+	var variant ProductVariant
+	err = db.Where("id = ? AND product_id = ?", variantID, productID).First(&variant).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, errVariantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	item.VariantID = variant.ID
+	item.SKU = variant.SKU
+	item.Available = availableToSell(variant.Quantity, heldByItem[stockKey{product.ID, variant.ID}])
+	if variant.Price != nil {
+		item.Price = *variant.Price
+	}
+	return item, nil
+}
+
+// syncProductQuantity sets the quantity of a product with variants to the
+// sum of its variants' stock so listings and filters stay correct
+func syncProductQuantity(tx *gorm.DB, productID uint) error {
+	return tx.Exec(`UPDATE product SET quantity = (
+			SELECT coalesce(sum(quantity), 0) FROM product_variants
+			WHERE product_id = ? AND deleted_at IS NULL)
+		WHERE id = ? AND EXISTS (SELECT 1 FROM product_variants WHERE product_id = ? AND deleted_at IS NULL)`,
+		productID, productID, productID).Error
+}
+
+// adjustStock changes the stock of a product or one of its variants
+func adjustStock(tx *gorm.DB, productID, variantID uint, delta int) error {
+	if variantID == 0 {
+		return tx.Model(&Product{}).
+			Where("id = ?", productID).
+			Update("quantity", gorm.Expr("quantity + ?", delta)).Error
+	}
+	// Lock the product first, the same order checkout uses
+	if _, err := lockProduct(tx, productID); err != nil {
+		return err
+	}
+	err := tx.Unscoped().Model(&ProductVariant{}).
+		Where("id = ?", variantID).
+		Update("quantity", gorm.Expr("quantity + ?", delta)).Error
+	if err != nil {
+		return err
+	}
+	return syncProductQuantity(tx, productID)
+}
+
+// loadOptions returns the product's options with their values, in order
+func loadOptions(db *gorm.DB, productID uint) ([]ProductOption, error) {
+	byProduct, err := loadOptionsFor(db, []uint{productID})
+	if err != nil {
+		return nil, err
+	}
+	return byProduct[productID], nil
+}
+
+// loadOptionsFor loads the options of several products at once
+func loadOptionsFor(db *gorm.DB, productIDs []uint) (map[uint][]ProductOption, error) {
+	byProduct := map[uint][]ProductOption{}
+	for _, id := range productIDs {
+		byProduct[id] = []ProductOption{}
+	}
+	var options []ProductOption
+	if err := db.Where("product_id IN (?)", productIDs).Order("position, id").Find(&options).Error; err != nil {
+		return nil, err
+	}
+	if len(options) == 0 {
+		return byProduct, nil
+	}
+	ids := make([]uint, len(options))
+	values := map[uint][]ProductOptionValue{}
+	for i, option := range options {
+		ids[i] = option.ID
+	}
+	var rows []ProductOptionValue
+	if err := db.Where("option_id IN (?)", ids).Order("position, id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, value := range rows {
+		values[value.OptionID] = append(values[value.OptionID], value)
+	}
+	for _, option := range options {
+		option.Values = values[option.ID]
+		if option.Values == nil {
+			option.Values = []ProductOptionValue{}
+		}
+		byProduct[option.ProductID] = append(byProduct[option.ProductID], option)
+	}
+	return byProduct, nil
+}
+
+// preloadProductVariants loads the options and variants shown with products
+func preloadProductVariants(db *gorm.DB, products []*Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(products))
+	byID := map[uint]*Product{}
+	for i, product := range products {
+		ids[i] = product.ID
+		byID[product.ID] = product
+		product.Variants = []ProductVariant{}
+	}
+	options, err := loadOptionsFor(db, ids)
+	if err != nil {
+		return err
+	}
+	var variants []ProductVariant
+	if err := db.Where("product_id IN (?)", ids).Order("id").Find(&variants).Error; err != nil {
+		return err
+	}
+	if err := preloadVariants(db, variants); err != nil {
+		return err
+	}
+	for _, variant := range variants {
+		product := byID[variant.ProductID]
+		product.Variants = append(product.Variants, variant)
+	}
+	for _, product := range products {
+		product.Options = options[product.ID]
+	}
+	return nil
+}
+
+// preloadVariants fills in the option names and values of each variant
+func preloadVariants(db *gorm.DB, variants []ProductVariant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(variants))
+	byID := map[uint]*ProductVariant{}
+	for i := range variants {
+		ids[i] = variants[i].ID
+		byID[variants[i].ID] = &variants[i]
+		variants[i].Options = map[string]string{}
+	}
+	var rows []struct {
+		VariantID uint
+		Name      string
+		Value     string
+	}
+	err := db.Table("variant_option_values").
+		Select("variant_option_values.variant_id, product_options.name, product_option_values.value").
+		Joins("JOIN product_option_values ON product_option_values.id = variant_option_values.option_value_id").
+		Joins("JOIN product_options ON product_options.id = product_option_values.option_id").
+		Where("variant_option_values.variant_id IN (?)", ids).
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		byID[row.VariantID].Options[row.Name] = row.Value
+	}
+	return nil
+}
+
+// loadVariantMatrix returns the options, variants and uncovered
+// combinations of a product
+func loadVariantMatrix(db *gorm.DB, productID uint) (*VariantMatrix, error) {
+	options, err := loadOptions(db, productID)
+	if err != nil {
+		return nil, err
+	}
+	variants := []ProductVariant{}
+	if err := db.Where("product_id = ?", productID).Order("id").Find(&variants).Error; err != nil {
+		return nil, err
+	}
+	if err := preloadVariants(db, variants); err != nil {
+		return nil, err
+	}
+	matrix := &VariantMatrix{Options: options, Variants: variants, Missing: []map[string]string{}}
+	if len(options) == 0 {
+		return matrix, nil
+	}
+	covered := map[string]bool{}
+	for _, variant := range variants {
+		covered[combinationKey(options, variant.Options)] = true
+	}
+	for _, combination := range combinations(options) {
+		if !covered[combinationKey(options, combination)] {
+			matrix.Missing = append(matrix.Missing, combination)
+		}
+	}
+	return matrix, nil
+}
+
+// combinations lists every choice of one value per option
+func combinations(options []ProductOption) []map[string]string {
+	result := []map[string]string{{}}
+	for _, option := range options {
+		var next []map[string]string
+		for _, partial := range result {
+			for _, value := range option.Values {
+				combination := map[string]string{option.Name: value.Value}
+				for name, chosen := range partial {
+					combination[name] = chosen
+				}
+				next = append(next, combination)
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// combinationKey identifies a combination independent of map order and case
+func combinationKey(options []ProductOption, combination map[string]string) string {
+	parts := make([]string, len(options))
+	for i, option := range options {
+		parts[i] = strings.ToLower(combination[option.Name])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// resolveVariantOptions checks that choice names exactly one value of every
+// option of the product and returns the value ids. Option names and values
+// are matched case-insensitively and stored with the product's spelling.
+func resolveVariantOptions(options []ProductOption, choice map[string]string) ([]uint, map[string]string, map[string]string) {
+	problems := map[string]string{}
+	if len(options) == 0 {
+		problems["options"] = "the product has no option types; define them first"
+		return nil, nil, problems
+	}
+	remaining := map[string]string{}
+	for name, value := range choice {
+		remaining[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	var ids []uint
+	canonical := map[string]string{}
+	for _, option := range options {
+		value, ok := remaining[strings.ToLower(option.Name)]
+		if !ok {
+			problems["options."+option.Name] = "is required"
+			continue
+		}
+		delete(remaining, strings.ToLower(option.Name))
+		found := false
+		for _, candidate := range option.Values {
+			if strings.EqualFold(candidate.Value, value) {
+				ids = append(ids, candidate.ID)
+				canonical[option.Name] = candidate.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems["options."+option.Name] = fmt.Sprintf("%q is not one of its values", value)
+		}
+	}
+	for name := range remaining {
+		problems["options."+name] = "is not an option of this product"
+	}
+	return ids, canonical, problems
+}
+
+// validateVariant checks SKU, price, stock and the option combination of a
+// variant against the other variants of the product
+func validateVariant(db *gorm.DB, variant *ProductVariant, options []ProductOption) (map[string]string, error) {
+	problems := map[string]string{}
+	if variant.SKU == "" {
+		problems["sku"] = "must not be empty"
+	}
+	if variant.Price != nil && variant.Price.IsNegative() {
+		problems["price"] = "must not be negative"
+	}
+	if variant.Quantity < 0 {
+		problems["quantity"] = "must not be negative"
+	}
+	var count int
+	// SKUs are unique across products and variants, deleted ones included
+	err := db.Unscoped().Model(&ProductVariant{}).Where("sku = ? AND id <> ?", variant.SKU, variant.ID).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		if err := db.Unscoped().Model(&Product{}).Where("sku = ?", variant.SKU).Count(&count).Error; err != nil {
+			return nil, err
+		}
+	}
+	if count > 0 {
+		problems["sku"] = "is already used by another product or variant"
+	}
+	if variant.Barcode != "" {
+		err := db.Model(&ProductVariant{}).Where("barcode = ? AND id <> ?", variant.Barcode, variant.ID).Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			problems["barcode"] = "is already used by another variant"
+		}
+	}
+
+	var siblings []ProductVariant
+	if err := db.Where("product_id = ? AND id <> ?", variant.ProductID, variant.ID).Find(&siblings).Error; err != nil {
+		return nil, err
+	}
+	if err := preloadVariants(db, siblings); err != nil {
+		return nil, err
+	}
+	key := combinationKey(options, variant.Options)
+	for _, sibling := range siblings {
+		if combinationKey(options, sibling.Options) == key {
+			problems["options"] = fmt.Sprintf("the combination is already used by variant %s", sibling.SKU)
+		}
+	}
+	return problems, nil
+}
+
+// lockProduct row-locks a product before its options or variants change
+func lockProduct(tx *gorm.DB, productID uint) (*Product, error) {
+	product := &Product{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", productID).First(product).Error
+	return product, err
+}
+
+func respondInvalidVariant(context *fiber.Ctx, problems map[string]string) error {
+	context.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+		"message": "Invalid variant",
+		"errors":  problems,
+	})
+	return nil
+}
+
+// variantError carries validation problems out of a transaction
+type variantError struct {
+	Problems map[string]string
+}
+
+func (e *variantError) Error() string { return "invalid variant" }
+
+// respondVariantError writes the response for errors returned by variant
+// and option changes
+func respondVariantError(context *fiber.Ctx, err error) error {
+	var invalid *variantError
+	switch {
+	case errors.As(err, &invalid):
+		return respondInvalidVariant(context, invalid.Problems)
+	case errors.Is(err, errVariantNotFound):
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Variant not found"})
+		return nil
+	case gorm.IsRecordNotFoundError(err):
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Product not found"})
+		return nil
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to update variants"})
+	return err
+}
+
+// Get the options, variants and missing combinations of a product
+func (r *Repository) GetProductVariants(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	matrix, err := loadVariantMatrix(r.DB, product.ID)
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve variants"})
+		return err
+	}
+	product.Variants = matrix.Variants
+	if err := preloadAvailability(r.DB, []*Product{product}); err != nil {
+		return err
+	}
+	if err := r.localizeProducts(context, []*Product{product}); err != nil {
+		return err
+	}
+	return context.JSON(matrix)
+}
+
+// Set the option types of a product. Options and values are matched by
+// name; new values may be added at any time, but option types can only be
+// added or removed while the product has no variants, and values in use by
+// a variant cannot be removed.
+func (r *Repository) SetProductOptions(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	request := ProductOptionsRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	problems := map[string]string{}
+	seenOptions := map[string]bool{}
+	for i, option := range request.Options {
+		name := strings.TrimSpace(option.Name)
+		field := "options." + strconv.Itoa(i)
+		if name == "" {
+			problems[field+".name"] = "must not be empty"
+		} else if seenOptions[strings.ToLower(name)] {
+			problems[field+".name"] = "is used twice"
+		}
+		seenOptions[strings.ToLower(name)] = true
+		if len(option.Values) == 0 {
+			problems[field+".values"] = "must not be empty"
+		}
+		seenValues := map[string]bool{}
+		for _, value := range option.Values {
+			value = strings.ToLower(strings.TrimSpace(value))
+			if value == "" || seenValues[value] {
+				problems[field+".values"] = "must be distinct and not empty"
+			}
+			seenValues[value] = true
+		}
+	}
+	if len(problems) > 0 {
+		return respondInvalidVariant(context, problems)
+	}
+
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockProduct(tx, product.ID); err != nil {
+			return err
+		}
+		existing, err := loadOptions(tx, product.ID)
+		if err != nil {
+			return err
+		}
+		withVariants, err := hasVariants(tx, product.ID)
+		if err != nil {
+			return err
+		}
+		byName := map[string]ProductOption{}
+		for _, option := range existing {
+			byName[strings.ToLower(option.Name)] = option
+		}
+		if withVariants {
+			changed := len(existing) != len(request.Options)
+			for _, option := range request.Options {
+				if _, ok := byName[strings.ToLower(strings.TrimSpace(option.Name))]; !ok {
+					changed = true
+				}
+			}
+			if changed {
+				return &variantError{map[string]string{
+					"options": "option types cannot change while the product has variants",
+				}}
+			}
+		}
+
+		kept := map[uint]bool{}
+		for position, requested := range request.Options {
+			name := strings.TrimSpace(requested.Name)
+			option, ok := byName[strings.ToLower(name)]
+			if !ok {
+				option = ProductOption{ProductID: product.ID}
+			}
+			option.Name = name
+			option.Position = position
+			values := option.Values
+			option.Values = nil
+			if err := tx.Save(&option).Error; err != nil {
+				return err
+			}
+			kept[option.ID] = true
+
+			keptValues := map[uint]bool{}
+			for valuePosition, raw := range requested.Values {
+				raw = strings.TrimSpace(raw)
+				value := ProductOptionValue{OptionID: option.ID}
+				for _, candidate := range values {
+					if strings.EqualFold(candidate.Value, raw) {
+						value = candidate
+					}
+				}
+				value.Value = raw
+				value.Position = valuePosition
+				if err := tx.Save(&value).Error; err != nil {
+					return err
+				}
+				keptValues[value.ID] = true
+			}
+			for _, value := range values {
+				if keptValues[value.ID] {
+					continue
+				}
+				var used int
+				tx.Model(&VariantOptionValue{}).Where("option_value_id = ?", value.ID).Count(&used)
+				if used > 0 {
+					return &variantError{map[string]string{
+						"options." + name: fmt.Sprintf("%q is used by a variant", value.Value),
+					}}
+				}
+				if err := tx.Delete(&value).Error; err != nil {
+					return err
+				}
+			}
+		}
+		for _, option := range existing {
+			if kept[option.ID] {
+				continue
+			}
+			if err := tx.Where("option_id = ?", option.ID).Delete(&ProductOptionValue{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&option).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return respondVariantError(context, err)
+	}
+	return r.GetProductVariants(context)
+}
+
+// saveVariant validates a variant and stores it with its option values
+func saveVariant(tx *gorm.DB, variant *ProductVariant, choice *map[string]string) error {
+	options, err := loadOptions(tx, variant.ProductID)
+	if err != nil {
+		return err
+	}
+	var valueIDs []uint
+	problems := map[string]string{}
+	if choice != nil {
+		valueIDs, variant.Options, problems = resolveVariantOptions(options, *choice)
+	} else {
+		variants := []ProductVariant{*variant}
+		if err := preloadVariants(tx, variants); err != nil {
+			return err
+		}
+		variant.Options = variants[0].Options
+	}
+	if len(problems) == 0 {
+		var err error
+		if problems, err = validateVariant(tx, variant, options); err != nil {
+			return err
+		}
+	}
+	if len(problems) > 0 {
+		return &variantError{problems}
+	}
+	if err := tx.Save(variant).Error; err != nil {
+		return err
+	}
+	if choice != nil {
+		if err := tx.Where("variant_id = ?", variant.ID).Delete(&VariantOptionValue{}).Error; err != nil {
+			return err
+		}
+		sort.Slice(valueIDs, func(i, j int) bool { return valueIDs[i] < valueIDs[j] })
+		for _, id := range valueIDs {
+			link := VariantOptionValue{VariantID: variant.ID, OptionValueID: id}
+			if err := tx.Create(&link).Error; err != nil {
+				return err
+			}
+		}
+	}
+	if err := setOnHand(tx, variant.ProductID, variant.ID, variant.Quantity); err != nil {
+		return err
+	}
+	return syncProductQuantity(tx, variant.ProductID)
+}
+
+// apply copies the fields present in the request onto variant. Prices are
+// in the currency of the product.
+func (request *VariantRequest) apply(variant *ProductVariant, currency string) map[string]string {
+	problems := map[string]string{}
+	if request.SKU != nil {
+		variant.SKU = strings.TrimSpace(*request.SKU)
+	}
+	if request.Barcode != nil {
+		variant.Barcode = strings.TrimSpace(*request.Barcode)
+	}
+	// null removes the override
+	if len(request.Price) > 0 && string(request.Price) != "null" {
+		var input money.Input
+		price, err := money.Money{}, json.Unmarshal(request.Price, &input)
+		if err == nil {
+			price, err = input.In(currency)
+		}
+		if err != nil {
+			problems["price"] = err.Error()
+		} else if price.Currency != currency {
+			problems["price"] = "must be in the product currency " + currency
+		}
+		variant.Price = &price
+	} else if len(request.Price) > 0 {
+		variant.Price = nil
+	}
+	if request.Quantity != nil {
+		variant.Quantity = *request.Quantity
+	}
+	return problems
+}
+
+// Create a variant of a product
+func (r *Repository) CreateProductVariant(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	request := VariantRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	problems := map[string]string{}
+	if request.SKU == nil {
+		problems["sku"] = "is required"
+	}
+	if request.Options == nil {
+		problems["options"] = "is required"
+	}
+	if len(problems) > 0 {
+		return respondInvalidVariant(context, problems)
+	}
+	variant := &ProductVariant{ProductID: product.ID}
+	if problems := request.apply(variant, product.Price.Currency); len(problems) > 0 {
+		return respondInvalidVariant(context, problems)
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockProduct(tx, product.ID); err != nil {
+			return err
+		}
+		return saveVariant(tx, variant, request.Options)
+	})
+	if err != nil {
+		return respondVariantError(context, err)
+	}
+	return context.Status(http.StatusCreated).JSON(variant)
+}
+
+// Update a variant
+func (r *Repository) UpdateProductVariant(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	request := VariantRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	variant := &ProductVariant{}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockProduct(tx, product.ID); err != nil {
+			return err
+		}
+		err := tx.Where("id = ? AND product_id = ?", context.Params("variant_id"), product.ID).First(variant).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return errVariantNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if problems := request.apply(variant, product.Price.Currency); len(problems) > 0 {
+			return &variantError{problems}
+		}
+		return saveVariant(tx, variant, request.Options)
+	})
+	if err != nil {
+		return respondVariantError(context, err)
+	}
+	return context.JSON(variant)
+}
+
+// Delete a variant. Like products, variants are soft deleted so past
+// orders still resolve them.
+func (r *Repository) DeleteProductVariant(context *fiber.Ctx) error {
+	product, err := r.findProduct(context)
+	if err != nil {
+		return respondProductLookupError(context, err)
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockProduct(tx, product.ID); err != nil {
+			return err
+		}
+		variant := ProductVariant{}
+		err := tx.Where("id = ? AND product_id = ?", context.Params("variant_id"), product.ID).First(&variant).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return errVariantNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&variant).Error; err != nil {
+			return err
+		}
+		return syncProductQuantity(tx, product.ID)
+	})
+	if err != nil {
+		return respondVariantError(context, err)
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Variant deleted successfully"})
+	return nil
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+
+	"golang_api/money"
+)
+
+// SavedForLater is the name of the list cart lines are saved to
+const SavedForLater = "Saved for later"
+
+const maxWishlistName = 100
+
+var errWishlistNotFound = errors.New("wishlist not found")
+
+// Struct Wishlist
+// A named list of products an account wants to keep track of. ShareToken
+// is set while the list is shared and lets anyone with it read the list.
+type Wishlist struct {
+	ID         uint           `json:"id" gorm:"primary_key"`
+	AccountID  uint           `json:"account_id" gorm:"unique_index:idx_wishlists_account_name;not null"`
+	Name       string         `json:"name" gorm:"unique_index:idx_wishlists_account_name;not null"`
+	ShareToken *string        `json:"share_token,omitempty" gorm:"unique_index"`
+	Items      []WishlistItem `json:"items,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+// Struct WishlistItem
+// WatchPrice is the store currency price last seen by the watch job and
+// InStock whether the item could be bought then; a lower price or a return
+// to stock notifies the owner if they asked for it.
+type WishlistItem struct {
+	ID                uint        `json:"id" gorm:"primary_key"`
+	WishlistID        uint        `json:"wishlist_id" gorm:"unique_index:idx_wishlist_items_item;not null"`
+	ProductID         uint        `json:"product_id" gorm:"unique_index:idx_wishlist_items_item;not null"`
+	VariantID         uint        `json:"variant_id" gorm:"unique_index:idx_wishlist_items_item;not null;default:0"`
+	NotifyPriceDrop   bool        `json:"notify_price_drop" gorm:"not null;default:false"`
+	NotifyBackInStock bool        `json:"notify_back_in_stock" gorm:"not null;default:false"`
+	WatchPrice        money.Money `json:"-" gorm:"embedded;embedded_prefix:watch_price_"`
+	InStock           bool        `json:"-" gorm:"not null;default:false"`
+	CreatedAt         time.Time   `json:"created_at"`
+	UpdatedAt         time.Time   `json:"updated_at"`
+
+	SKU       string       `json:"sku" gorm:"-"`
+	Title     string       `json:"title" gorm:"-"`
+	Price     *money.Money `json:"price,omitempty" gorm:"-"`
+	Available int          `json:"available" gorm:"-"`
+}
+
+// Struct WishlistRequest
+type WishlistRequest struct {
+	Name string `json:"name"`
+}
+
+// Struct WishlistItemRequest
+type WishlistItemRequest struct {
+	ProductID         uint `json:"product_id"`
+	VariantID         uint `json:"variant_id"`
+	NotifyPriceDrop   bool `json:"notify_price_drop"`
+	NotifyBackInStock bool `json:"notify_back_in_stock"`
+}
+
+// Struct MoveToCartRequest
+type MoveToCartRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// MigrateWishlists creates the wishlist tables
+func MigrateWishlists(db *gorm.DB) error {
+	return db.AutoMigrate(&Wishlist{}, &WishlistItem{}).Error
+}
+
+// wishlistWatchInterval reads WISHLIST_WATCH_INTERVAL, a duration such as
+// "1h" (the default)
+func wishlistWatchInterval() (time.Duration, error) {
+	value := os.Getenv("WISHLIST_WATCH_INTERVAL")
+	if value == "" {
+		return time.Hour, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("WISHLIST_WATCH_INTERVAL %q must be a positive duration", value)
+	}
+	return interval, nil
+}
+
+// wishlistFor loads one of the account's lists
+func wishlistFor(db *gorm.DB, accountID, wishlistID uint) (*Wishlist, error) {
+	wishlist := &Wishlist{}
+	err := db.Where("id = ? AND account_id = ?", wishlistID, accountID).First(wishlist).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, errWishlistNotFound
+	}
+	return wishlist, err
+}
+
+// savedForLater returns the account's saved-for-later list, creating it on
+// first use
+func savedForLater(db *gorm.DB, accountID uint) (*Wishlist, error) {
+	now := time.Now()
+	err := db.Exec(`INSERT INTO wishlists (account_id, name, created_at, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`, accountID, SavedForLater, now, now).Error
+	if err != nil {
+		return nil, err
+	}
+	wishlist := &Wishlist{}
+	err = db.Where("account_id = ? AND name = ?", accountID, SavedForLater).First(wishlist).Error
+	return wishlist, err
+}
+
+// addWishlistItem adds a product or variant to a list, or updates the
+// notification choices of an item already on it
+func addWishlistItem(tx *gorm.DB, wishlistID uint, request WishlistItemRequest) (*WishlistItem, error) {
+	sellable, err := findSellable(tx, request.ProductID, request.VariantID)
+	if err != nil {
+		return nil, err
+	}
+	item := &WishlistItem{}
+	err = tx.Where("wishlist_id = ? AND product_id = ? AND variant_id = ?",
+		wishlistID, request.ProductID, request.VariantID).First(item).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		item = &WishlistItem{
+			WishlistID: wishlistID,
+			ProductID:  request.ProductID,
+			VariantID:  request.VariantID,
+			WatchPrice: sellable.Price,
+			InStock:    sellable.Available > 0,
+		}
+	}
+	item.NotifyPriceDrop = request.NotifyPriceDrop
+	item.NotifyBackInStock = request.NotifyBackInStock
+	return item, tx.Save(item).Error
+}
+
+// preloadWishlistItems fills in the product details of the items, priced
+// in currency
+func (r *Repository) preloadWishlistItems(ctx context.Context, currency string, items []WishlistItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, item := range items {
+		ids = append(ids, item.ProductID)
+	}
+	var products []Product
+	if err := r.DB.Where("id IN (?)", ids).Find(&products).Error; err != nil {
+		return err
+	}
+	byID := map[uint]*Product{}
+	for i := range products {
+		byID[products[i].ID] = &products[i]
+	}
+	var variants []ProductVariant
+	if err := r.DB.Where("product_id IN (?)", ids).Find(&variants).Error; err != nil {
+		return err
+	}
+	if err := preloadVariants(r.DB, variants); err != nil {
+		return err
+	}
+	variantsByID := map[uint]*ProductVariant{}
+	for i := range variants {
+		variantsByID[variants[i].ID] = &variants[i]
+	}
+	heldByProduct, heldByItem, err := heldStock(r.DB, ids)
+	if err != nil {
+		return err
+	}
+	var prices []*localPrice
+	var priced []*WishlistItem
+	for i := range items {
+		item := &items[i]
+		product, ok := byID[item.ProductID]
+		if !ok {
+			// Deleted products stay listed without a price
+			item.Title = "Unavailable product"
+			continue
+		}
+		item.SKU, item.Title = product.SKU, product.Title
+		price, inherit := product.Price, true
+		item.Available = availableToSell(product.Quantity, heldByProduct[product.ID])
+		if item.VariantID != 0 {
+			variant, ok := variantsByID[item.VariantID]
+			if !ok {
+				item.Available = 0
+				continue
+			}
+			item.SKU = variant.SKU
+			item.Available = availableToSell(variant.Quantity, heldByItem[stockKey{product.ID, variant.ID}])
+			if variant.Price != nil {
+				price, inherit = *variant.Price, false
+			}
+		}
+		prices = append(prices, &localPrice{ProductID: product.ID, VariantID: item.VariantID, Base: price, Inherit: inherit})
+		priced = append(priced, item)
+	}
+	if _, err := r.localizePrices(ctx, r.DB, currency, prices); err != nil {
+		return err
+	}
+	for i, item := range priced {
+		price := prices[i].Local
+		item.Price = &price
+	}
+	return nil
+}
+
+func respondInvalidWishlist(context *fiber.Ctx, problems map[string]string) error {
+	context.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+		"message": "Invalid wishlist",
+		"errors":  problems,
+	})
+	return nil
+}
+
+// respondWishlistError writes the response for errors from wishlist changes
+func respondWishlistError(context *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errWishlistNotFound):
+		context.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Wishlist not found"})
+		return nil
+	case gorm.IsRecordNotFoundError(err), errors.Is(err, errVariantNotFound),
+		errors.Is(err, errVariantRequired), errors.Is(err, errInsufficientStock):
+		return respondCartError(context, err)
+	}
+	context.Status(http.StatusInternalServerError).JSON(
+		&fiber.Map{"message": "Failed to update wishlist"})
+	return err
+}
+
+// validateWishlistName reports problems with a list name for the account
+func validateWishlistName(db *gorm.DB, accountID, wishlistID uint, name string) (map[string]string, error) {
+	problems := map[string]string{}
+	if name == "" {
+		problems["name"] = "must not be empty"
+	} else if len(name) > maxWishlistName {
+		problems["name"] = "must be at most " + strconv.Itoa(maxWishlistName) + " characters"
+	} else {
+		var count int
+		err := db.Model(&Wishlist{}).
+			Where("account_id = ? AND lower(name) = lower(?) AND id <> ?", accountID, name, wishlistID).
+			Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			problems["name"] = "is already in use"
+		}
+	}
+	return problems, nil
+}
+
+// respondWishlist writes a list with its items priced in the request
+// currency
+func (r *Repository) respondWishlist(context *fiber.Ctx, wishlist *Wishlist, status int) error {
+	wishlist.Items = []WishlistItem{}
+	if err := r.DB.Where("wishlist_id = ?", wishlist.ID).Order("created_at, id").Find(&wishlist.Items).Error; err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve wishlist"})
+		return err
+	}
+	if err := r.preloadWishlistItems(context.Context(), r.requestCurrency(context), wishlist.Items); err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve wishlist"})
+		return err
+	}
+	return context.Status(status).JSON(wishlist)
+}
+
+// findCallerWishlist loads the caller's list named by the :id parameter
+func (r *Repository) findCallerWishlist(context *fiber.Ctx) (*Wishlist, error) {
+	id, err := parseIDParam(context, "id")
+	if err != nil {
+		return nil, errWishlistNotFound
+	}
+	return wishlistFor(r.DB, currentAccount(context).ID, id)
+}
+
+// List the caller's wishlists
+func (r *Repository) GetWishlists(context *fiber.Ctx) error {
+	wishlists := []Wishlist{}
+	err := r.DB.Where("account_id = ?", currentAccount(context).ID).Order("created_at, id").Find(&wishlists).Error
+	if err != nil {
+		context.Status(http.StatusInternalServerError).JSON(
+			&fiber.Map{"message": "Failed to retrieve wishlists"})
+		return err
+	}
+	return context.JSON(wishlists)
+}
+
+// Get one of the caller's wishlists with its items
+func (r *Repository) GetWishlist(context *fiber.Ctx) error {
+	wishlist, err := r.findCallerWishlist(context)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	return r.respondWishlist(context, wishlist, http.StatusOK)
+}
+
+// Create a wishlist
+func (r *Repository) CreateWishlist(context *fiber.Ctx) error {
+	request := WishlistRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	account := currentAccount(context)
+	wishlist := &Wishlist{AccountID: account.ID, Name: strings.TrimSpace(request.Name)}
+	problems, err := validateWishlistName(r.DB, account.ID, 0, wishlist.Name)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	if len(problems) > 0 {
+		return respondInvalidWishlist(context, problems)
+	}
+	if err := r.DB.Create(wishlist).Error; err != nil {
+		return respondWishlistError(context, err)
+	}
+	return r.respondWishlist(context, wishlist, http.StatusCreated)
+}
+
+// Rename a wishlist
+func (r *Repository) UpdateWishlist(context *fiber.Ctx) error {
+	wishlist, err := r.findCallerWishlist(context)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	request := WishlistRequest{}
+	if err := context.BodyParser(&request); err != nil {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	name := strings.TrimSpace(request.Name)
+	problems, err := validateWishlistName(r.DB, wishlist.AccountID, wishlist.ID, name)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	if len(problems) > 0 {
+		return respondInvalidWishlist(context, problems)
+	}
+	if err := r.DB.Model(wishlist).Update("name", name).Error; err != nil {
+		return respondWishlistError(context, err)
+	}
+	return r.respondWishlist(context, wishlist, http.StatusOK)
+}
+
+// Delete a wishlist and its items
+func (r *Repository) DeleteWishlist(context *fiber.Ctx) error {
+	wishlist, err := r.findCallerWishlist(context)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("wishlist_id = ?", wishlist.ID).Delete(&WishlistItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(wishlist).Error
+	})
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Wishlist deleted successfully"})
+	return nil
+}
+
+// Add a product to a wishlist. Adding it again updates its notification
+// choices.
+func (r *Repository) AddWishlistItem(context *fiber.Ctx) error {
+	wishlist, err := r.findCallerWishlist(context)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	request := WishlistItemRequest{}
+	if err := context.BodyParser(&request); err != nil || request.ProductID == 0 {
+		context.Status(http.StatusUnprocessableEntity).JSON(
+			&fiber.Map{"message": "Invalid request"})
+		return nil
+	}
+	if _, err := addWishlistItem(r.DB, wishlist.ID, request); err != nil {
+		return respondWishlistError(context, err)
+	}
+	return r.respondWishlist(context, wishlist, http.StatusOK)
+}
+
+// Remove an item from a wishlist
+func (r *Repository) RemoveWishlistItem(context *fiber.Ctx) error {
+	wishlist, err := r.findCallerWishlist(context)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	itemID, err := parseIDParam(context, "item_id")
+	if err == nil {
+		err = r.DB.Where("id = ? AND wishlist_id = ?", itemID, wishlist.ID).Delete(&WishlistItem{}).Error
+	}
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return respondWishlistError(context, err)
+	}
+	return r.respondWishlist(context, wishlist, http.StatusOK)
+}
+
+// Move a wishlist item into the caller's cart. quantity defaults to 1.
+func (r *Repository) MoveWishlistItemToCart(ctx *fiber.Ctx) error {
+	wishlist, err := r.findCallerWishlist(ctx)
+	if err != nil {
+		return respondWishlistError(ctx, err)
+	}
+	request := MoveToCartRequest{Quantity: 1}
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(&request); err != nil || request.Quantity <= 0 {
+			ctx.Status(http.StatusUnprocessableEntity).JSON(
+				&fiber.Map{"message": "Invalid request"})
+			return nil
+		}
+	}
+	itemID, err := parseIDParam(ctx, "item_id")
+	item := &WishlistItem{}
+	if err == nil {
+		err = r.DB.Where("id = ? AND wishlist_id = ?", itemID, wishlist.ID).First(item).Error
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		ctx.Status(http.StatusNotFound).JSON(
+			&fiber.Map{"message": "Wishlist item not found"})
+		return nil
+	}
+	if err != nil {
+		return respondWishlistError(ctx, err)
+	}
+	cart, err := cartForAccount(r.DB, wishlist.AccountID)
+	if err == nil {
+		err = r.DB.Transaction(func(tx *gorm.DB) error {
+			if err := lockCart(tx, cart.ID); err != nil {
+				return err
+			}
+			quantity, err := cartQuantity(tx, cart.ID, item.ProductID, item.VariantID)
+			if err != nil {
+				return err
+			}
+			if err := setCartQuantity(tx, cart.ID, item.ProductID, item.VariantID, quantity+request.Quantity); err != nil {
+				return err
+			}
+			return tx.Delete(item).Error
+		})
+	}
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return r.GetCart(ctx)
+}
+
+// Move a cart line to the caller's saved-for-later list
+func (r *Repository) SaveCartItemForLater(ctx *fiber.Ctx) error {
+	productID, variantID, err := cartLineParams(ctx)
+	if err != nil {
+		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
+			"message": "Invalid product ID",
+		})
+		return nil
+	}
+	account := currentAccount(ctx)
+	cart, err := cartForAccount(r.DB, account.ID)
+	var wishlist *Wishlist
+	if err == nil {
+		wishlist, err = savedForLater(r.DB, account.ID)
+	}
+	if err == nil {
+		err = r.DB.Transaction(func(tx *gorm.DB) error {
+			if err := lockCart(tx, cart.ID); err != nil {
+				return err
+			}
+			quantity, err := cartQuantity(tx, cart.ID, productID, variantID)
+			if err != nil {
+				return err
+			}
+			if quantity == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			request := WishlistItemRequest{ProductID: productID, VariantID: variantID}
+			if _, err := addWishlistItem(tx, wishlist.ID, request); err != nil {
+				return err
+			}
+			return setCartQuantity(tx, cart.ID, productID, variantID, 0)
+		})
+	}
+	if err != nil {
+		return respondCartError(ctx, err)
+	}
+	return r.GetCart(ctx)
+}
+
+// Share a wishlist. The returned token gives read access to anyone who has
+// it; sharing again keeps the same token.
+func (r *Repository) ShareWishlist(context *fiber.Ctx) error {
+	wishlist, err := r.findCallerWishlist(context)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	if wishlist.ShareToken == nil {
+		token := randomToken(24)
+		if err := r.DB.Model(wishlist).Update("share_token", token).Error; err != nil {
+			return respondWishlistError(context, err)
+		}
+		wishlist.ShareToken = &token
+	}
+	return context.JSON(fiber.Map{
+		"share_token": *wishlist.ShareToken,
+		"path":        "/api/wishlists/shared/" + *wishlist.ShareToken,
+	})
+}
+
+// Stop sharing a wishlist; the old link stops working
+func (r *Repository) UnshareWishlist(context *fiber.Ctx) error {
+	wishlist, err := r.findCallerWishlist(context)
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	if err := r.DB.Model(wishlist).Update("share_token", nil).Error; err != nil {
+		return respondWishlistError(context, err)
+	}
+	wishlist.ShareToken = nil
+	return r.respondWishlist(context, wishlist, http.StatusOK)
+}
+
+// View a shared wishlist
+func (r *Repository) GetSharedWishlist(context *fiber.Ctx) error {
+	token := context.Params("token")
+	wishlist := &Wishlist{}
+	err := r.DB.Where("share_token = ?", token).First(wishlist).Error
+	if gorm.IsRecordNotFoundError(err) || token == "" {
+		return respondWishlistError(context, errWishlistNotFound)
+	}
+	if err != nil {
+		return respondWishlistError(context, err)
+	}
+	// The owner's account and the token are not shown to visitors
+	wishlist.AccountID, wishlist.ShareToken = 0, nil
+	return r.respondWishlist(context, wishlist, http.StatusOK)
+}
+
+// wishlistChange is a price drop or return to stock of one watched item
+type wishlistChange struct {
+	AccountID uint
+	Title     string
+	Was, Now  *money.Money
+	Restocked bool
+}
+
+// wishlistObservation is the current price and stock of one watched item,
+// with the change to tell its owner about, if any
+type wishlistObservation struct {
+	Item    WishlistItem
+	Price   money.Money
+	InStock bool
+	Change  *wishlistChange
+}
+
+// watchWishlists compares watched items with the current prices and stock.
+// Nothing is recorded here, so a change stays pending until its owner has
+// been told. Items that cannot be looked up are logged and skipped.
+func watchWishlists(db *gorm.DB) ([]wishlistObservation, error) {
+	var items []WishlistItem
+	err := db.Where("notify_price_drop = ? OR notify_back_in_stock = ?", true, true).Order("id").Find(&items).Error
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	var wishlistIDs []uint
+	for _, item := range items {
+		wishlistIDs = append(wishlistIDs, item.WishlistID)
+	}
+	var wishlists []Wishlist
+	if err := db.Where("id IN (?)", wishlistIDs).Find(&wishlists).Error; err != nil {
+		return nil, err
+	}
+	owners := map[uint]uint{}
+	for _, wishlist := range wishlists {
+		owners[wishlist.ID] = wishlist.AccountID
+	}
+	var observations []wishlistObservation
+	for _, item := range items {
+		sellable, err := findSellable(db, item.ProductID, item.VariantID)
+		if gorm.IsRecordNotFoundError(err) || errors.Is(err, errVariantNotFound) || errors.Is(err, errVariantRequired) {
+			continue
+		}
+		if err != nil {
+			log.Printf("wishlist watch: item %d: %v", item.ID, err)
+			continue
+		}
+		observation := wishlistObservation{Item: item, Price: sellable.Price, InStock: sellable.Available > 0}
+		change := wishlistChange{AccountID: owners[item.WishlistID], Title: sellable.Title}
+		notify := false
+		if item.NotifyPriceDrop && item.WatchPrice.Currency == sellable.Price.Currency &&
+			sellable.Price.Cmp(item.WatchPrice) < 0 {
+			was, now := item.WatchPrice, sellable.Price
+			change.Was, change.Now = &was, &now
+			notify = true
+		}
+		if item.NotifyBackInStock && observation.InStock && !item.InStock {
+			change.Restocked = true
+			notify = true
+		}
+		if notify {
+			observation.Change = &change
+		}
+		observations = append(observations, observation)
+	}
+	return observations, nil
+}
+
+// recordWishlistObservation remembers what was seen of an item, so the same
+// change is not reported twice
+func recordWishlistObservation(db *gorm.DB, observation wishlistObservation) error {
+	item := observation.Item
+	if item.WatchPrice == observation.Price && item.InStock == observation.InStock {
+		return nil
+	}
+	return db.Model(&item).Updates(map[string]interface{}{
+		"watch_price_amount":   observation.Price.Amount,
+		"watch_price_currency": observation.Price.Currency,
+		"in_stock":             observation.InStock,
+	}).Error
+}
+
+// wishlistNotification describes the changes for one account
+func wishlistNotification(changes []wishlistChange) Notification {
+	var text strings.Builder
+	for _, change := range changes {
+		if change.Now != nil {
+			fmt.Fprintf(&text, "%s is now %s (was %s)\n", change.Title, change.Now.String(), change.Was.String())
+		}
+		if change.Restocked {
+			fmt.Fprintf(&text, "%s is back in stock\n", change.Title)
+		}
+	}
+	return Notification{
+		Kind:    "wishlist",
+		Subject: "Updates on your wishlist",
+		Text:    text.String(),
+		Data:    changes,
+	}
+}
+
+// runWishlistWatch tells owners about price drops and restocks every
+// WishlistWatch until the process exits. Changes are only recorded once
+// the owner has been told, so failed notifications are retried on the next
+// run.
+func (r *Repository) runWishlistWatch() {
+	for range time.Tick(r.WishlistWatch) {
+		observations, err := watchWishlists(r.DB)
+		if err != nil {
+			log.Printf("wishlist watch: %v", err)
+			continue
+		}
+		byAccount := map[uint][]wishlistObservation{}
+		var accountIDs []uint
+		for _, observation := range observations {
+			if observation.Change == nil {
+				if err := recordWishlistObservation(r.DB, observation); err != nil {
+					log.Printf("wishlist watch: item %d: %v", observation.Item.ID, err)
+				}
+				continue
+			}
+			accountID := observation.Change.AccountID
+			if _, ok := byAccount[accountID]; !ok {
+				accountIDs = append(accountIDs, accountID)
+			}
+			byAccount[accountID] = append(byAccount[accountID], observation)
+		}
+		for _, accountID := range accountIDs {
+			account := &Account{}
+			if err := r.DB.Where("id = ?", accountID).First(account).Error; err != nil {
+				log.Printf("wishlist watch: account %d: %v", accountID, err)
+				continue
+			}
+			var changes []wishlistChange
+			for _, observation := range byAccount[accountID] {
+				changes = append(changes, *observation.Change)
+			}
+			err := r.Customers.NotifyCustomer(context.Background(), account, wishlistNotification(changes))
+			if err != nil {
+				log.Printf("wishlist notification for account %d: %v", accountID, err)
+				continue
+			}
+			for _, observation := range byAccount[accountID] {
+				if err := recordWishlistObservation(r.DB, observation); err != nil {
+					log.Printf("wishlist watch: item %d: %v", observation.Item.ID, err)
+				}
+			}
+		}
+	}
+}